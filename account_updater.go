@@ -0,0 +1,115 @@
+package main
+
+import (
+	"authnet/authorizenet"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// auOutcome classifies an Account Updater change into what happened to the stored card
+// and whether someone has to reach out to the customer about it.
+func auOutcome(changeType, reasonCode string) (outcome string, needsContact bool) {
+	if changeType == "delete" {
+		return "deleted", true
+	}
+	switch reasonCode {
+	case authorizenet.AUNewAccountNumber:
+		return "updated", false
+	case authorizenet.AUNewExpirationDate:
+		return "expiration-updated", false
+	case authorizenet.AUAccountClosed:
+		return "closed", true
+	case authorizenet.AUContactCardholder:
+		return "contact-cardholder", true
+	}
+	return "unknown", true
+}
+
+// runAUReport pulls the Account Updater report for one month and records every card change.
+// It is meant to run monthly from cron: `authnet au-report -month 2026-09`.
+func runAUReport(client *authorizenet.APIClient, db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("au-report", flag.ContinueOnError)
+	defaultMonth := time.Now().AddDate(0, -1, 0).Format("2006-01")
+	month := fs.String("month", defaultMonth, "report month as YYYY-MM")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := time.Parse("2006-01", *month); err != nil {
+		return fmt.Errorf("invalid month %q, expected YYYY-MM", *month)
+	}
+
+	summary, err := client.GetAUJobSummary(*month)
+	if err != nil {
+		return fmt.Errorf("failed to get Account Updater summary: %v", err)
+	}
+	for _, s := range summary {
+		slog.Info("Account Updater summary", "month", *month, "reason_code", s.AuReasonCode, "reason", s.ReasonDescription, "profiles", s.ProfileCount)
+	}
+
+	const pageSize = 1000
+	recorded := 0
+	contactNeeded := map[string]bool{}
+
+	for page := 1; ; page++ {
+		details, total, err := client.GetAUJobDetails(*month, authorizenet.AUModifiedTypeAll, &authorizenet.Paging{Limit: pageSize, Offset: page})
+		if err != nil {
+			return fmt.Errorf("failed to get Account Updater details page %d: %v", page, err)
+		}
+
+		changes := 0
+		for changeType, list := range map[string][]authorizenet.AUChange{"update": details.AuUpdate, "delete": details.AuDelete} {
+			for _, change := range list {
+				changes++
+				outcome, needsContact := auOutcome(changeType, change.AuReasonCode)
+				if err := recordAUChange(db, *month, changeType, outcome, change, needsContact); err != nil {
+					return err
+				}
+				recorded++
+				if needsContact {
+					contactNeeded[change.CustomerProfileId] = true
+				}
+			}
+		}
+
+		if changes < pageSize || page*pageSize >= total {
+			break
+		}
+	}
+
+	slog.Info("Account Updater report recorded", "month", *month, "changes", recorded, "profiles_needing_contact", len(contactNeeded))
+	for profileID := range contactNeeded {
+		slog.Warn("Account Updater customer needs contact", "month", *month, "customer_profile_id", profileID)
+	}
+	return nil
+}
+
+func recordAUChange(db *sql.DB, month, changeType, outcome string, change authorizenet.AUChange, needsContact bool) error {
+	var oldCard, newCard authorizenet.MaskedCreditCard
+	if change.OldCreditCard != nil {
+		oldCard = *change.OldCreditCard
+	}
+	if change.NewCreditCard != nil {
+		newCard = *change.NewCreditCard
+	}
+
+	stmt := `
+		INSERT INTO account_updater_events (
+			report_month, customer_profile_id, customer_payment_profile_id, change_type, outcome,
+			reason_code, reason_description, old_card_number, old_expiration_date,
+			new_card_number, new_expiration_date, update_time_utc, needs_contact
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (customer_payment_profile_id, reason_code, update_time_utc) DO NOTHING;
+	`
+	_, err := db.Exec(stmt,
+		month, change.CustomerProfileId, change.CustomerPaymentProfileId, changeType, outcome,
+		change.AuReasonCode, change.ReasonDescription, oldCard.CardNumber, oldCard.ExpirationDate,
+		newCard.CardNumber, newCard.ExpirationDate, change.UpdateTimeUTC, needsContact,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record Account Updater change for payment profile %s: %v", change.CustomerPaymentProfileId, err)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package authorizenet
+
+// Account Updater reason codes reported by getAUJobSummaryRequest and getAUJobDetailsRequest.
+const (
+	AUNewAccountNumber   = "NAN"
+	AUNewExpirationDate  = "NED"
+	AUAccountClosed      = "ACL"
+	AUContactCardholder  = "CCH"
+	AUModifiedTypeAll    = "all"
+	AUModifiedTypeUpdate = "updates"
+	AUModifiedTypeDelete = "deletes"
+)
+
+type AUSummary struct {
+	AuReasonCode      string `json:"auReasonCode"`
+	ProfileCount      int    `json:"profileCount"`
+	ReasonDescription string `json:"reasonDescription"`
+}
+
+type AUChange struct {
+	CustomerProfileId        string            `json:"customerProfileID"`
+	CustomerPaymentProfileId string            `json:"customerPaymentProfileID"`
+	FirstName                string            `json:"firstName,omitempty"`
+	LastName                 string            `json:"lastName,omitempty"`
+	UpdateTimeUTC            string            `json:"updateTimeUTC"`
+	AuReasonCode             string            `json:"auReasonCode"`
+	ReasonDescription        string            `json:"reasonDescription"`
+	NewCreditCard            *MaskedCreditCard `json:"newCreditCard,omitempty"`
+	OldCreditCard            *MaskedCreditCard `json:"oldCreditCard,omitempty"`
+}
+
+type AUDetails struct {
+	AuUpdate []AUChange `json:"auUpdate,omitempty"`
+	AuDelete []AUChange `json:"auDelete,omitempty"`
+}
+
+type GetAUJobSummaryRequest struct {
+	MerchantAuthentication MerchantAuthentication `json:"merchantAuthentication"`
+	Month                  string                 `json:"month"`
+}
+
+type GetAUJobSummaryResponse struct {
+	AuSummary struct {
+		AuResponse []AUSummary `json:"auResponse"`
+	} `json:"auSummary"`
+	Messages ResponseMessages `json:"messages"`
+}
+
+// GetAUJobSummary returns how many profiles Account Updater changed in month (YYYY-MM), per reason code.
+func (c *APIClient) GetAUJobSummary(month string) ([]AUSummary, error) {
+	requestWrapper := struct {
+		Request GetAUJobSummaryRequest `json:"getAUJobSummaryRequest"`
+	}{
+		Request: GetAUJobSummaryRequest{
+			MerchantAuthentication: c.Auth,
+			Month:                  month,
+		},
+	}
+
+	var response GetAUJobSummaryResponse
+	if err := c.makeRequest(requestWrapper, &response); err != nil {
+		return nil, err
+	}
+	if err := response.Messages.Err(); err != nil {
+		return nil, err
+	}
+
+	return response.AuSummary.AuResponse, nil
+}
+
+type GetAUJobDetailsRequest struct {
+	MerchantAuthentication MerchantAuthentication `json:"merchantAuthentication"`
+	Month                  string                 `json:"month"`
+	ModifiedTypeFilter     string                 `json:"modifiedTypeFilter,omitempty"`
+	Paging                 *Paging                `json:"paging,omitempty"`
+}
+
+type GetAUJobDetailsResponse struct {
+	TotalNumInResultSet int              `json:"totalNumInResultSet"`
+	AuDetails           AUDetails        `json:"auDetails"`
+	Messages            ResponseMessages `json:"messages"`
+}
+
+// GetAUJobDetails returns one page of the individual card changes Account Updater made in month.
+// Offset in paging is the 1-based page number.
+func (c *APIClient) GetAUJobDetails(month, modifiedTypeFilter string, paging *Paging) (*AUDetails, int, error) {
+	requestWrapper := struct {
+		Request GetAUJobDetailsRequest `json:"getAUJobDetailsRequest"`
+	}{
+		Request: GetAUJobDetailsRequest{
+			MerchantAuthentication: c.Auth,
+			Month:                  month,
+			ModifiedTypeFilter:     modifiedTypeFilter,
+			Paging:                 paging,
+		},
+	}
+
+	var response GetAUJobDetailsResponse
+	if err := c.makeRequest(requestWrapper, &response); err != nil {
+		return nil, 0, err
+	}
+	if err := response.Messages.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return &response.AuDetails, response.TotalNumInResultSet, nil
+}
@@ -0,0 +1,58 @@
+package authorizenet_test
+
+import (
+	"authnet/authorizenet"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// serveFixture answers every request with the response body in the named testdata file and
+// records the last request body it received.
+func serveFixture(t *testing.T, name string) (*httptest.Server, *string) {
+	t.Helper()
+	body, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		received = string(data)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &received
+}
+
+// TestGetAUJobSummary decodes the getAUJobSummaryResponse example from the Authorize.Net API
+// reference, which nests the per-reason counts in auSummary.auResponse.
+func TestGetAUJobSummary(t *testing.T) {
+	srv, received := serveFixture(t, "getAUJobSummaryResponse.json")
+	client := authorizenet.NewAPIClient("login", "key", srv.URL)
+
+	summary, err := client.GetAUJobSummary("2026-09")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []authorizenet.AUSummary{
+		{AuReasonCode: authorizenet.AUAccountClosed, ProfileCount: 1, ReasonDescription: "AccountClosed"},
+		{AuReasonCode: authorizenet.AUNewAccountNumber, ProfileCount: 2, ReasonDescription: "NewAccountNumber"},
+		{AuReasonCode: authorizenet.AUNewExpirationDate, ProfileCount: 12, ReasonDescription: "NewExpirationDate"},
+	}
+	if len(summary) != len(want) {
+		t.Fatalf("got %+v, want %+v", summary, want)
+	}
+	for i := range want {
+		if summary[i] != want[i] {
+			t.Errorf("summary[%d] = %+v, want %+v", i, summary[i], want[i])
+		}
+	}
+	if !strings.Contains(*received, `"getAUJobSummaryRequest"`) || !strings.Contains(*received, `"month":"2026-09"`) {
+		t.Errorf("unexpected request %s", *received)
+	}
+}
@@ -1,13 +1,20 @@
 package authorizenet
 
 import (
+	"authnet/redact"
 	"bytes"
+	"context"
 	// "crypto/des"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"iter"
+	"log/slog"
 	"net/http"
+	"sort"
+	"sync"
+	"time"
 )
 
 const (
@@ -23,6 +30,11 @@ type MerchantAuthentication struct {
 type APIClient struct {
 	Auth     MerchantAuthentication
 	Endpoint string
+	// Logger receives one line per gateway call. slog.Default() is used when nil.
+	Logger *slog.Logger
+	// HTTPClient sends the requests. A plain http.Client is used when nil; tests set one
+	// with a recording or replaying transport.
+	HTTPClient *http.Client
 }
 
 func NewAPIClient(apiLoginID, transactionKey, endpoint string) *APIClient {
@@ -35,24 +47,105 @@ func NewAPIClient(apiLoginID, transactionKey, endpoint string) *APIClient {
 	}
 }
 
-func (c *APIClient) makeRequest(requestBody interface{}, response interface{}) error {
+// WithLogger returns a copy of the client that logs through logger, so gateway calls made
+// while serving a request carry that request's correlation fields.
+func (c *APIClient) WithLogger(logger *slog.Logger) *APIClient {
+	clone := *c
+	clone.Logger = logger
+	return &clone
+}
+
+func (c *APIClient) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// operationName returns the request type, e.g. "createTransactionRequest", from a marshalled request.
+func operationName(jsonData []byte) string {
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(jsonData, &envelope); err != nil {
+		return "unknown"
+	}
+	for name := range envelope {
+		return name
+	}
+	return "unknown"
+}
+
+// gatewayOutcome holds the fields of a response worth putting on the log line.
+type gatewayOutcome struct {
+	Messages            ResponseMessages `json:"messages"`
+	TransactionResponse struct {
+		ResponseCode string `json:"responseCode"`
+		TransId      string `json:"transId"`
+	} `json:"transactionResponse"`
+}
+
+func (c *APIClient) logCall(operation string, started time.Time, status int, body []byte, err error) {
+	attrs := []slog.Attr{
+		slog.String("operation", operation),
+		slog.Duration("latency", time.Since(started)),
+	}
+	if status != 0 {
+		attrs = append(attrs, slog.Int("http_status", status))
+	}
+
+	var outcome gatewayOutcome
+	if len(body) > 0 && json.Unmarshal(body, &outcome) == nil {
+		attrs = append(attrs, slog.String("result_code", outcome.Messages.ResultCode))
+		if len(outcome.Messages.Message) > 0 {
+			attrs = append(attrs, slog.String("message_code", outcome.Messages.Message[0].Code))
+		}
+		if outcome.TransactionResponse.TransId != "" {
+			attrs = append(attrs,
+				slog.String("trans_id", outcome.TransactionResponse.TransId),
+				slog.String("response_code", outcome.TransactionResponse.ResponseCode),
+			)
+		}
+	}
+
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelError
+		attrs = append(attrs, slog.String("error", err.Error()))
+	} else if outcome.Messages.ResultCode != "" && outcome.Messages.ResultCode != "Ok" {
+		level = slog.LevelWarn
+	}
+	c.logger().LogAttrs(context.Background(), level, "gateway call", attrs...)
+}
+
+func (c *APIClient) makeRequest(requestBody interface{}, response interface{}) (err error) {
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
 		return fmt.Errorf("failed to marshal request: %v", err)
 	}
 
+	started := time.Now()
+	operation := operationName(jsonData)
+	var status int
+	var loggedBody []byte
+	defer func() {
+		c.logCall(operation, started, status, loggedBody, err)
+	}()
+
 	req, err := http.NewRequest("POST", c.Endpoint, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	client := c.HTTPClient
+	if client == nil {
+		client = &http.Client{}
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %v", err)
 	}
 	defer resp.Body.Close()
+	status = resp.StatusCode
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -66,10 +159,11 @@ func (c *APIClient) makeRequest(requestBody interface{}, response interface{}) e
 	if len(trimmedBody) > 0 {
 		bom := []byte{0xef, 0xbb, 0xbf}
 		bodyToParse := bytes.TrimPrefix(trimmedBody, bom)
+		loggedBody = bodyToParse
 
 		if err := json.Unmarshal(bodyToParse, response); err != nil {
 			// Updated error message to include the problematic body for easier debugging
-			return fmt.Errorf("failed to unmarshal response: %v. Body received: %s", err, string(bodyToParse))
+			return fmt.Errorf("failed to unmarshal response: %v. Body received: %s", err, redact.JSON(bodyToParse))
 		}
 	}
 
@@ -113,14 +207,14 @@ func (c *APIClient) CreateCustomerProfile(profile CustomerProfile, validationMod
 			ValidationMode:         validationMode,
 		},
 	}
-	log.Printf("CreateCustomerProfile:ValidationMode:%s", validationMode)
+	c.logger().Debug("creating customer profile", "validation_mode", validationMode)
 	var response CreateCustomerProfileResponse
 	if err := c.makeRequest(requestWrapper, &response); err != nil {
 		return "", err
 	}
 
 	if response.Messages.ResultCode != "Ok" {
-		log.Printf("Authorize.Net Error Response: %+v", response)
+		c.logger().Warn("create customer profile rejected", "response", response)
 		if len(response.Messages.Message) > 0 {
 			return "", fmt.Errorf("API error %s %s", response.Messages.Message[0].Text, response.Messages.Message[0].Code)
 		}
@@ -131,7 +225,9 @@ func (c *APIClient) CreateCustomerProfile(profile CustomerProfile, validationMod
 
 type GetCustomerProfileRequest struct {
 	MerchantAuthentication MerchantAuthentication `json:"merchantAuthentication"`
-	CustomerProfileId      string                 `json:"customerProfileId"`
+	CustomerProfileId      string                 `json:"customerProfileId,omitempty"`
+	MerchantCustomerId     string                 `json:"merchantCustomerId,omitempty"`
+	Email                  string                 `json:"email,omitempty"`
 }
 
 type GetCustomerProfileResponse struct {
@@ -147,7 +243,7 @@ type GetCustomerProfileResponse struct {
 
 // Change the function signature to return *CustomerProfile
 func (c *APIClient) GetCustomerProfile(profileID string) (*CustomerProfile, error) {
-	log.Println("--- GetCustomerProfile ---")
+	c.logger().Debug("getting customer profile", "customer_profile_id", profileID)
 
 	requestWrapper := struct {
 		Request GetCustomerProfileRequest `json:"getCustomerProfileRequest"`
@@ -175,6 +271,51 @@ func (c *APIClient) GetCustomerProfile(profileID string) (*CustomerProfile, erro
 	return &response.Profile, nil
 }
 
+// ErrProfileNotFound is returned by GetCustomerProfileBy when no profile matches.
+var ErrProfileNotFound = errors.New("customer profile not found")
+
+// ProfileLookup finds a customer profile by our own identifiers instead of its gateway ID.
+// When both fields are set, both must match.
+type ProfileLookup struct {
+	MerchantCustomerId string
+	Email              string
+}
+
+// GetCustomerProfileBy looks up a customer profile by merchantCustomerId and/or email.
+func (c *APIClient) GetCustomerProfileBy(lookup ProfileLookup) (*CustomerProfile, error) {
+	if lookup.MerchantCustomerId == "" && lookup.Email == "" {
+		return nil, errors.New("profile lookup needs a merchantCustomerId or email")
+	}
+	c.logger().Debug("looking up customer profile", "merchant_customer_id", lookup.MerchantCustomerId)
+
+	requestWrapper := struct {
+		Request GetCustomerProfileRequest `json:"getCustomerProfileRequest"`
+	}{
+		Request: GetCustomerProfileRequest{
+			MerchantAuthentication: c.Auth,
+			MerchantCustomerId:     lookup.MerchantCustomerId,
+			Email:                  lookup.Email,
+		},
+	}
+
+	var response GetCustomerProfileResponse
+	if err := c.makeRequest(requestWrapper, &response); err != nil {
+		return nil, err
+	}
+
+	if response.Messages.ResultCode != "Ok" {
+		if len(response.Messages.Message) > 0 {
+			if response.Messages.Message[0].Code == "E00040" {
+				return nil, ErrProfileNotFound
+			}
+			return nil, fmt.Errorf("API error: %s", response.Messages.Message[0].Text)
+		}
+		return nil, fmt.Errorf("API error: unknown error from Authorize.Net")
+	}
+
+	return &response.Profile, nil
+}
+
 type Paging struct {
 	Limit  int `json:"limit"`
 	Offset int `json:"offset"`
@@ -197,68 +338,234 @@ type GetCustomerProfileIdsResponse struct {
 	} `json:"messages"`
 }
 
-func (c *APIClient) GetAllCustomerProfileIds() ([]string, error) {
-	var allProfileIds []string
-	limit := 1000
-	offset := 1
+// DefaultProfileIdPageSize is the page size used when paging through profile IDs.
+const DefaultProfileIdPageSize = 1000
 
-	for {
-		requestWrapper := struct {
-			GetCustomerProfileIdsRequest GetCustomerProfileIdsRequest `json:"getCustomerProfileIdsRequest"`
-		}{
-			GetCustomerProfileIdsRequest: GetCustomerProfileIdsRequest{
-				MerchantAuthentication: c.Auth,
-				Paging: &Paging{
-					Limit:  limit,
-					Offset: offset,
-				},
-			},
-		}
+// CustomerProfileIds pages lazily through getCustomerProfileIdsRequest, requesting the next
+// page only when the caller has consumed the previous one. A failed page yields ("", err) and
+// ends the sequence.
+func (c *APIClient) CustomerProfileIds(pageSize int) iter.Seq2[string, error] {
+	if pageSize < 1 {
+		pageSize = DefaultProfileIdPageSize
+	}
 
-		var responseWrapper struct {
-			GetCustomerProfileIdsResponse GetCustomerProfileIdsResponse `json:"getCustomerProfileIdsResponse"`
-		}
-		if err := c.makeRequest(requestWrapper, &responseWrapper); err != nil {
-			return nil, fmt.Errorf("failed to make API request: %v", err)
-		}
+	return func(yield func(string, error) bool) {
+		seen := 0
+		// Authorize.Net paging offsets are 1-based page numbers, not record offsets.
+		for page := 1; ; page++ {
+			requestWrapper := struct {
+				GetCustomerProfileIdsRequest GetCustomerProfileIdsRequest `json:"getCustomerProfileIdsRequest"`
+			}{
+				GetCustomerProfileIdsRequest: GetCustomerProfileIdsRequest{
+					MerchantAuthentication: c.Auth,
+					Paging: &Paging{
+						Limit:  pageSize,
+						Offset: page,
+					},
+				},
+			}
 
-		response := responseWrapper.GetCustomerProfileIdsResponse
+			var response GetCustomerProfileIdsResponse
+			if err := c.makeRequest(requestWrapper, &response); err != nil {
+				yield("", fmt.Errorf("failed to make API request: %v", err))
+				return
+			}
 
-		if response.Messages.ResultCode != "Ok" {
-			if len(response.Messages.Message) > 0 {
-				return nil, fmt.Errorf("API error: %s", response.Messages.Message[0].Text)
+			if response.Messages.ResultCode != "Ok" {
+				if len(response.Messages.Message) > 0 {
+					yield("", fmt.Errorf("API error: %s", response.Messages.Message[0].Text))
+					return
+				}
+				yield("", fmt.Errorf("API error: unknown error"))
+				return
 			}
-			return nil, fmt.Errorf("API error: unknown error")
-		}
 
-		allProfileIds = append(allProfileIds, response.Ids...)
+			for _, id := range response.Ids {
+				if !yield(id, nil) {
+					return
+				}
+			}
+			seen += len(response.Ids)
 
-		if len(response.Ids) < limit {
-			break
+			// A short page is the last one. A page longer than requested means the gateway
+			// ignored paging and returned everything at once.
+			if len(response.Ids) < pageSize || len(response.Ids) > pageSize {
+				return
+			}
+			if response.TotalNumInResultSet > 0 && seen >= response.TotalNumInResultSet {
+				return
+			}
 		}
+	}
+}
 
-		offset += limit
+// CustomerProfiles yields every customer profile, hydrating each ID with getCustomerProfileRequest
+// as the caller consumes the sequence. A profile that cannot be fetched yields a
+// *ProfileFetchError and the sequence continues; a failure listing IDs ends it.
+func (c *APIClient) CustomerProfiles(pageSize int) iter.Seq2[*CustomerProfile, error] {
+	return func(yield func(*CustomerProfile, error) bool) {
+		for id, err := range c.CustomerProfileIds(pageSize) {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			profile, err := c.GetCustomerProfile(id)
+			if err != nil {
+				err = &ProfileFetchError{ProfileId: id, Err: err}
+			}
+			if !yield(profile, err) {
+				return
+			}
+		}
 	}
+}
 
+func (c *APIClient) GetAllCustomerProfileIds() ([]string, error) {
+	var allProfileIds []string
+	for id, err := range c.CustomerProfileIds(DefaultProfileIdPageSize) {
+		if err != nil {
+			return nil, err
+		}
+		allProfileIds = append(allProfileIds, id)
+	}
 	return allProfileIds, nil
 }
 
+// FetchOptions controls how GetAllCustomerProfilesWithOptions hydrates profiles.
+type FetchOptions struct {
+	// Workers is the number of concurrent getCustomerProfileRequest calls.
+	Workers int
+	// RequestsPerSecond caps the rate of getCustomerProfileRequest calls across all workers.
+	// Zero means unlimited.
+	RequestsPerSecond float64
+	// Progress, when set, is called after each profile is fetched or fails.
+	Progress func(done, total int)
+}
+
+// DefaultFetchOptions keeps well under the gateway's throttling limits.
+var DefaultFetchOptions = FetchOptions{
+	Workers:           4,
+	RequestsPerSecond: 10,
+}
+
+// ProfileFetchError is one profile that could not be fetched.
+type ProfileFetchError struct {
+	ProfileId string
+	Err       error
+}
+
+func (e *ProfileFetchError) Error() string {
+	return fmt.Sprintf("failed to fetch customer profile %s: %v", e.ProfileId, e.Err)
+}
+
+func (e *ProfileFetchError) Unwrap() error {
+	return e.Err
+}
+
+// PartialFetchError is returned alongside the profiles that were fetched when some failed.
+type PartialFetchError struct {
+	Total  int
+	Failed []ProfileFetchError
+}
+
+func (e *PartialFetchError) Error() string {
+	if len(e.Failed) == 0 {
+		return "no profiles failed"
+	}
+	return fmt.Sprintf("failed to fetch %d of %d customer profiles, first error (profile %s): %v",
+		len(e.Failed), e.Total, e.Failed[0].ProfileId, e.Failed[0].Err)
+}
+
 func (c *APIClient) GetAllCustomerProfiles() ([]CustomerProfile, error) {
-	log.Println("Get All Customer Profiles")
+	return c.GetAllCustomerProfilesWithOptions(DefaultFetchOptions)
+}
+
+// GetAllCustomerProfilesWithOptions fetches every profile with a bounded, rate-limited worker
+// pool. Profiles are returned in ID order. If some profiles fail, the rest are still returned
+// together with a *PartialFetchError listing the failures.
+func (c *APIClient) GetAllCustomerProfilesWithOptions(opts FetchOptions) ([]CustomerProfile, error) {
+	c.logger().Debug("getting all customer profiles", "workers", opts.Workers, "requests_per_second", opts.RequestsPerSecond)
 	ids, err := c.GetAllCustomerProfileIds()
 	if err != nil {
 		return nil, err
 	}
+	return c.GetCustomerProfilesWithOptions(ids, opts)
+}
+
+// GetCustomerProfilesWithOptions fetches the given profiles the same way as
+// GetAllCustomerProfilesWithOptions, for callers that already hold the ID list.
+func (c *APIClient) GetCustomerProfilesWithOptions(ids []string, opts FetchOptions) ([]CustomerProfile, error) {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(ids) {
+		workers = len(ids)
+	}
 
-	var profiles []CustomerProfile
-	for _, id := range ids {
-		// 'profile' is now type *CustomerProfile
-		profile, err := c.GetCustomerProfile(id)
-		if err != nil {
-			return nil, err
+	var limiter <-chan time.Time
+	if opts.RequestsPerSecond > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.RequestsPerSecond))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	type result struct {
+		index   int
+		profile *CustomerProfile
+		err     error
+	}
+
+	jobs := make(chan int)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if limiter != nil {
+					<-limiter
+				}
+				profile, err := c.GetCustomerProfile(ids[i])
+				results <- result{index: i, profile: profile, err: err}
+			}
+		}()
+	}
+	go func() {
+		for i := range ids {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	fetched := make([]*CustomerProfile, len(ids))
+	partial := &PartialFetchError{Total: len(ids)}
+	done := 0
+	for res := range results {
+		done++
+		if res.err != nil {
+			partial.Failed = append(partial.Failed, ProfileFetchError{ProfileId: ids[res.index], Err: res.err})
+		} else {
+			fetched[res.index] = res.profile
+		}
+		if opts.Progress != nil {
+			opts.Progress(done, len(ids))
+		}
+	}
+
+	profiles := make([]CustomerProfile, 0, len(ids))
+	for _, profile := range fetched {
+		if profile != nil {
+			profiles = append(profiles, *profile)
 		}
-		// Append the dereferenced struct, not profile.Profile
-		profiles = append(profiles, *profile)
+	}
+
+	if len(partial.Failed) > 0 {
+		sort.Slice(partial.Failed, func(i, j int) bool { return partial.Failed[i].ProfileId < partial.Failed[j].ProfileId })
+		return profiles, partial
 	}
 	return profiles, nil
 }
@@ -270,7 +577,7 @@ type Order struct {
 
 type TransactionRequestType struct {
 	TransactionType string `json:"transactionType"`
-	Amount          string `json:"amount"`
+	Amount          string `json:"amount,omitempty"`
 	Profile         *struct {
 		CustomerProfileID string `json:"customerProfileId"`
 		PaymentProfile    struct {
@@ -314,7 +621,14 @@ type CreateTransactionResponse struct {
 }
 
 func (c *APIClient) ChargeCustomerProfile(profileID, paymentProfileID, amount, invoiceNumber, transactionType, description string) (*FullTransactionResponse, error) {
-	log.Printf("ChargeCustomerProfile %s %s %s %s %s |%s|", profileID, paymentProfileID, amount, invoiceNumber, description, transactionType)
+	c.logger().Debug("charging customer profile",
+		"customer_profile_id", profileID,
+		"payment_profile_id", paymentProfileID,
+		"amount", amount,
+		"invoice_number", invoiceNumber,
+		"description", description,
+		"transaction_type", transactionType,
+	)
 
 	finalTransactionType := "authCaptureTransaction"
 	if transactionType == "authOnlyTransaction" {
@@ -356,19 +670,18 @@ func (c *APIClient) ChargeCustomerProfile(profileID, paymentProfileID, amount, i
 		},
 	}
 
-	log.Printf("Backend Charge Request %+v", request)
-	// log.Println("Backend Charge Request")
+	c.logger().Debug("backend charge request", "request", request)
 	var response CreateTransactionResponse
 	if err := c.makeRequest(request, &response); err != nil {
 		return nil, err
 	}
 	if response.Messages.ResultCode != "Ok" {
 		if len(response.Messages.Message) > 0 {
-			log.Printf("Error charging customer profile, %s", response.Messages.Message[0].Text)
-			return nil, fmt.Errorf("API error: %s", response.Messages.Message[0].Text)
+			c.logger().Warn("charge customer profile rejected", "customer_profile_id", profileID, "error", response.Messages.Message[0].Text)
+			return declinedResponse(&response), fmt.Errorf("API error: %s", response.Messages.Message[0].Text)
 		}
-		log.Println("API Error: unknown error")
-		return nil, fmt.Errorf("API error: unknown error")
+		c.logger().Warn("charge customer profile rejected with unknown error", "customer_profile_id", profileID)
+		return declinedResponse(&response), fmt.Errorf("API error: unknown error")
 	}
 	return &response.TransactionResponse, nil
 }
@@ -409,9 +722,9 @@ func (c *APIClient) AuthorizeCustomerProfile(profileID, paymentProfileID, amount
 	}
 	if response.Messages.ResultCode != "Ok" {
 		if len(response.Messages.Message) > 0 {
-			return nil, fmt.Errorf("API error: %s", response.Messages.Message[0].Text)
+			return declinedResponse(&response), fmt.Errorf("API error: %s", response.Messages.Message[0].Text)
 		}
-		return nil, fmt.Errorf("API error: unknown error")
+		return declinedResponse(&response), fmt.Errorf("API error: unknown error")
 	}
 	return &response.TransactionResponse, nil
 }
@@ -440,9 +753,9 @@ func (c *APIClient) CapturePriorAuthTransaction(refTransId, amount string) (*Ful
 
 	if response.Messages.ResultCode != "Ok" {
 		if len(response.Messages.Message) > 0 {
-			return nil, fmt.Errorf("API error: %s", response.Messages.Message[0].Text)
+			return declinedResponse(&response), fmt.Errorf("API error: %s", response.Messages.Message[0].Text)
 		}
-		return nil, fmt.Errorf("API error: unknown error")
+		return declinedResponse(&response), fmt.Errorf("API error: unknown error")
 	}
 	return &response.TransactionResponse, nil
 }
@@ -490,38 +803,29 @@ func (c *APIClient) UpdateCustomerPaymentProfile(customerPaymentProfileId, custo
 	return nil
 }
 
-func (c *APIClient) UpdatePaymentProfile(customerProfileId string, paymentProfile *struct {
+// PaymentProfileUpdate is the payment profile sent by UpdatePaymentProfile.
+type PaymentProfileUpdate struct {
 	BillTo  *ShippingAddress `json:"billTo,omitempty"`
 	Payment struct {
 		CreditCard CreditCard `json:"creditCard,omitempty"`
 	} `json:"payment,omitempty"`
 	CustomerPaymentProfileId string `json:"customerPaymentProfileId,omitempty"`
-}) error {
-	log.Printf("Update Payment Profile: %s", customerProfileId)
+}
+
+func (c *APIClient) UpdatePaymentProfile(customerProfileId string, paymentProfile *PaymentProfileUpdate) error {
+	c.logger().Debug("updating payment profile", "customer_profile_id", customerProfileId)
 
 	requestWrapper := struct {
 		Request struct {
 			MerchantAuthentication MerchantAuthentication `json:"merchantAuthentication"`
 			CustomerProfileId      string                 `json:"customerProfileId"`
-			PaymentProfile         *struct {
-				BillTo  *ShippingAddress `json:"billTo,omitempty"`
-				Payment struct {
-					CreditCard CreditCard `json:"creditCard,omitempty"`
-				} `json:"payment,omitempty"`
-				CustomerPaymentProfileId string `json:"customerPaymentProfileId,omitempty"`
-			} `json:"paymentProfile"`
+			PaymentProfile         *PaymentProfileUpdate  `json:"paymentProfile"`
 		} `json:"updateCustomerPaymentProfileRequest"`
 	}{
 		Request: struct {
 			MerchantAuthentication MerchantAuthentication `json:"merchantAuthentication"`
 			CustomerProfileId      string                 `json:"customerProfileId"`
-			PaymentProfile         *struct {
-				BillTo  *ShippingAddress `json:"billTo,omitempty"`
-				Payment struct {
-					CreditCard CreditCard `json:"creditCard,omitempty"`
-				} `json:"payment,omitempty"`
-				CustomerPaymentProfileId string `json:"customerPaymentProfileId,omitempty"`
-			} `json:"paymentProfile"`
+			PaymentProfile         *PaymentProfileUpdate  `json:"paymentProfile"`
 		}{
 			MerchantAuthentication: c.Auth,
 			CustomerProfileId:      customerProfileId,
@@ -662,7 +966,7 @@ type CreateCustomerShippingAddressResponse struct {
 }
 
 func (c *APIClient) AddShippingAddress(profileID string, address ShippingAddress) (string, error) {
-	log.Println("Add shipping address to profile:", profileID)
+	c.logger().Debug("adding shipping address", "customer_profile_id", profileID)
 
 	requestWrapper := struct {
 		Request CreateCustomerShippingAddressRequest `json:"createCustomerShippingAddressRequest"`
@@ -736,7 +1040,7 @@ type UpdateCustomerPaymentProfileResponse struct {
 }
 
 func (c *APIClient) UpdateBillingAddress(customerprofileID string, paymentProfileID string, address ShippingAddress) error {
-	log.Printf("Updating billing address for customer profile: %s, payment profile: %s", customerprofileID, paymentProfileID)
+	c.logger().Debug("updating billing address", "customer_profile_id", customerprofileID, "payment_profile_id", paymentProfileID)
 
 	requestWrapper := struct {
 		Request UpdateCustomerPaymentProfileRequest `json:"updateCustomerPaymentProfileRequest"`
@@ -0,0 +1,31 @@
+package authorizenet_test
+
+import (
+	"authnet/authorizenet"
+	"authnet/authorizenet/cassette"
+	"strings"
+	"testing"
+)
+
+// TestGetAllCustomerProfileIds replays testdata/getCustomerProfileIds.json, whose response
+// follows the getCustomerProfileIdsResponse example in the Authorize.Net API reference: ids and
+// messages sit at the top level of the JSON body, with no wrapper element.
+func TestGetAllCustomerProfileIds(t *testing.T) {
+	rec, err := cassette.New("testdata/getCustomerProfileIds.json", cassette.Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := authorizenet.NewAPIClient("login", "key", "https://apitest.authorize.net/xml/v1/request.api")
+	client.HTTPClient = rec.Client()
+
+	ids, err := client.GetAllCustomerProfileIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(ids, ","); got != "47988,47997,48458,48468" {
+		t.Errorf("ids = %s", got)
+	}
+	if unused := rec.Unused(); len(unused) != 0 {
+		t.Errorf("%d recorded interactions not replayed", len(unused))
+	}
+}
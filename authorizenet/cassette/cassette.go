@@ -0,0 +1,287 @@
+// Package cassette records Authorize.Net traffic to fixture files and replays it, so client and
+// handler tests run deterministically without network access.
+//
+// Record once against the sandbox:
+//
+//	rec, _ := cassette.New("testdata/charge.json", cassette.Record)
+//	client.HTTPClient = rec.Client()
+//	... exercise the client ...
+//	rec.Save()
+//
+// and replay in tests with cassette.Replay. Merchant credentials, card numbers, expiration
+// dates, card codes and bank account numbers are scrubbed before anything is written, and
+// replayed requests are scrubbed the same way before they are matched.
+package cassette
+
+import (
+	"authnet/redact"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type Mode int
+
+const (
+	// Replay serves responses from the fixture file and never touches the network.
+	Replay Mode = iota
+	// Record forwards requests to the real gateway and captures every exchange.
+	Record
+)
+
+// ModeFromEnv returns Record when AUTHNET_RECORD=1, so fixtures can be refreshed with
+// `AUTHNET_RECORD=1 go test ./...`, and Replay otherwise.
+func ModeFromEnv() Mode {
+	if os.Getenv("AUTHNET_RECORD") == "1" {
+		return Record
+	}
+	return Replay
+}
+
+const scrubbed = "SCRUBBED"
+
+type Request struct {
+	Operation string          `json:"operation"`
+	Body      json.RawMessage `json:"body"`
+}
+
+type Response struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	// Text holds bodies that are not JSON.
+	Text string `json:"text,omitempty"`
+}
+
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Recorder is an http.RoundTripper that records or replays gateway exchanges.
+type Recorder struct {
+	path string
+	mode Mode
+	// Transport sends requests in Record mode. http.DefaultTransport is used when nil.
+	Transport http.RoundTripper
+
+	mu       sync.Mutex
+	cassette Cassette
+	used     []bool
+}
+
+// New opens the cassette at path. In Replay mode the file must exist.
+func New(path string, mode Mode) (*Recorder, error) {
+	r := &Recorder{path: path, mode: mode}
+	if mode == Record {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %v", err)
+	}
+	if err := json.Unmarshal(data, &r.cassette); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette %s: %v", path, err)
+	}
+	r.used = make([]bool, len(r.cassette.Interactions))
+	return r, nil
+}
+
+// Client returns an http.Client that sends through the recorder.
+func (r *Recorder) Client() *http.Client {
+	return &http.Client{Transport: r}
+}
+
+// Save writes the recorded interactions to the cassette file. It is a no-op in Replay mode.
+func (r *Recorder) Save() error {
+	if r.mode != Record {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := json.MarshalIndent(r.cassette, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal cassette: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create cassette directory: %v", err)
+	}
+	return os.WriteFile(r.path, append(data, '\n'), 0o644)
+}
+
+// Unused returns the recorded interactions a replay has not served yet.
+func (r *Recorder) Unused() []Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unused []Interaction
+	for i, interaction := range r.cassette.Interactions {
+		if !r.used[i] {
+			unused = append(unused, interaction)
+		}
+	}
+	return unused
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	scrubbedReq := scrubRequest(body)
+
+	if r.mode == Record {
+		return r.record(req, body, scrubbedReq)
+	}
+	return r.replay(req, scrubbedReq)
+}
+
+func (r *Recorder) record(req *http.Request, body []byte, scrubbedReq Request) (*http.Response, error) {
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	resp, err := transport.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, Interaction{
+		Request:  scrubbedReq,
+		Response: scrubResponse(resp.StatusCode, respBody),
+	})
+	r.used = append(r.used, true)
+	r.mu.Unlock()
+
+	// The caller gets the real, unscrubbed response.
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	return resp, nil
+}
+
+func (r *Recorder) replay(req *http.Request, scrubbedReq Request) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Prefer an exact match on the scrubbed body, then fall back to the next recorded
+	// exchange of the same operation, always in recorded order.
+	match := -1
+	for i, interaction := range r.cassette.Interactions {
+		if !r.used[i] && interaction.Request.Operation == scrubbedReq.Operation && bytes.Equal(interaction.Request.Body, scrubbedReq.Body) {
+			match = i
+			break
+		}
+	}
+	if match < 0 {
+		for i, interaction := range r.cassette.Interactions {
+			if !r.used[i] && interaction.Request.Operation == scrubbedReq.Operation {
+				match = i
+				break
+			}
+		}
+	}
+	if match < 0 {
+		return nil, fmt.Errorf("cassette %s: no unused recording for %s", r.path, scrubbedReq.Operation)
+	}
+	r.used[match] = true
+
+	recorded := r.cassette.Interactions[match].Response
+	body := []byte(recorded.Text)
+	if len(recorded.Body) > 0 {
+		body = recorded.Body
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json; charset=utf-8"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// scrubRequest replaces the merchant login and every sensitive field, and returns the
+// request in canonical form so recorded and replayed requests compare byte for byte.
+func scrubRequest(body []byte) Request {
+	var envelope map[string]map[string]interface{}
+	if err := decode(body, &envelope); err != nil {
+		return Request{Operation: "unknown", Body: canonical(redact.JSON(body))}
+	}
+
+	var operation string
+	for name, request := range envelope {
+		operation = name
+		if auth, ok := request["merchantAuthentication"].(map[string]interface{}); ok {
+			auth["name"] = scrubbed
+			auth["transactionKey"] = scrubbed
+		}
+		// refId is caller generated and would defeat exact matching.
+		delete(request, "refId")
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return Request{Operation: operation, Body: canonical(redact.JSON(body))}
+	}
+	return Request{Operation: operation, Body: canonical(redact.JSON(data))}
+}
+
+func scrubResponse(status int, body []byte) Response {
+	body = bytes.TrimPrefix(bytes.TrimSpace(body), []byte{0xef, 0xbb, 0xbf})
+
+	var doc map[string]interface{}
+	if err := decode(body, &doc); err != nil {
+		return Response{Status: status, Text: redact.String(string(body))}
+	}
+	if _, ok := doc["publicClientKey"]; ok {
+		doc["publicClientKey"] = scrubbed
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return Response{Status: status, Text: redact.String(string(body))}
+	}
+	return Response{Status: status, Body: canonical(redact.JSON(data))}
+}
+
+// decode unmarshals keeping numbers exact, so long IDs survive the round trip.
+func decode(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// canonical returns valid JSON as a compact RawMessage, or a JSON string otherwise.
+func canonical(data []byte) json.RawMessage {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		quoted, _ := json.Marshal(string(data))
+		return quoted
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,225 @@
+package cassette
+
+import (
+	"authnet/authorizenet"
+	"authnet/authorizenet/fakegateway"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Secrets the scrubbed output must never contain.
+const (
+	testLogin  = "merchant-login"
+	testKey    = "tx-key-8a7b6c5d"
+	testCard   = "4111111111111111"
+	testExpiry = "2030-12"
+	testCode   = "987"
+)
+
+func expectScrubbed(t *testing.T, data string) {
+	t.Helper()
+	for _, secret := range []string{testLogin, testKey, testCard, testExpiry, testCode} {
+		if strings.Contains(data, secret) {
+			t.Errorf("%q not scrubbed from %s", secret, data)
+		}
+	}
+}
+
+func TestScrubRequest(t *testing.T) {
+	body := `{"createCustomerProfileRequest":{
+		"merchantAuthentication":{"name":"` + testLogin + `","transactionKey":"` + testKey + `"},
+		"refId":"ref-123",
+		"profile":{"merchantCustomerId":"CF-1001","paymentProfiles":[{"payment":{"creditCard":{
+			"cardNumber":"` + testCard + `","expirationDate":"` + testExpiry + `","cardCode":"` + testCode + `"}}}]}}}`
+
+	req := scrubRequest([]byte(body))
+	if req.Operation != "createCustomerProfileRequest" {
+		t.Errorf("operation = %q", req.Operation)
+	}
+	expectScrubbed(t, string(req.Body))
+	for _, want := range []string{`"name":"SCRUBBED"`, `"transactionKey":"[REDACTED]"`, `XXXX1111`, `"merchantCustomerId":"CF-1001"`} {
+		if !strings.Contains(string(req.Body), want) {
+			t.Errorf("scrubbed request %s is missing %s", req.Body, want)
+		}
+	}
+	if strings.Contains(string(req.Body), "refId") {
+		t.Errorf("refId kept in %s", req.Body)
+	}
+
+	// Key order and whitespace must not matter when matching.
+	reordered := `{"createCustomerProfileRequest":{"profile":{"paymentProfiles":[{"payment":{"creditCard":{"cardCode":"111","expirationDate":"2031-01","cardNumber":"4111111111111111"}}}],"merchantCustomerId":"CF-1001"},"merchantAuthentication":{"transactionKey":"other","name":"other"}}}`
+	if other := scrubRequest([]byte(reordered)); string(other.Body) != string(req.Body) {
+		t.Errorf("equivalent requests scrub differently:\n%s\n%s", req.Body, other.Body)
+	}
+}
+
+func TestScrubResponse(t *testing.T) {
+	body := "\xef\xbb\xbf" + `{"publicClientKey":"pk-123","profile":{"paymentProfiles":[{"payment":{"creditCard":{"cardNumber":"` + testCard + `","expirationDate":"` + testExpiry + `"}}}]},"messages":{"resultCode":"Ok"}}`
+	resp := scrubResponse(http.StatusOK, []byte(body))
+	if resp.Status != http.StatusOK || len(resp.Body) == 0 || resp.Text != "" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	expectScrubbed(t, string(resp.Body))
+	if strings.Contains(string(resp.Body), "pk-123") {
+		t.Errorf("publicClientKey kept in %s", resp.Body)
+	}
+
+	text := scrubResponse(http.StatusBadGateway, []byte("upstream failed for card "+testCard))
+	if text.Text == "" || len(text.Body) != 0 {
+		t.Fatalf("unexpected response %+v", text)
+	}
+	expectScrubbed(t, text.Text)
+}
+
+// chargeFlow creates a profile with a card, charges it once successfully and once with an
+// amount the fake gateway declines.
+func chargeFlow(t *testing.T, client *authorizenet.APIClient) *authorizenet.FullTransactionResponse {
+	t.Helper()
+	profileID, err := client.CreateCustomerProfile(authorizenet.CustomerProfile{
+		MerchantCustomerId: "CF-1001",
+		Email:              "ringer@example.com",
+		PaymentProfiles: []authorizenet.PaymentProfile{{
+			Payment: authorizenet.Payment{CreditCard: authorizenet.CreditCard{CardNumber: testCard, ExpirationDate: testExpiry}},
+		}},
+	}, "testMode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := client.GetCustomerProfile(profileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paymentProfileID := profile.PaymentProfiles[0].CustomerPaymentProfileId
+
+	approved, err := client.ChargeCustomerProfile(profileID, paymentProfileID, "10.00", "INV-1", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ChargeCustomerProfile(profileID, paymentProfileID, "10.02", "INV-2", "", ""); err == nil {
+		t.Fatal("expected a decline")
+	}
+	return approved
+}
+
+// TestReplay replays testdata/charge.json, which was recorded against the fake gateway.
+func TestReplay(t *testing.T) {
+	rec, err := New("testdata/charge.json", Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens here; every response has to come from the cassette.
+	client := authorizenet.NewAPIClient(testLogin, testKey, "http://127.0.0.1:1/xml/v1/request.api")
+	client.HTTPClient = rec.Client()
+
+	if approved := chargeFlow(t, client); approved.ResponseCode != "1" || approved.TransId == "" {
+		t.Errorf("unexpected approval %+v", approved)
+	}
+	if unused := rec.Unused(); len(unused) != 0 {
+		t.Errorf("%d recorded interactions not replayed", len(unused))
+	}
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	srv := httptest.NewServer(fakegateway.New())
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "charge.json")
+
+	rec, err := New(path, Record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := authorizenet.NewAPIClient(testLogin, testKey, srv.URL)
+	client.HTTPClient = rec.Client()
+	recordedApproval := chargeFlow(t, client)
+	if err := rec.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectScrubbed(t, string(data))
+
+	replay, err := New(path, Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	client.HTTPClient = replay.Client()
+	if approved := chargeFlow(t, client); approved.TransId != recordedApproval.TransId {
+		t.Errorf("replayed transId %s, recorded %s", approved.TransId, recordedApproval.TransId)
+	}
+}
+
+func TestReplayMatching(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "merchant.json")
+	cassette := `{"interactions":[
+		{"request":{"operation":"getTransactionDetailsRequest","body":{"getTransactionDetailsRequest":{"merchantAuthentication":{"name":"SCRUBBED","transactionKey":"[REDACTED]"},"transId":"1"}}},
+		 "response":{"status":200,"body":{"transaction":{"transId":"1"}}}},
+		{"request":{"operation":"getTransactionDetailsRequest","body":{"getTransactionDetailsRequest":{"merchantAuthentication":{"name":"SCRUBBED","transactionKey":"[REDACTED]"},"transId":"2"}}},
+		 "response":{"status":200,"body":{"transaction":{"transId":"2"}}}},
+		{"request":{"operation":"getMerchantDetailsRequest","body":{}},
+		 "response":{"status":500,"text":"gateway unavailable"}}
+	]}`
+	if err := os.WriteFile(path, []byte(cassette), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := New(path, Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(t *testing.T, body string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "https://apitest.authorize.net/xml/v1/request.api", strings.NewReader(body))
+		resp, err := rec.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(data)
+	}
+	details := func(transId string) string {
+		return `{"getTransactionDetailsRequest":{"merchantAuthentication":{"name":"live","transactionKey":"live"},"transId":"` + transId + `"}}`
+	}
+
+	t.Run("exact match wins over recorded order", func(t *testing.T) {
+		if _, body := send(t, details("2")); !strings.Contains(body, `"transId":"2"`) {
+			t.Errorf("got %s, want the second recording", body)
+		}
+	})
+	t.Run("falls back to the next recording of the operation", func(t *testing.T) {
+		if _, body := send(t, details("3")); !strings.Contains(body, `"transId":"1"`) {
+			t.Errorf("got %s, want the remaining recording", body)
+		}
+	})
+	t.Run("text responses replay as recorded", func(t *testing.T) {
+		status, body := send(t, `{"getMerchantDetailsRequest":{"merchantAuthentication":{"name":"live","transactionKey":"live"}}}`)
+		if status != http.StatusInternalServerError || body != "gateway unavailable" {
+			t.Errorf("got %d %q", status, body)
+		}
+	})
+	t.Run("each recording is served once", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "https://apitest.authorize.net/xml/v1/request.api", strings.NewReader(details("1")))
+		if _, err := rec.RoundTrip(req); err == nil {
+			t.Error("expected an error once the recordings are used up")
+		}
+		if unused := rec.Unused(); len(unused) != 0 {
+			t.Errorf("unused = %+v", unused)
+		}
+	})
+	t.Run("missing cassette", func(t *testing.T) {
+		if _, err := New(filepath.Join(t.TempDir(), "missing.json"), Replay); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
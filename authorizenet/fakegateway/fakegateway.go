@@ -0,0 +1,1006 @@
+// Package fakegateway is an in-memory stand-in for the Authorize.Net JSON API, for tests and
+// offline development:
+//
+//	srv := httptest.NewServer(fakegateway.New())
+//	defer srv.Close()
+//	client := authorizenet.NewAPIClient("login", "key", srv.URL)
+//
+// It keeps customer profiles, payment profiles, shipping addresses and transactions in memory
+// and answers the requests APIClient makes with the same shapes the real gateway returns.
+// Account Updater reports are seeded with AddAUChange.
+//
+// Transactions can be steered with magic values. By the cents of the amount:
+//
+//	x.02  declined (response code 2)
+//	x.27  declined for an AVS mismatch (response code 2, AVS result N)
+//	x.05  processing error (response code 3)
+//
+// and by the card number stored on the charged payment profile:
+//
+//	DeclinedCard     always declined
+//	AVSMismatchCard  always declined for an AVS mismatch
+//	ErrorCard        always fails with a processing error
+package fakegateway
+
+import (
+	"authnet/authorizenet"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Card numbers that force a transaction outcome regardless of amount.
+const (
+	ApprovedCard    = "4111111111111111"
+	DeclinedCard    = "4000000000000002"
+	AVSMismatchCard = "4000000000000010"
+	ErrorCard       = "4000000000000119"
+)
+
+// Transaction statuses, as reported by getTransactionDetailsRequest.
+const (
+	StatusAuthorized = "authorizedPendingCapture"
+	StatusCaptured   = "capturedPendingSettlement"
+	StatusSettled    = "settledSuccessfully"
+	StatusRefunded   = "refundPendingSettlement"
+	StatusVoided     = "voided"
+	StatusDeclined   = "declined"
+	StatusError      = "generalError"
+)
+
+// Transaction is a transaction as the fake gateway stores it.
+type Transaction struct {
+	TransId           string
+	RefTransId        string
+	Type              string
+	Status            string
+	Amount            float64
+	CustomerProfileId string
+	PaymentProfileId  string
+	InvoiceNumber     string
+	Description       string
+	CardNumber        string
+	ResponseCode      string
+	AvsResultCode     string
+	SubmittedAt       time.Time
+}
+
+type storedPaymentProfile struct {
+	authorizenet.PaymentProfile
+	isDefault bool
+}
+
+type storedProfile struct {
+	profile         authorizenet.CustomerProfile
+	paymentProfiles []*storedPaymentProfile
+	addresses       []authorizenet.ShippingAddress
+}
+
+// Server is an http.Handler implementing the Authorize.Net JSON API in memory.
+type Server struct {
+	mu           sync.Mutex
+	profiles     map[string]*storedProfile
+	profileOrder []string
+	transactions map[string]*Transaction
+	transOrder   []string
+	receipts     []Receipt
+	auChanges    map[string]*authorizenet.AUDetails
+	nextID       int64
+	now          func() time.Time
+}
+
+// Receipt records a sendCustomerTransactionReceiptRequest.
+type Receipt struct {
+	TransId string
+	Email   string
+	Header  string
+	Footer  string
+}
+
+func New() *Server {
+	return &Server{
+		profiles:     make(map[string]*storedProfile),
+		transactions: make(map[string]*Transaction),
+		auChanges:    make(map[string]*authorizenet.AUDetails),
+		nextID:       500000000,
+		now:          time.Now,
+	}
+}
+
+func (s *Server) newID() string {
+	s.nextID++
+	return strconv.FormatInt(s.nextID, 10)
+}
+
+// Transaction returns a copy of a stored transaction.
+func (s *Server) Transaction(transId string) (Transaction, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.transactions[transId]
+	if !ok {
+		return Transaction{}, false
+	}
+	return *t, true
+}
+
+// Receipts returns every receipt the gateway was asked to send.
+func (s *Server) Receipts() []Receipt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Receipt(nil), s.receipts...)
+}
+
+// AddAUChange records a card change for the Account Updater reports of month (YYYY-MM).
+// A deleted card is reported under auDelete, anything else under auUpdate.
+func (s *Server) AddAUChange(month string, deleted bool, change authorizenet.AUChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	details, ok := s.auChanges[month]
+	if !ok {
+		details = &authorizenet.AUDetails{}
+		s.auChanges[month] = details
+	}
+	if deleted {
+		details.AuDelete = append(details.AuDelete, change)
+	} else {
+		details.AuUpdate = append(details.AuUpdate, change)
+	}
+}
+
+// Settle moves every captured transaction to settled, as the nightly batch would, so it can be refunded.
+func (s *Server) Settle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.transactions {
+		if t.Status == StatusCaptured {
+			t.Status = StatusSettled
+		}
+	}
+}
+
+type messages struct {
+	ResultCode string    `json:"resultCode"`
+	Message    []message `json:"message"`
+}
+
+type message struct {
+	Code string `json:"code"`
+	Text string `json:"text"`
+}
+
+func ok() messages {
+	return messages{ResultCode: "Ok", Message: []message{{Code: "I00001", Text: "Successful."}}}
+}
+
+func apiError(code, text string) messages {
+	return messages{ResultCode: "Error", Message: []message{{Code: code, Text: text}}}
+}
+
+func notFound() map[string]interface{} {
+	return map[string]interface{}{"messages": apiError("E00040", "The record cannot be found.")}
+}
+
+// handlers maps each request type to the method answering it.
+func (s *Server) handlers() map[string]func(json.RawMessage) interface{} {
+	return map[string]func(json.RawMessage) interface{}{
+		"createCustomerProfileRequest":          s.createCustomerProfile,
+		"getCustomerProfileRequest":             s.getCustomerProfile,
+		"getCustomerProfileIdsRequest":          s.getCustomerProfileIds,
+		"updateCustomerProfileRequest":          s.updateCustomerProfile,
+		"createCustomerPaymentProfileRequest":   s.createCustomerPaymentProfile,
+		"updateCustomerPaymentProfileRequest":   s.updateCustomerPaymentProfile,
+		"deleteCustomerPaymentProfileRequest":   s.deleteCustomerPaymentProfile,
+		"createCustomerShippingAddressRequest":  s.createCustomerShippingAddress,
+		"deleteCustomerShippingAddressRequest":  s.deleteCustomerShippingAddress,
+		"createTransactionRequest":              s.createTransaction,
+		"getTransactionDetailsRequest":          s.getTransactionDetails,
+		"getTransactionListForCustomerRequest":  s.getTransactionListForCustomer,
+		"sendCustomerTransactionReceiptRequest": s.sendCustomerTransactionReceipt,
+		"getMerchantDetailsRequest":             s.getMerchantDetails,
+		"getAUJobSummaryRequest":                s.getAUJobSummary,
+		"getAUJobDetailsRequest":                s.getAUJobDetails,
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var envelope map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil || len(envelope) != 1 {
+		writeResponse(w, map[string]interface{}{"messages": apiError("E00003", "An error occurred while parsing the request.")})
+		return
+	}
+
+	for name, body := range envelope {
+		var auth struct {
+			MerchantAuthentication authorizenet.MerchantAuthentication `json:"merchantAuthentication"`
+		}
+		if err := json.Unmarshal(body, &auth); err != nil || auth.MerchantAuthentication.Name == "" || auth.MerchantAuthentication.TransactionKey == "" {
+			writeResponse(w, map[string]interface{}{"messages": apiError("E00007", "User authentication failed due to invalid authentication values.")})
+			return
+		}
+
+		handler, ok := s.handlers()[name]
+		if !ok {
+			writeResponse(w, map[string]interface{}{"messages": apiError("E00003", fmt.Sprintf("The element '%s' is not supported by the fake gateway.", name))})
+			return
+		}
+
+		s.mu.Lock()
+		response := handler(body)
+		s.mu.Unlock()
+		writeResponse(w, response)
+	}
+}
+
+// writeResponse writes JSON with the byte order mark the real gateway prepends.
+func writeResponse(w http.ResponseWriter, response interface{}) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write([]byte{0xef, 0xbb, 0xbf})
+	w.Write(data)
+}
+
+func maskCard(card authorizenet.CreditCard) authorizenet.CreditCard {
+	number := card.CardNumber
+	if len(number) > 4 {
+		number = "XXXX" + number[len(number)-4:]
+	}
+	return authorizenet.CreditCard{CardNumber: number, ExpirationDate: "XXXX"}
+}
+
+func validCard(card authorizenet.CreditCard) bool {
+	if len(card.CardNumber) < 13 || len(card.CardNumber) > 16 {
+		return false
+	}
+	for _, c := range card.CardNumber {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *storedProfile) view() authorizenet.CustomerProfile {
+	profile := p.profile
+	profile.PaymentProfiles = nil
+	for _, pp := range p.paymentProfiles {
+		masked := pp.PaymentProfile
+		masked.Payment.CreditCard = maskCard(pp.Payment.CreditCard)
+		profile.PaymentProfiles = append(profile.PaymentProfiles, masked)
+	}
+	profile.ShipToList = append([]authorizenet.ShippingAddress(nil), p.addresses...)
+	return profile
+}
+
+func (p *storedProfile) paymentProfile(id string) *storedPaymentProfile {
+	for _, pp := range p.paymentProfiles {
+		if pp.CustomerPaymentProfileId == id {
+			return pp
+		}
+	}
+	return nil
+}
+
+func (s *Server) createCustomerProfile(body json.RawMessage) interface{} {
+	var req authorizenet.CreateCustomerProfileRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+	if req.Profile.MerchantCustomerId == "" && req.Profile.Email == "" && req.Profile.Description == "" {
+		return map[string]interface{}{"messages": apiError("E00041", "One or more fields in the profile must contain a value.")}
+	}
+	for _, id := range s.profileOrder {
+		existing := s.profiles[id].profile
+		if req.Profile.MerchantCustomerId != "" && existing.MerchantCustomerId == req.Profile.MerchantCustomerId {
+			return map[string]interface{}{"messages": apiError("E00039", "A duplicate record with ID "+id+" already exists.")}
+		}
+	}
+
+	stored := &storedProfile{profile: req.Profile}
+	stored.profile.CustomerProfileId = s.newID()
+	stored.profile.PaymentProfiles = nil
+	stored.profile.ShipToList = nil
+
+	paymentIds := []string{}
+	for _, pp := range req.Profile.PaymentProfiles {
+		if !validCard(pp.Payment.CreditCard) {
+			return map[string]interface{}{"messages": apiError("E00013", "Card Number is invalid.")}
+		}
+		pp.CustomerPaymentProfileId = s.newID()
+		stored.paymentProfiles = append(stored.paymentProfiles, &storedPaymentProfile{PaymentProfile: pp})
+		paymentIds = append(paymentIds, pp.CustomerPaymentProfileId)
+	}
+	addressIds := []string{}
+	for _, addr := range req.Profile.ShipToList {
+		addr.CustomerAddressId = s.newID()
+		stored.addresses = append(stored.addresses, addr)
+		addressIds = append(addressIds, addr.CustomerAddressId)
+	}
+
+	s.profiles[stored.profile.CustomerProfileId] = stored
+	s.profileOrder = append(s.profileOrder, stored.profile.CustomerProfileId)
+
+	return map[string]interface{}{
+		"customerProfileId":             stored.profile.CustomerProfileId,
+		"customerPaymentProfileIdList":  paymentIds,
+		"customerShippingAddressIdList": addressIds,
+		"validationDirectResponseList":  []string{},
+		"messages":                      ok(),
+	}
+}
+
+func (s *Server) getCustomerProfile(body json.RawMessage) interface{} {
+	var req struct {
+		CustomerProfileId  string `json:"customerProfileId"`
+		MerchantCustomerId string `json:"merchantCustomerId"`
+		Email              string `json:"email"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+
+	var found *storedProfile
+	if req.CustomerProfileId != "" {
+		found = s.profiles[req.CustomerProfileId]
+	} else {
+		for _, id := range s.profileOrder {
+			p := s.profiles[id]
+			if req.MerchantCustomerId != "" && p.profile.MerchantCustomerId != req.MerchantCustomerId {
+				continue
+			}
+			if req.Email != "" && !strings.EqualFold(p.profile.Email, req.Email) {
+				continue
+			}
+			if req.MerchantCustomerId == "" && req.Email == "" {
+				continue
+			}
+			found = p
+			break
+		}
+	}
+	if found == nil {
+		return notFound()
+	}
+
+	return map[string]interface{}{
+		"profile":  found.view(),
+		"messages": ok(),
+	}
+}
+
+func (s *Server) getCustomerProfileIds(body json.RawMessage) interface{} {
+	var req struct {
+		Paging *authorizenet.Paging `json:"paging"`
+	}
+	json.Unmarshal(body, &req)
+
+	ids := append([]string{}, s.profileOrder...)
+	total := len(ids)
+	if req.Paging != nil && req.Paging.Limit > 0 {
+		ids = page(ids, req.Paging)
+	}
+
+	return map[string]interface{}{
+		"ids":                 ids,
+		"totalNumInResultSet": total,
+		"messages":            ok(),
+	}
+}
+
+// page applies Authorize.Net paging, where Offset is the 1-based page number.
+func page[T any](items []T, paging *authorizenet.Paging) []T {
+	offset := paging.Offset
+	if offset < 1 {
+		offset = 1
+	}
+	start := (offset - 1) * paging.Limit
+	if start >= len(items) {
+		return []T{}
+	}
+	end := start + paging.Limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[start:end]
+}
+
+func (s *Server) updateCustomerProfile(body json.RawMessage) interface{} {
+	var req struct {
+		Profile struct {
+			CustomerProfileId  string `json:"customerProfileId"`
+			MerchantCustomerId string `json:"merchantCustomerId"`
+			Email              string `json:"email"`
+			Description        string `json:"description"`
+		} `json:"profile"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+
+	p, found := s.profiles[req.Profile.CustomerProfileId]
+	if !found {
+		return notFound()
+	}
+	p.profile.Email = req.Profile.Email
+	p.profile.Description = req.Profile.Description
+	if req.Profile.MerchantCustomerId != "" {
+		p.profile.MerchantCustomerId = req.Profile.MerchantCustomerId
+	}
+	return map[string]interface{}{"messages": ok()}
+}
+
+func (s *Server) createCustomerPaymentProfile(body json.RawMessage) interface{} {
+	var req authorizenet.CreateCustomerPaymentProfileRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+
+	p, found := s.profiles[req.CustomerProfileId]
+	if !found {
+		return notFound()
+	}
+	if !validCard(req.PaymentProfile.Payment.CreditCard) {
+		return map[string]interface{}{"messages": apiError("E00013", "Card Number is invalid.")}
+	}
+	for _, pp := range p.paymentProfiles {
+		if pp.Payment.CreditCard.CardNumber == req.PaymentProfile.Payment.CreditCard.CardNumber {
+			return map[string]interface{}{
+				"customerProfileId":        p.profile.CustomerProfileId,
+				"customerPaymentProfileId": pp.CustomerPaymentProfileId,
+				"messages":                 apiError("E00039", "A duplicate customer payment profile already exists."),
+			}
+		}
+	}
+
+	pp := req.PaymentProfile
+	pp.CustomerPaymentProfileId = s.newID()
+	p.paymentProfiles = append(p.paymentProfiles, &storedPaymentProfile{PaymentProfile: pp})
+
+	return map[string]interface{}{
+		"customerProfileId":        p.profile.CustomerProfileId,
+		"customerPaymentProfileId": pp.CustomerPaymentProfileId,
+		"messages":                 ok(),
+	}
+}
+
+func (s *Server) updateCustomerPaymentProfile(body json.RawMessage) interface{} {
+	var req authorizenet.UpdateCustomerPaymentProfileRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+
+	p, found := s.profiles[req.CustomerProfileId]
+	if !found {
+		return notFound()
+	}
+	pp := p.paymentProfile(req.PaymentProfile.CustomerPaymentProfileId)
+	if pp == nil {
+		return notFound()
+	}
+
+	// Masked values sent back unchanged keep what is stored, as on the real gateway.
+	card := req.PaymentProfile.Payment.CreditCard
+	if card.CardNumber != "" && !strings.HasPrefix(card.CardNumber, "XXXX") {
+		if !validCard(card) {
+			return map[string]interface{}{"messages": apiError("E00013", "Card Number is invalid.")}
+		}
+		pp.Payment.CreditCard.CardNumber = card.CardNumber
+	}
+	if card.ExpirationDate != "" && card.ExpirationDate != "XXXX" {
+		pp.Payment.CreditCard.ExpirationDate = card.ExpirationDate
+	}
+	if req.PaymentProfile.BillTo != nil {
+		billTo := *req.PaymentProfile.BillTo
+		pp.BillTo = &billTo
+	}
+	return map[string]interface{}{"messages": ok()}
+}
+
+func (s *Server) deleteCustomerPaymentProfile(body json.RawMessage) interface{} {
+	var req authorizenet.DeleteCustomerPaymentProfileRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+
+	p, found := s.profiles[req.CustomerProfileId]
+	if !found {
+		return notFound()
+	}
+	for i, pp := range p.paymentProfiles {
+		if pp.CustomerPaymentProfileId == req.CustomerPaymentProfileId {
+			p.paymentProfiles = append(p.paymentProfiles[:i], p.paymentProfiles[i+1:]...)
+			return map[string]interface{}{"messages": ok()}
+		}
+	}
+	return notFound()
+}
+
+func (s *Server) createCustomerShippingAddress(body json.RawMessage) interface{} {
+	var req authorizenet.CreateCustomerShippingAddressRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+
+	p, found := s.profiles[req.CustomerProfileId]
+	if !found {
+		return notFound()
+	}
+	addr := req.Address
+	addr.CustomerAddressId = s.newID()
+	p.addresses = append(p.addresses, addr)
+
+	return map[string]interface{}{
+		"customerProfileId": p.profile.CustomerProfileId,
+		"customerAddressId": addr.CustomerAddressId,
+		"messages":          ok(),
+	}
+}
+
+func (s *Server) deleteCustomerShippingAddress(body json.RawMessage) interface{} {
+	var req authorizenet.DeleteCustomerShippingAddressRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+
+	p, found := s.profiles[req.CustomerProfileId]
+	if !found {
+		return notFound()
+	}
+	for i, addr := range p.addresses {
+		if addr.CustomerAddressId == req.CustomerAddressId {
+			p.addresses = append(p.addresses[:i], p.addresses[i+1:]...)
+			return map[string]interface{}{"messages": ok()}
+		}
+	}
+	return notFound()
+}
+
+type transactionMessage struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+type transactionError struct {
+	ErrorCode string `json:"errorCode"`
+	ErrorText string `json:"errorText"`
+}
+
+type transactionResponse struct {
+	ResponseCode  string               `json:"responseCode"`
+	AuthCode      string               `json:"authCode"`
+	AvsResultCode string               `json:"avsResultCode"`
+	CvvResultCode string               `json:"cvvResultCode"`
+	TransId       string               `json:"transId"`
+	RefTransID    string               `json:"refTransID"`
+	AccountNumber string               `json:"accountNumber,omitempty"`
+	AccountType   string               `json:"accountType,omitempty"`
+	Messages      []transactionMessage `json:"messages,omitempty"`
+	Errors        []transactionError   `json:"errors,omitempty"`
+}
+
+func declined(resp transactionResponse, errorCode, errorText string) map[string]interface{} {
+	resp.Errors = []transactionError{{ErrorCode: errorCode, ErrorText: errorText}}
+	return map[string]interface{}{
+		"transactionResponse": resp,
+		"messages":            apiError("E00027", "The transaction was unsuccessful."),
+	}
+}
+
+func approved(resp transactionResponse) map[string]interface{} {
+	resp.ResponseCode = "1"
+	resp.Messages = []transactionMessage{{Code: "1", Description: "This transaction has been approved."}}
+	return map[string]interface{}{
+		"transactionResponse": resp,
+		"messages":            ok(),
+	}
+}
+
+func cents(amount float64) int {
+	return int(math.Round(amount*100)) % 100
+}
+
+func (s *Server) createTransaction(body json.RawMessage) interface{} {
+	var req authorizenet.CreateTransactionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+	tr := req.TransactionRequest
+
+	var amount float64
+	if tr.Amount != "" {
+		var err error
+		amount, err = strconv.ParseFloat(tr.Amount, 64)
+		if err != nil || amount < 0 {
+			return map[string]interface{}{"messages": apiError("E00003", "The 'amount' element is invalid.")}
+		}
+	}
+
+	switch tr.TransactionType {
+	case "authOnlyTransaction", "authCaptureTransaction":
+		return s.charge(tr, amount)
+	case "priorAuthCaptureTransaction":
+		return s.capture(tr, amount)
+	case "refundTransaction":
+		return s.refund(tr, amount)
+	case "voidTransaction":
+		return s.void(tr)
+	}
+	return map[string]interface{}{"messages": apiError("E00003", fmt.Sprintf("Transaction type '%s' is not supported by the fake gateway.", tr.TransactionType))}
+}
+
+func (s *Server) record(t *Transaction) {
+	t.SubmittedAt = s.now()
+	s.transactions[t.TransId] = t
+	s.transOrder = append(s.transOrder, t.TransId)
+}
+
+func (s *Server) charge(tr authorizenet.TransactionRequestType, amount float64) interface{} {
+	if tr.Profile == nil {
+		return map[string]interface{}{"messages": apiError("E00003", "The fake gateway only supports profile transactions.")}
+	}
+	if amount <= 0 {
+		return map[string]interface{}{"messages": apiError("E00027", "A valid amount is required.")}
+	}
+	p, found := s.profiles[tr.Profile.CustomerProfileID]
+	if !found {
+		return notFound()
+	}
+	pp := p.paymentProfile(tr.Profile.PaymentProfile.PaymentProfileId)
+	if pp == nil {
+		return notFound()
+	}
+
+	t := &Transaction{
+		TransId:           s.newID(),
+		Type:              tr.TransactionType,
+		Amount:            amount,
+		CustomerProfileId: tr.Profile.CustomerProfileID,
+		PaymentProfileId:  tr.Profile.PaymentProfile.PaymentProfileId,
+		CardNumber:        pp.Payment.CreditCard.CardNumber,
+		AvsResultCode:     "Y",
+	}
+	if tr.Order != nil {
+		t.InvoiceNumber = tr.Order.InvoiceNumber
+		t.Description = tr.Order.Description
+	}
+
+	resp := transactionResponse{
+		TransId:       t.TransId,
+		CvvResultCode: "P",
+		AccountNumber: maskCard(pp.Payment.CreditCard).CardNumber,
+		AccountType:   "Visa",
+	}
+
+	card := pp.Payment.CreditCard.CardNumber
+	switch {
+	case cents(amount) == 2 || card == DeclinedCard:
+		t.Status, t.ResponseCode = StatusDeclined, "2"
+		s.record(t)
+		resp.ResponseCode, resp.AvsResultCode = "2", "Y"
+		return declined(resp, "2", "This transaction has been declined.")
+	case cents(amount) == 27 || card == AVSMismatchCard:
+		t.Status, t.ResponseCode, t.AvsResultCode = StatusDeclined, "2", "N"
+		s.record(t)
+		resp.ResponseCode, resp.AvsResultCode = "2", "N"
+		return declined(resp, "27", "The transaction has been declined because of an AVS mismatch. The address provided does not match billing address of cardholder.")
+	case cents(amount) == 5 || card == ErrorCard:
+		t.Status, t.ResponseCode = StatusError, "3"
+		s.record(t)
+		resp.ResponseCode, resp.AvsResultCode = "3", "P"
+		return declined(resp, "57", "An error occurred in processing. Please try again.")
+	}
+
+	t.Status, t.ResponseCode = StatusCaptured, "1"
+	if tr.TransactionType == "authOnlyTransaction" {
+		t.Status = StatusAuthorized
+	}
+	s.record(t)
+	resp.AuthCode = fmt.Sprintf("%06d", s.nextID%1000000)
+	resp.AvsResultCode = t.AvsResultCode
+	return approved(resp)
+}
+
+func (s *Server) capture(tr authorizenet.TransactionRequestType, amount float64) interface{} {
+	orig, found := s.transactions[tr.RefTransId]
+	resp := transactionResponse{RefTransID: tr.RefTransId, AvsResultCode: "P"}
+	if !found {
+		resp.ResponseCode = "3"
+		return declined(resp, "16", "The transaction cannot be found.")
+	}
+	if orig.Status != StatusAuthorized {
+		resp.ResponseCode = "3"
+		return declined(resp, "311", "This transaction has already been captured.")
+	}
+	if amount == 0 {
+		amount = orig.Amount
+	}
+	if amount > orig.Amount {
+		resp.ResponseCode = "3"
+		return declined(resp, "47", "The amount requested for settlement cannot be greater than the original amount authorized.")
+	}
+
+	orig.Status = StatusCaptured
+	orig.Amount = amount
+
+	// The real gateway answers a prior-auth capture with the authorization's transId.
+	resp.TransId = orig.TransId
+	resp.AuthCode = "CAPTURED"
+	resp.AccountNumber = maskCard(authorizenet.CreditCard{CardNumber: orig.CardNumber}).CardNumber
+	resp.AccountType = "Visa"
+	return approved(resp)
+}
+
+func (s *Server) refund(tr authorizenet.TransactionRequestType, amount float64) interface{} {
+	orig, found := s.transactions[tr.RefTransId]
+	resp := transactionResponse{RefTransID: tr.RefTransId, AvsResultCode: "P"}
+	if !found {
+		resp.ResponseCode = "3"
+		return declined(resp, "16", "The transaction cannot be found.")
+	}
+	if orig.Status != StatusSettled {
+		resp.ResponseCode = "3"
+		return declined(resp, "54", "The referenced transaction does not meet the criteria for issuing a credit.")
+	}
+	if amount <= 0 || amount > orig.Amount {
+		resp.ResponseCode = "3"
+		return declined(resp, "55", "The sum of credits against the referenced transaction would exceed original debit amount.")
+	}
+
+	t := &Transaction{
+		TransId:           s.newID(),
+		RefTransId:        orig.TransId,
+		Type:              "refundTransaction",
+		Status:            StatusRefunded,
+		Amount:            amount,
+		CustomerProfileId: orig.CustomerProfileId,
+		PaymentProfileId:  orig.PaymentProfileId,
+		InvoiceNumber:     orig.InvoiceNumber,
+		CardNumber:        orig.CardNumber,
+		ResponseCode:      "1",
+	}
+	s.record(t)
+	orig.Amount -= amount
+
+	resp.TransId = t.TransId
+	resp.AccountNumber = maskCard(authorizenet.CreditCard{CardNumber: orig.CardNumber}).CardNumber
+	resp.AccountType = "Visa"
+	return approved(resp)
+}
+
+func (s *Server) void(tr authorizenet.TransactionRequestType) interface{} {
+	orig, found := s.transactions[tr.RefTransId]
+	resp := transactionResponse{RefTransID: tr.RefTransId, AvsResultCode: "P"}
+	if !found {
+		resp.ResponseCode = "3"
+		return declined(resp, "16", "The transaction cannot be found.")
+	}
+	if orig.Status != StatusAuthorized && orig.Status != StatusCaptured {
+		resp.ResponseCode = "3"
+		return declined(resp, "16", "The transaction cannot be found.")
+	}
+
+	orig.Status = StatusVoided
+	resp.TransId = orig.TransId
+	resp.AccountNumber = maskCard(authorizenet.CreditCard{CardNumber: orig.CardNumber}).CardNumber
+	resp.AccountType = "Visa"
+	return approved(resp)
+}
+
+func (t *Transaction) details() map[string]interface{} {
+	responseCode, _ := strconv.Atoi(t.ResponseCode)
+	details := map[string]interface{}{
+		"transId":           t.TransId,
+		"submitTimeUTC":     t.SubmittedAt.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"transactionType":   t.Type,
+		"transactionStatus": t.Status,
+		"responseCode":      responseCode,
+		"authAmount":        t.Amount,
+		"settleAmount":      t.Amount,
+		"order":             authorizenet.Order{InvoiceNumber: t.InvoiceNumber, Description: t.Description},
+		"profile": authorizenet.TransactionProfile{
+			CustomerProfileId:        t.CustomerProfileId,
+			CustomerPaymentProfileId: t.PaymentProfileId,
+		},
+	}
+	if t.RefTransId != "" {
+		details["refTransId"] = t.RefTransId
+	}
+	return details
+}
+
+func (s *Server) getTransactionDetails(body json.RawMessage) interface{} {
+	var req authorizenet.GetTransactionDetailsRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+
+	t, found := s.transactions[req.TransId]
+	if !found {
+		return notFound()
+	}
+	details := t.details()
+	if p, ok := s.profiles[t.CustomerProfileId]; ok {
+		details["customer"] = authorizenet.TransactionCustomer{Id: p.profile.MerchantCustomerId, Email: p.profile.Email}
+	}
+	return map[string]interface{}{
+		"transaction": details,
+		"messages":    ok(),
+	}
+}
+
+func (s *Server) getTransactionListForCustomer(body json.RawMessage) interface{} {
+	var req authorizenet.GetTransactionListForCustomerRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+	if _, found := s.profiles[req.CustomerProfileId]; !found {
+		return notFound()
+	}
+
+	var list []*Transaction
+	for _, id := range s.transOrder {
+		t := s.transactions[id]
+		if t.CustomerProfileId != req.CustomerProfileId {
+			continue
+		}
+		if req.CustomerPaymentProfileId != "" && t.PaymentProfileId != req.CustomerPaymentProfileId {
+			continue
+		}
+		list = append(list, t)
+	}
+	if req.Sorting != nil && req.Sorting.OrderDescending {
+		for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+			list[i], list[j] = list[j], list[i]
+		}
+	}
+	total := len(list)
+	if req.Paging != nil && req.Paging.Limit > 0 {
+		list = page(list, req.Paging)
+	}
+
+	summaries := []authorizenet.TransactionSummary{}
+	for _, t := range list {
+		summaries = append(summaries, authorizenet.TransactionSummary{
+			TransId:           t.TransId,
+			SubmitTimeUTC:     t.SubmittedAt.UTC().Format("2006-01-02T15:04:05Z"),
+			SubmitTimeLocal:   t.SubmittedAt.Format("2006-01-02T15:04:05"),
+			TransactionStatus: t.Status,
+			InvoiceNumber:     t.InvoiceNumber,
+			AccountType:       "Visa",
+			AccountNumber:     maskCard(authorizenet.CreditCard{CardNumber: t.CardNumber}).CardNumber,
+			SettleAmount:      t.Amount,
+			Profile: &authorizenet.TransactionProfile{
+				CustomerProfileId:        t.CustomerProfileId,
+				CustomerPaymentProfileId: t.PaymentProfileId,
+			},
+		})
+	}
+
+	return map[string]interface{}{
+		"transactions":        summaries,
+		"totalNumInResultSet": total,
+		"messages":            ok(),
+	}
+}
+
+func (s *Server) sendCustomerTransactionReceipt(body json.RawMessage) interface{} {
+	var req authorizenet.SendCustomerTransactionReceiptRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+	if _, found := s.transactions[req.TransId]; !found {
+		return notFound()
+	}
+
+	receipt := Receipt{TransId: req.TransId, Email: req.CustomerEmail}
+	if req.EmailSettings != nil {
+		for _, setting := range req.EmailSettings.Setting {
+			switch setting.SettingName {
+			case "headerEmailReceipt":
+				receipt.Header = setting.SettingValue
+			case "footerEmailReceipt":
+				receipt.Footer = setting.SettingValue
+			}
+		}
+	}
+	s.receipts = append(s.receipts, receipt)
+	return map[string]interface{}{"messages": ok()}
+}
+
+func (s *Server) getMerchantDetails(body json.RawMessage) interface{} {
+	return map[string]interface{}{
+		"isTestMode":     true,
+		"processors":     []authorizenet.Processor{{Name: "Fake Processor", Id: 1, CardTypes: []string{"V", "M", "A", "D"}}},
+		"merchantName":   "Fake Merchant",
+		"gatewayId":      "000000",
+		"marketTypes":    []string{"2"},
+		"productCodes":   []string{"CNP"},
+		"paymentMethods": []string{"Visa", "Mastercard", "AmericanExpress", "Discover"},
+		"currencies":     []string{"USD"},
+		"messages":       ok(),
+	}
+}
+
+func (s *Server) getAUJobSummary(body json.RawMessage) interface{} {
+	var req authorizenet.GetAUJobSummaryRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+
+	summaries := []authorizenet.AUSummary{}
+	byReason := map[string]int{}
+	if details, ok := s.auChanges[req.Month]; ok {
+		for _, change := range append(append([]authorizenet.AUChange{}, details.AuUpdate...), details.AuDelete...) {
+			i, seen := byReason[change.AuReasonCode]
+			if !seen {
+				i = len(summaries)
+				byReason[change.AuReasonCode] = i
+				summaries = append(summaries, authorizenet.AUSummary{AuReasonCode: change.AuReasonCode, ReasonDescription: change.ReasonDescription})
+			}
+			summaries[i].ProfileCount++
+		}
+	}
+
+	// The real gateway wraps the list in auSummary.auResponse.
+	return map[string]interface{}{
+		"auSummary": map[string]interface{}{"auResponse": summaries},
+		"messages":  ok(),
+	}
+}
+
+// getAUJobDetails pages through a month's updates followed by its deletes.
+func (s *Server) getAUJobDetails(body json.RawMessage) interface{} {
+	var req authorizenet.GetAUJobDetailsRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return map[string]interface{}{"messages": apiError("E00003", err.Error())}
+	}
+
+	type change struct {
+		deleted bool
+		authorizenet.AUChange
+	}
+	var changes []change
+	if details, ok := s.auChanges[req.Month]; ok {
+		if req.ModifiedTypeFilter != authorizenet.AUModifiedTypeDelete {
+			for _, c := range details.AuUpdate {
+				changes = append(changes, change{false, c})
+			}
+		}
+		if req.ModifiedTypeFilter != authorizenet.AUModifiedTypeUpdate {
+			for _, c := range details.AuDelete {
+				changes = append(changes, change{true, c})
+			}
+		}
+	}
+	total := len(changes)
+	if req.Paging != nil && req.Paging.Limit > 0 {
+		changes = page(changes, req.Paging)
+	}
+
+	var details authorizenet.AUDetails
+	for _, c := range changes {
+		if c.deleted {
+			details.AuDelete = append(details.AuDelete, c.AUChange)
+		} else {
+			details.AuUpdate = append(details.AuUpdate, c.AUChange)
+		}
+	}
+	return map[string]interface{}{
+		"totalNumInResultSet": total,
+		"auDetails":           details,
+		"messages":            ok(),
+	}
+}
@@ -0,0 +1,136 @@
+package fakegateway_test
+
+import (
+	"authnet/authorizenet"
+	"authnet/authorizenet/fakegateway"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newCustomer creates a customer profile, named after the running test, whose only payment
+// profile holds card and returns the profile and payment profile IDs.
+func newCustomer(t *testing.T, client *authorizenet.APIClient, card string) (string, string) {
+	t.Helper()
+	profileID, err := client.CreateCustomerProfile(authorizenet.CustomerProfile{
+		MerchantCustomerId: t.Name(),
+		PaymentProfiles: []authorizenet.PaymentProfile{{
+			Payment: authorizenet.Payment{CreditCard: authorizenet.CreditCard{CardNumber: card, ExpirationDate: "2030-12"}},
+		}},
+	}, "testMode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := client.GetCustomerProfile(profileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profileID, profile.PaymentProfiles[0].CustomerPaymentProfileId
+}
+
+// createTransaction posts a createTransactionRequest straight to the fake, so the test sees
+// the response the gateway sends rather than what APIClient makes of it.
+func createTransaction(t *testing.T, url, transactionRequest string) authorizenet.CreateTransactionResponse {
+	t.Helper()
+	body := `{"createTransactionRequest":{"merchantAuthentication":{"name":"login","transactionKey":"key"},"transactionRequest":` + transactionRequest + `}}`
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	var response authorizenet.CreateTransactionResponse
+	if err := json.Unmarshal(bytes.TrimPrefix(buf.Bytes(), []byte{0xef, 0xbb, 0xbf}), &response); err != nil {
+		t.Fatalf("failed to decode %s: %v", buf.Bytes(), err)
+	}
+	return response
+}
+
+func chargeRequest(transactionType, amount, profileID, paymentProfileID string) string {
+	return fmt.Sprintf(`{"transactionType":%q,"amount":%q,"profile":{"customerProfileId":%q,"paymentProfile":{"paymentProfileId":%q}}}`,
+		transactionType, amount, profileID, paymentProfileID)
+}
+
+func TestMagicValues(t *testing.T) {
+	fake := fakegateway.New()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := authorizenet.NewAPIClient("login", "key", srv.URL)
+
+	tests := []struct {
+		name            string
+		card            string
+		amount          string
+		transactionType string
+		responseCode    string
+		avs             string
+		errorCode       string
+		status          string
+	}{
+		{name: "approved charge", card: fakegateway.ApprovedCard, amount: "10.00", transactionType: "authCaptureTransaction", responseCode: "1", avs: "Y", status: fakegateway.StatusCaptured},
+		{name: "approved authorization", card: fakegateway.ApprovedCard, amount: "10.00", transactionType: "authOnlyTransaction", responseCode: "1", avs: "Y", status: fakegateway.StatusAuthorized},
+		{name: "declined amount", card: fakegateway.ApprovedCard, amount: "10.02", transactionType: "authCaptureTransaction", responseCode: "2", avs: "Y", errorCode: "2", status: fakegateway.StatusDeclined},
+		{name: "declined card", card: fakegateway.DeclinedCard, amount: "10.00", transactionType: "authCaptureTransaction", responseCode: "2", avs: "Y", errorCode: "2", status: fakegateway.StatusDeclined},
+		{name: "declined authorization", card: fakegateway.DeclinedCard, amount: "10.00", transactionType: "authOnlyTransaction", responseCode: "2", avs: "Y", errorCode: "2", status: fakegateway.StatusDeclined},
+		{name: "AVS mismatch amount", card: fakegateway.ApprovedCard, amount: "10.27", transactionType: "authCaptureTransaction", responseCode: "2", avs: "N", errorCode: "27", status: fakegateway.StatusDeclined},
+		{name: "AVS mismatch card", card: fakegateway.AVSMismatchCard, amount: "10.00", transactionType: "authCaptureTransaction", responseCode: "2", avs: "N", errorCode: "27", status: fakegateway.StatusDeclined},
+		{name: "processing error amount", card: fakegateway.ApprovedCard, amount: "10.05", transactionType: "authCaptureTransaction", responseCode: "3", avs: "P", errorCode: "57", status: fakegateway.StatusError},
+		{name: "processing error card", card: fakegateway.ErrorCard, amount: "10.00", transactionType: "authCaptureTransaction", responseCode: "3", avs: "P", errorCode: "57", status: fakegateway.StatusError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profileID, paymentProfileID := newCustomer(t, client, tt.card)
+			response := createTransaction(t, srv.URL, chargeRequest(tt.transactionType, tt.amount, profileID, paymentProfileID))
+			resp := response.TransactionResponse
+
+			wantResult := "Ok"
+			if tt.errorCode != "" {
+				wantResult = "Error"
+			}
+			if response.Messages.ResultCode != wantResult {
+				t.Errorf("result code %q, want %q", response.Messages.ResultCode, wantResult)
+			}
+			if resp.ResponseCode != tt.responseCode || resp.AvsResultCode != tt.avs || resp.TransId == "" {
+				t.Errorf("response code %q, AVS %q, transId %q; want %q, %q", resp.ResponseCode, resp.AvsResultCode, resp.TransId, tt.responseCode, tt.avs)
+			}
+			if tt.errorCode == "" {
+				if resp.AuthCode == "" || len(resp.Errors) != 0 {
+					t.Errorf("unexpected approval %+v", resp)
+				}
+			} else if len(resp.Errors) != 1 || resp.Errors[0].ErrorCode != tt.errorCode {
+				t.Errorf("errors = %+v, want code %s", resp.Errors, tt.errorCode)
+			}
+
+			stored, found := fake.Transaction(resp.TransId)
+			if !found {
+				t.Fatalf("transaction %s not stored", resp.TransId)
+			}
+			if stored.Status != tt.status || stored.ResponseCode != tt.responseCode || stored.CardNumber != tt.card {
+				t.Errorf("stored %+v, want status %s", stored, tt.status)
+			}
+		})
+	}
+}
+
+func TestDeclinedAuthorizationCannotBeCaptured(t *testing.T) {
+	srv := httptest.NewServer(fakegateway.New())
+	defer srv.Close()
+	client := authorizenet.NewAPIClient("login", "key", srv.URL)
+
+	profileID, paymentProfileID := newCustomer(t, client, fakegateway.ApprovedCard)
+	auth := createTransaction(t, srv.URL, chargeRequest("authOnlyTransaction", "10.02", profileID, paymentProfileID))
+	if auth.TransactionResponse.ResponseCode != "2" {
+		t.Fatalf("expected a decline, got %+v", auth.TransactionResponse)
+	}
+	capture := createTransaction(t, srv.URL, fmt.Sprintf(`{"transactionType":"priorAuthCaptureTransaction","refTransId":%q}`, auth.TransactionResponse.TransId))
+	if capture.Messages.ResultCode == "Ok" {
+		t.Error("captured a declined authorization")
+	}
+}
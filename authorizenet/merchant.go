@@ -0,0 +1,81 @@
+package authorizenet
+
+import (
+	"fmt"
+)
+
+// ResponseMessages is the "messages" block returned with every Authorize.Net response.
+type ResponseMessages struct {
+	ResultCode string `json:"resultCode"`
+	Message    []struct {
+		Code string `json:"code"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// Err converts a non-Ok result into an error, or returns nil on success.
+func (m ResponseMessages) Err() error {
+	if m.ResultCode == "Ok" {
+		return nil
+	}
+	if len(m.Message) > 0 {
+		return fmt.Errorf("API error: %s (Code: %s)", m.Message[0].Text, m.Message[0].Code)
+	}
+	return fmt.Errorf("API error: request failed with ResultCode '%s'", m.ResultCode)
+}
+
+type Processor struct {
+	Name      string   `json:"name"`
+	Id        int      `json:"id"`
+	CardTypes []string `json:"cardTypes,omitempty"`
+}
+
+type MerchantContact struct {
+	FirstName string `json:"firstName,omitempty"`
+	LastName  string `json:"lastName,omitempty"`
+	Email     string `json:"email,omitempty"`
+}
+
+type MerchantDetails struct {
+	IsTestMode       bool              `json:"isTestMode"`
+	Processors       []Processor       `json:"processors"`
+	MerchantName     string            `json:"merchantName"`
+	GatewayId        string            `json:"gatewayId"`
+	MarketTypes      []string          `json:"marketTypes,omitempty"`
+	ProductCodes     []string          `json:"productCodes,omitempty"`
+	PaymentMethods   []string          `json:"paymentMethods"`
+	Currencies       []string          `json:"currencies"`
+	MerchantTimeZone string            `json:"merchantTimeZone,omitempty"`
+	ContactDetails   []MerchantContact `json:"contactDetails,omitempty"`
+}
+
+type GetMerchantDetailsRequest struct {
+	MerchantAuthentication MerchantAuthentication `json:"merchantAuthentication"`
+}
+
+type GetMerchantDetailsResponse struct {
+	MerchantDetails
+	Messages ResponseMessages `json:"messages"`
+}
+
+// GetMerchantDetails reports what the merchant account is configured to accept.
+// The public client key is deliberately not decoded so it never ends up in our responses.
+func (c *APIClient) GetMerchantDetails() (*MerchantDetails, error) {
+	requestWrapper := struct {
+		Request GetMerchantDetailsRequest `json:"getMerchantDetailsRequest"`
+	}{
+		Request: GetMerchantDetailsRequest{
+			MerchantAuthentication: c.Auth,
+		},
+	}
+
+	var response GetMerchantDetailsResponse
+	if err := c.makeRequest(requestWrapper, &response); err != nil {
+		return nil, err
+	}
+	if err := response.Messages.Err(); err != nil {
+		return nil, err
+	}
+
+	return &response.MerchantDetails, nil
+}
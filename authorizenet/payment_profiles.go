@@ -0,0 +1,58 @@
+package authorizenet
+
+// MaskedCreditCard is a stored card as the gateway reports it back, with the number masked.
+type MaskedCreditCard struct {
+	CardNumber     string `json:"cardNumber"`
+	ExpirationDate string `json:"expirationDate"`
+	CardType       string `json:"cardType,omitempty"`
+}
+
+type PaymentProfileListItem struct {
+	DefaultPaymentProfile    bool             `json:"defaultPaymentProfile"`
+	CustomerPaymentProfileId int              `json:"customerPaymentProfileId"`
+	CustomerProfileId        int              `json:"customerProfileId"`
+	BillTo                   *ShippingAddress `json:"billTo,omitempty"`
+	Payment                  struct {
+		CreditCard MaskedCreditCard `json:"creditCard"`
+	} `json:"payment"`
+}
+
+type GetCustomerPaymentProfileListRequest struct {
+	MerchantAuthentication MerchantAuthentication `json:"merchantAuthentication"`
+	SearchType             string                 `json:"searchType"`
+	Month                  string                 `json:"month"`
+	Sorting                *Sorting               `json:"sorting,omitempty"`
+	Paging                 *Paging                `json:"paging,omitempty"`
+}
+
+type GetCustomerPaymentProfileListResponse struct {
+	TotalNumInResultSet int                      `json:"totalNumInResultSet"`
+	PaymentProfiles     []PaymentProfileListItem `json:"paymentProfiles"`
+	Messages            ResponseMessages         `json:"messages"`
+}
+
+// GetCardsExpiringInMonth returns one page of payment profiles whose card expires in month
+// (formatted YYYY-MM) and the total number of matches. Offset is the 1-based page number.
+func (c *APIClient) GetCardsExpiringInMonth(month string, sorting *Sorting, paging *Paging) ([]PaymentProfileListItem, int, error) {
+	requestWrapper := struct {
+		Request GetCustomerPaymentProfileListRequest `json:"getCustomerPaymentProfileListRequest"`
+	}{
+		Request: GetCustomerPaymentProfileListRequest{
+			MerchantAuthentication: c.Auth,
+			SearchType:             "cardsExpiringInMonth",
+			Month:                  month,
+			Sorting:                sorting,
+			Paging:                 paging,
+		},
+	}
+
+	var response GetCustomerPaymentProfileListResponse
+	if err := c.makeRequest(requestWrapper, &response); err != nil {
+		return nil, 0, err
+	}
+	if err := response.Messages.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return response.PaymentProfiles, response.TotalNumInResultSet, nil
+}
@@ -0,0 +1,59 @@
+package authorizenet
+
+type Setting struct {
+	SettingName  string `json:"settingName"`
+	SettingValue string `json:"settingValue"`
+}
+
+type EmailSettings struct {
+	Setting []Setting `json:"setting"`
+}
+
+// ReceiptOptions carries the custom header and footer text printed on the emailed receipt.
+type ReceiptOptions struct {
+	Header string
+	Footer string
+}
+
+func (o ReceiptOptions) emailSettings() *EmailSettings {
+	var settings []Setting
+	if o.Header != "" {
+		settings = append(settings, Setting{SettingName: "headerEmailReceipt", SettingValue: o.Header})
+	}
+	if o.Footer != "" {
+		settings = append(settings, Setting{SettingName: "footerEmailReceipt", SettingValue: o.Footer})
+	}
+	if len(settings) == 0 {
+		return nil
+	}
+	return &EmailSettings{Setting: settings}
+}
+
+type SendCustomerTransactionReceiptRequest struct {
+	MerchantAuthentication MerchantAuthentication `json:"merchantAuthentication"`
+	TransId                string                 `json:"transId"`
+	CustomerEmail          string                 `json:"customerEmail"`
+	EmailSettings          *EmailSettings         `json:"emailSettings,omitempty"`
+}
+
+func (c *APIClient) SendCustomerTransactionReceipt(transId, customerEmail string, opts ReceiptOptions) error {
+	requestWrapper := struct {
+		Request SendCustomerTransactionReceiptRequest `json:"sendCustomerTransactionReceiptRequest"`
+	}{
+		Request: SendCustomerTransactionReceiptRequest{
+			MerchantAuthentication: c.Auth,
+			TransId:                transId,
+			CustomerEmail:          customerEmail,
+			EmailSettings:          opts.emailSettings(),
+		},
+	}
+
+	var response struct {
+		Messages ResponseMessages `json:"messages"`
+	}
+	if err := c.makeRequest(requestWrapper, &response); err != nil {
+		return err
+	}
+
+	return response.Messages.Err()
+}
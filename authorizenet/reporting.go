@@ -0,0 +1,142 @@
+package authorizenet
+
+type TransactionProfile struct {
+	CustomerProfileId        string `json:"customerProfileId"`
+	CustomerPaymentProfileId string `json:"customerPaymentProfileId"`
+}
+
+type TransactionCustomer struct {
+	Id    string `json:"id,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+type TransactionDetails struct {
+	TransId           string               `json:"transId"`
+	RefTransId        string               `json:"refTransId,omitempty"`
+	SubmitTimeUTC     string               `json:"submitTimeUTC"`
+	TransactionType   string               `json:"transactionType"`
+	TransactionStatus string               `json:"transactionStatus"`
+	ResponseCode      int                  `json:"responseCode"`
+	AuthCode          string               `json:"authCode,omitempty"`
+	AuthAmount        float64              `json:"authAmount"`
+	SettleAmount      float64              `json:"settleAmount"`
+	Order             *Order               `json:"order,omitempty"`
+	Customer          *TransactionCustomer `json:"customer,omitempty"`
+	Profile           *TransactionProfile  `json:"profile,omitempty"`
+}
+
+type GetTransactionDetailsRequest struct {
+	MerchantAuthentication MerchantAuthentication `json:"merchantAuthentication"`
+	TransId                string                 `json:"transId"`
+}
+
+type GetTransactionDetailsResponse struct {
+	Transaction TransactionDetails `json:"transaction"`
+	Messages    ResponseMessages   `json:"messages"`
+}
+
+func (c *APIClient) GetTransactionDetails(transId string) (*TransactionDetails, error) {
+	requestWrapper := struct {
+		Request GetTransactionDetailsRequest `json:"getTransactionDetailsRequest"`
+	}{
+		Request: GetTransactionDetailsRequest{
+			MerchantAuthentication: c.Auth,
+			TransId:                transId,
+		},
+	}
+
+	var response GetTransactionDetailsResponse
+	if err := c.makeRequest(requestWrapper, &response); err != nil {
+		return nil, err
+	}
+	if err := response.Messages.Err(); err != nil {
+		return nil, err
+	}
+
+	return &response.Transaction, nil
+}
+
+type Sorting struct {
+	OrderBy         string `json:"orderBy"`
+	OrderDescending bool   `json:"orderDescending"`
+}
+
+type TransactionSummary struct {
+	TransId           string              `json:"transId"`
+	SubmitTimeUTC     string              `json:"submitTimeUTC"`
+	SubmitTimeLocal   string              `json:"submitTimeLocal"`
+	TransactionStatus string              `json:"transactionStatus"`
+	InvoiceNumber     string              `json:"invoiceNumber,omitempty"`
+	FirstName         string              `json:"firstName,omitempty"`
+	LastName          string              `json:"lastName,omitempty"`
+	AccountType       string              `json:"accountType"`
+	AccountNumber     string              `json:"accountNumber"`
+	SettleAmount      float64             `json:"settleAmount"`
+	Profile           *TransactionProfile `json:"profile,omitempty"`
+}
+
+type GetTransactionListForCustomerRequest struct {
+	MerchantAuthentication   MerchantAuthentication `json:"merchantAuthentication"`
+	CustomerProfileId        string                 `json:"customerProfileId"`
+	CustomerPaymentProfileId string                 `json:"customerPaymentProfileId,omitempty"`
+	Sorting                  *Sorting               `json:"sorting,omitempty"`
+	Paging                   *Paging                `json:"paging,omitempty"`
+}
+
+type GetTransactionListResponse struct {
+	Transactions        []TransactionSummary `json:"transactions"`
+	TotalNumInResultSet int                  `json:"totalNumInResultSet"`
+	Messages            ResponseMessages     `json:"messages"`
+}
+
+// TransactionListOptions narrows and orders a customer's transaction history.
+// Offset is the 1-based page number, as Authorize.Net defines it.
+type TransactionListOptions struct {
+	PaymentProfileId string
+	OrderBy          string
+	OrderDescending  bool
+	Limit            int
+	Offset           int
+}
+
+// GetTransactionListForCustomer returns one page of transactions charged to a customer profile
+// together with the total number of transactions available.
+func (c *APIClient) GetTransactionListForCustomer(customerProfileId string, opts TransactionListOptions) ([]TransactionSummary, int, error) {
+	request := GetTransactionListForCustomerRequest{
+		MerchantAuthentication:   c.Auth,
+		CustomerProfileId:        customerProfileId,
+		CustomerPaymentProfileId: opts.PaymentProfileId,
+	}
+	if opts.OrderBy != "" {
+		request.Sorting = &Sorting{
+			OrderBy:         opts.OrderBy,
+			OrderDescending: opts.OrderDescending,
+		}
+	}
+	if opts.Limit > 0 {
+		offset := opts.Offset
+		if offset < 1 {
+			offset = 1
+		}
+		request.Paging = &Paging{
+			Limit:  opts.Limit,
+			Offset: offset,
+		}
+	}
+
+	requestWrapper := struct {
+		Request GetTransactionListForCustomerRequest `json:"getTransactionListForCustomerRequest"`
+	}{
+		Request: request,
+	}
+
+	var response GetTransactionListResponse
+	if err := c.makeRequest(requestWrapper, &response); err != nil {
+		return nil, 0, err
+	}
+	if err := response.Messages.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return response.Transactions, response.TotalNumInResultSet, nil
+}
@@ -0,0 +1,92 @@
+package authorizenet
+
+import "fmt"
+
+// transactionError describes why a createTransactionRequest failed, preferring the
+// transaction-level error text over the generic "The transaction was unsuccessful.".
+func transactionError(response *CreateTransactionResponse) error {
+	if errs := response.TransactionResponse.Errors; len(errs) > 0 {
+		return fmt.Errorf("API error: %s (Code: %s)", errs[0].ErrorText, errs[0].ErrorCode)
+	}
+	if len(response.Messages.Message) > 0 {
+		return fmt.Errorf("API error: %s", response.Messages.Message[0].Text)
+	}
+	return fmt.Errorf("API error: unknown error")
+}
+
+// declinedResponse is the transaction part of a failed createTransactionRequest, returned
+// alongside the error so declines keep their transId, response code and AVS/CVV results.
+// It is nil when the request was rejected before it became a transaction.
+func declinedResponse(response *CreateTransactionResponse) *FullTransactionResponse {
+	if response.TransactionResponse.ResponseCode == "" && response.TransactionResponse.TransId == "" {
+		return nil
+	}
+	return &response.TransactionResponse
+}
+
+// RefundTransaction credits amount back against a settled transaction. The gateway needs
+// to know which card to credit; passing the customer and payment profile IDs lets it find
+// the card without us handling the card number. Either may be empty if the gateway can
+// match the card from refTransId alone.
+func (c *APIClient) RefundTransaction(refTransId, amount, profileID, paymentProfileID string) (*FullTransactionResponse, error) {
+	c.logger().Debug("refunding transaction", "ref_trans_id", refTransId, "amount", amount)
+
+	transactionRequest := TransactionRequestType{
+		TransactionType: "refundTransaction",
+		Amount:          amount,
+		RefTransId:      refTransId,
+	}
+	if profileID != "" {
+		transactionRequest.Profile = &struct {
+			CustomerProfileID string `json:"customerProfileId"`
+			PaymentProfile    struct {
+				PaymentProfileId string `json:"paymentProfileId"`
+			} `json:"paymentProfile"`
+		}{CustomerProfileID: profileID}
+		transactionRequest.Profile.PaymentProfile.PaymentProfileId = paymentProfileID
+	}
+
+	requestWrapper := struct {
+		CreateTransactionRequest CreateTransactionRequest `json:"createTransactionRequest"`
+	}{
+		CreateTransactionRequest: CreateTransactionRequest{
+			MerchantAuthentication: c.Auth,
+			TransactionRequest:     transactionRequest,
+		},
+	}
+
+	var response CreateTransactionResponse
+	if err := c.makeRequest(requestWrapper, &response); err != nil {
+		return nil, err
+	}
+	if response.Messages.ResultCode != "Ok" {
+		return declinedResponse(&response), transactionError(&response)
+	}
+	return &response.TransactionResponse, nil
+}
+
+// VoidTransaction cancels an authorization or an unsettled capture.
+func (c *APIClient) VoidTransaction(refTransId string) (*FullTransactionResponse, error) {
+	c.logger().Debug("voiding transaction", "ref_trans_id", refTransId)
+
+	requestWrapper := struct {
+		CreateTransactionRequest CreateTransactionRequest `json:"createTransactionRequest"`
+	}{
+		CreateTransactionRequest: CreateTransactionRequest{
+			MerchantAuthentication: c.Auth,
+			TransactionRequest: TransactionRequestType{
+				TransactionType: "voidTransaction",
+				RefTransId:      refTransId,
+			},
+		},
+	}
+
+	var response CreateTransactionResponse
+	if err := c.makeRequest(requestWrapper, &response); err != nil {
+		return nil, err
+	}
+	if response.Messages.ResultCode != "Ok" {
+		return declinedResponse(&response), transactionError(&response)
+	}
+	return &response.TransactionResponse, nil
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"authnet/authorizenet"
+	"authnet/redact"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type authNetConfig struct {
+	// Environment is "production" or "sandbox"; it picks the validation mode and the
+	// default endpoint.
+	Environment    string
+	Endpoint       string
+	ValidationMode string
+	LoginID        string
+	TransactionKey string
+}
+
+type config struct {
+	// Addr is the address the HTTPS server listens on.
+	Addr        string
+	TLSCertFile string
+	TLSKeyFile  string
+	// ReadTimeout, WriteTimeout and IdleTimeout bound how long a connection may spend
+	// sending a request, receiving the response and waiting for its next request.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// ShutdownTimeout is how long in-flight requests get to finish after SIGTERM.
+	ShutdownTimeout time.Duration
+	// CORSOrigins are the browser origins allowed to call the API.
+	CORSOrigins []string
+	DatabaseDSN string
+
+	AuthNet      authNetConfig
+	LogFormat    string
+	LogLevel     string
+	ProfileFetch authorizenet.FetchOptions
+	// ProfileSyncInterval is how often the customer profile mirror is fully resynced.
+	ProfileSyncInterval time.Duration
+	ClientCerts         clientCertConfig
+	// IdempotencyWindow is how long an Idempotency-Key and its response are remembered.
+	IdempotencyWindow time.Duration
+}
+
+// defaultConfig is the configuration before the file, environment and flags are applied.
+func defaultConfig() *config {
+	return &config{
+		Addr:                ":1337",
+		TLSCertFile:         "cert.pem",
+		TLSKeyFile:          "key.pem",
+		ReadTimeout:         15 * time.Second,
+		WriteTimeout:        90 * time.Second,
+		IdleTimeout:         2 * time.Minute,
+		ShutdownTimeout:     30 * time.Second,
+		CORSOrigins:         []string{"https://www.handbellworld.com"},
+		AuthNet:             authNetConfig{Environment: "sandbox"},
+		ProfileFetch:        authorizenet.DefaultFetchOptions,
+		ProfileSyncInterval: 15 * time.Minute,
+		IdempotencyWindow:   24 * time.Hour,
+	}
+}
+
+// setting is one configuration value. It can be given in the config file as key, in the
+// environment as env, or on the command line as -key with '.' and '_' turned into '-'
+// (server.tls_cert becomes -server-tls-cert). Later sources win: file, environment, flags.
+type setting struct {
+	key    string
+	env    string
+	usage  string
+	secret bool
+	list   bool // a comma-separated string, or an array of strings in the file
+	set    func(c *config, v string) error
+	get    func(c *config) string
+}
+
+// display is the setting's value as printed, with secrets masked.
+func (s setting) display(c *config) string {
+	v := s.get(c)
+	if s.secret && v != "" {
+		return redact.Mask
+	}
+	return v
+}
+
+func (s setting) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.key)
+}
+
+func positiveDuration(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, errors.New("must be a positive duration")
+	}
+	return d, nil
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var settings = []setting{
+	{
+		key: "server.addr", env: "LISTEN_ADDR", usage: "address to listen on",
+		set: func(c *config, v string) error { c.Addr = v; return nil },
+		get: func(c *config) string { return c.Addr },
+	},
+	{
+		key: "server.tls_cert", env: "TLS_CERT_FILE", usage: "PEM certificate for HTTPS",
+		set: func(c *config, v string) error { c.TLSCertFile = v; return nil },
+		get: func(c *config) string { return c.TLSCertFile },
+	},
+	{
+		key: "server.tls_key", env: "TLS_KEY_FILE", usage: "PEM private key for HTTPS",
+		set: func(c *config, v string) error { c.TLSKeyFile = v; return nil },
+		get: func(c *config) string { return c.TLSKeyFile },
+	},
+	{
+		key: "server.cors_origins", env: "CORS_ORIGINS", usage: "comma-separated origins allowed by CORS", list: true,
+		set: func(c *config, v string) error {
+			origins := splitList(v)
+			for _, origin := range origins {
+				if u, err := url.Parse(origin); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Path != "" {
+					return fmt.Errorf("invalid origin %q, expected scheme://host", origin)
+				}
+			}
+			c.CORSOrigins = origins
+			return nil
+		},
+		get: func(c *config) string { return strings.Join(c.CORSOrigins, ",") },
+	},
+	{
+		key: "server.read_timeout", env: "READ_TIMEOUT", usage: "longest a client may take to send a request",
+		set: func(c *config, v string) (err error) {
+			c.ReadTimeout, err = positiveDuration(v)
+			return err
+		},
+		get: func(c *config) string { return c.ReadTimeout.String() },
+	},
+	{
+		key: "server.write_timeout", env: "WRITE_TIMEOUT", usage: "longest a response may take, gateway calls included",
+		set: func(c *config, v string) (err error) {
+			c.WriteTimeout, err = positiveDuration(v)
+			return err
+		},
+		get: func(c *config) string { return c.WriteTimeout.String() },
+	},
+	{
+		key: "server.idle_timeout", env: "IDLE_TIMEOUT", usage: "how long an idle keep-alive connection is kept open",
+		set: func(c *config, v string) (err error) {
+			c.IdleTimeout, err = positiveDuration(v)
+			return err
+		},
+		get: func(c *config) string { return c.IdleTimeout.String() },
+	},
+	{
+		key: "server.shutdown_timeout", env: "SHUTDOWN_TIMEOUT", usage: "how long in-flight requests get to finish on shutdown",
+		set: func(c *config, v string) (err error) {
+			c.ShutdownTimeout, err = positiveDuration(v)
+			return err
+		},
+		get: func(c *config) string { return c.ShutdownTimeout.String() },
+	},
+	{
+		key: "database.dsn", env: "DB_DSN", usage: "Postgres connection string", secret: true,
+		set: func(c *config, v string) error { c.DatabaseDSN = v; return nil },
+		get: func(c *config) string { return c.DatabaseDSN },
+	},
+	{
+		key: "log.format", env: "LOG_FORMAT", usage: "json or text",
+		set: func(c *config, v string) error {
+			if v != "json" && v != "text" {
+				return errors.New("must be json or text")
+			}
+			c.LogFormat = v
+			return nil
+		},
+		get: func(c *config) string { return c.LogFormat },
+	},
+	{
+		key: "log.level", env: "LOG_LEVEL", usage: "debug, info, warn or error",
+		set: func(c *config, v string) error {
+			if !slices.Contains([]string{"debug", "info", "warn", "error"}, strings.ToLower(v)) {
+				return errors.New("must be debug, info, warn or error")
+			}
+			c.LogLevel = v
+			return nil
+		},
+		get: func(c *config) string { return c.LogLevel },
+	},
+	{
+		key: "authorizenet.environment", env: "AUTHORIZENET_ENVIRONMENT", usage: "production; anything else means sandbox",
+		set: func(c *config, v string) error {
+			if v != "production" {
+				v = "sandbox"
+			}
+			c.AuthNet.Environment = v
+			return nil
+		},
+		get: func(c *config) string { return c.AuthNet.Environment },
+	},
+	{
+		key: "authorizenet.endpoint", env: "AUTHORIZENET_ENDPOINT", usage: "API endpoint; defaults to the environment's",
+		set: func(c *config, v string) error {
+			if u, err := url.Parse(v); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return errors.New("must be an http or https URL")
+			}
+			c.AuthNet.Endpoint = v
+			return nil
+		},
+		get: func(c *config) string { return c.AuthNet.Endpoint },
+	},
+	{
+		key: "authorizenet.login_id", env: "AUTHORIZENET_NAME", usage: "API login ID",
+		set: func(c *config, v string) error { c.AuthNet.LoginID = v; return nil },
+		get: func(c *config) string { return c.AuthNet.LoginID },
+	},
+	{
+		key: "authorizenet.transaction_key", env: "AUTHORIZENET_TRANSACTION_KEY", usage: "API transaction key", secret: true,
+		set: func(c *config, v string) error { c.AuthNet.TransactionKey = v; return nil },
+		get: func(c *config) string { return c.AuthNet.TransactionKey },
+	},
+	{
+		key: "profiles.fetch_workers", env: "PROFILE_FETCH_WORKERS", usage: "concurrent profile fetches",
+		set: func(c *config, v string) error {
+			workers, err := strconv.Atoi(v)
+			if err != nil || workers < 1 {
+				return errors.New("must be a positive integer")
+			}
+			c.ProfileFetch.Workers = workers
+			return nil
+		},
+		get: func(c *config) string { return strconv.Itoa(c.ProfileFetch.Workers) },
+	},
+	{
+		key: "profiles.fetch_rps", env: "PROFILE_FETCH_RPS", usage: "profile fetches per second, 0 for unlimited",
+		set: func(c *config, v string) error {
+			rps, err := strconv.ParseFloat(v, 64)
+			if err != nil || rps < 0 {
+				return errors.New("must be a non-negative number")
+			}
+			c.ProfileFetch.RequestsPerSecond = rps
+			return nil
+		},
+		get: func(c *config) string { return strconv.FormatFloat(c.ProfileFetch.RequestsPerSecond, 'g', -1, 64) },
+	},
+	{
+		key: "profiles.sync_interval", env: "PROFILE_SYNC_INTERVAL", usage: "how often the profile mirror is resynced",
+		set: func(c *config, v string) (err error) {
+			c.ProfileSyncInterval, err = positiveDuration(v)
+			return err
+		},
+		get: func(c *config) string { return c.ProfileSyncInterval.String() },
+	},
+	{
+		key: "idempotency.window", env: "IDEMPOTENCY_WINDOW", usage: "how long Idempotency-Keys are remembered",
+		set: func(c *config, v string) (err error) {
+			c.IdempotencyWindow, err = positiveDuration(v)
+			return err
+		},
+		get: func(c *config) string { return c.IdempotencyWindow.String() },
+	},
+	{
+		key: "client_certs.ca_file", env: "CLIENT_CA_FILE", usage: "PEM bundle of CAs for client certificates",
+		set: func(c *config, v string) error { c.ClientCerts.CAFile = v; return nil },
+		get: func(c *config) string { return c.ClientCerts.CAFile },
+	},
+	{
+		key: "client_certs.required", env: "CLIENT_CERT_REQUIRED", usage: "reject connections without a client certificate",
+		set: func(c *config, v string) error {
+			required, err := strconv.ParseBool(v)
+			if err != nil {
+				return errors.New("must be true or false")
+			}
+			c.ClientCerts.Require = required
+			return nil
+		},
+		get: func(c *config) string { return strconv.FormatBool(c.ClientCerts.Require) },
+	},
+	{
+		key: "client_certs.scopes", env: "CLIENT_CERT_SCOPES", usage: "subject=scopes pairs separated by ';'",
+		set: func(c *config, v string) (err error) {
+			c.ClientCerts.Scopes, err = parseCertScopes(v)
+			return err
+		},
+		get: func(c *config) string { return formatCertScopes(c.ClientCerts.Scopes) },
+	},
+}
+
+// loadConfig builds the configuration from defaults, then the config file, then the
+// environment, then flags in args. The file is named by -config or CONFIG_FILE. It returns
+// the arguments left after the flags, which name a subcommand if there is one.
+func loadConfig(args []string, getenv func(string) string) (*config, []string, error) {
+	fs := flag.NewFlagSet("authnet", flag.ContinueOnError)
+	configFile := fs.String("config", getenv("CONFIG_FILE"), "TOML config file")
+	for _, s := range settings {
+		fs.String(s.flagName(), "", s.usage+" ($"+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	cfg := defaultConfig()
+	if *configFile != "" {
+		f, err := os.Open(*configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		values, err := parseConfigFile(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", *configFile, err)
+		}
+		for _, s := range settings {
+			if v, ok := values[s.key]; ok {
+				if err := s.set(cfg, v); err != nil {
+					return nil, nil, fmt.Errorf("%s: %s %v", *configFile, s.key, err)
+				}
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if v := getenv(s.env); v != "" {
+			if err := s.set(cfg, v); err != nil {
+				return nil, nil, fmt.Errorf("%s %v", s.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if flagErr == nil && f.Name == s.flagName() {
+				if err := s.set(cfg, f.Value.String()); err != nil {
+					flagErr = fmt.Errorf("-%s %v", f.Name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, nil, flagErr
+	}
+
+	if err := cfg.finish(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// finish fills in values derived from others and checks settings that depend on each other.
+func (c *config) finish() error {
+	if c.AuthNet.Environment == "production" {
+		c.AuthNet.ValidationMode = "liveMode"
+		if c.AuthNet.Endpoint == "" {
+			c.AuthNet.Endpoint = authorizenet.ProductionEndpoint
+		}
+	} else {
+		c.AuthNet.ValidationMode = "testMode"
+		if c.AuthNet.Endpoint == "" {
+			c.AuthNet.Endpoint = authorizenet.SandboxEndpoint
+		}
+	}
+
+	if c.DatabaseDSN == "" {
+		return errors.New("missing required settings: database.dsn")
+	}
+	if c.Addr == "" || c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return errors.New("server.addr, server.tls_cert and server.tls_key cannot be empty")
+	}
+	if c.ClientCerts.CAFile == "" && (c.ClientCerts.Require || len(c.ClientCerts.Scopes) > 0) {
+		return errors.New("client_certs.required and client_certs.scopes need client_certs.ca_file")
+	}
+	return nil
+}
+
+// requireGateway checks the settings needed by commands that call the gateway. migrate and
+// apikey only use the database, so loadConfig doesn't insist on them.
+func (c *config) requireGateway() error {
+	var missing []string
+	if c.AuthNet.LoginID == "" {
+		missing = append(missing, "authorizenet.login_id")
+	}
+	if c.AuthNet.TransactionKey == "" {
+		missing = append(missing, "authorizenet.transaction_key")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required settings: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// parseConfigFile reads the subset of TOML the config file uses: [section] headers and
+// key = value lines, where a value is a string, a one-line array of strings, a number or a
+// boolean. Keys are returned as "section.key"; arrays are joined with commas. Anything else,
+// such as inline tables, multi-line strings or arrays of tables, is an error naming its line
+// rather than something to guess at.
+//
+//	[server]
+//	addr = ":8443"
+//	cors_origins = ["https://www.handbellworld.com", "https://handbellworld.com"]
+//
+//	[authorizenet]
+//	environment = "production"   # or "sandbox"
+func parseConfigFile(r io.Reader) (map[string]string, error) {
+	values := map[string]string{}
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[[") {
+			return nil, fmt.Errorf("line %d: arrays of tables are not supported", n)
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated section header", n)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if !bareKey.MatchString(section) {
+				return nil, fmt.Errorf("line %d: invalid section name %q", n, section)
+			}
+			continue
+		}
+
+		name, raw, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		if !bareKey.MatchString(name) {
+			return nil, fmt.Errorf("line %d: invalid key %q; quoted keys are not supported", n, name)
+		}
+		key := name
+		if section != "" {
+			key = section + "." + name
+		}
+		i := slices.IndexFunc(settings, func(s setting) bool { return s.key == key })
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: unknown setting %s", n, key)
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("line %d: %s is set twice", n, key)
+		}
+		v, array, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", n, key, err)
+		}
+		if array && !settings[i].list {
+			return nil, fmt.Errorf("line %d: %s takes a single value, not an array", n, key)
+		}
+		values[key] = v
+	}
+	return values, scanner.Err()
+}
+
+var (
+	// bareKey matches a TOML bare key, or several joined by dots.
+	bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+	// configNumber matches TOML decimal integers and floats, with optional '_' separators.
+	configNumber = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)(\.[0-9](_?[0-9])*)?([eE][+-]?[0-9](_?[0-9])*)?$`)
+)
+
+// stripComment drops a '#' comment that isn't inside a quoted string.
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseConfigValue parses one value and reports whether it was an array.
+func parseConfigValue(raw string) (string, bool, error) {
+	switch {
+	case raw == "":
+		return "", false, errors.New("missing value")
+	case strings.HasPrefix(raw, `"""`) || strings.HasPrefix(raw, "'''"):
+		return "", false, errors.New("multi-line strings are not supported")
+	case raw[0] == '{':
+		return "", false, errors.New("inline tables are not supported")
+	case raw[0] == '[':
+		items, err := parseConfigArray(raw)
+		return strings.Join(items, ","), true, err
+	case raw[0] == '"' || raw[0] == '\'':
+		v, rest, err := parseConfigString(raw)
+		if err == nil && rest != "" {
+			err = fmt.Errorf("unexpected %s after the string", rest)
+		}
+		return v, false, err
+	case raw == "true" || raw == "false":
+		return raw, false, nil
+	case configNumber.MatchString(raw):
+		return strings.ReplaceAll(raw, "_", ""), false, nil
+	}
+	return "", false, fmt.Errorf("invalid value %s; quote strings", raw)
+}
+
+// parseConfigArray parses a one-line array of strings. The items are joined with commas
+// afterwards, so an item may not contain one.
+func parseConfigArray(raw string) ([]string, error) {
+	items := []string{}
+	rest := strings.TrimSpace(raw[1:])
+	for {
+		switch {
+		case rest == "":
+			return nil, errors.New("arrays must be on one line")
+		case rest[0] == ']':
+			if tail := strings.TrimSpace(rest[1:]); tail != "" {
+				return nil, fmt.Errorf("unexpected %s after the array", tail)
+			}
+			return items, nil
+		case rest[0] != '"' && rest[0] != '\'' || strings.HasPrefix(rest, `"""`) || strings.HasPrefix(rest, "'''"):
+			return nil, errors.New("array items must be one-line strings")
+		}
+		item, after, err := parseConfigString(rest)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(item, ",") {
+			return nil, fmt.Errorf("array item %q cannot contain a comma", item)
+		}
+		items = append(items, item)
+		if strings.HasPrefix(after, ",") {
+			after = strings.TrimSpace(after[1:])
+		} else if after != "" && after[0] != ']' {
+			return nil, fmt.Errorf("expected , or ] before %s", after)
+		}
+		rest = after
+	}
+}
+
+// parseConfigString parses the basic ("...") or literal ('...') string that raw starts with
+// and returns it with whatever follows, trimmed.
+func parseConfigString(raw string) (string, string, error) {
+	quote := raw[0]
+	var b strings.Builder
+	for i := 1; i < len(raw); i++ {
+		switch c := raw[i]; {
+		case c == quote:
+			return b.String(), strings.TrimSpace(raw[i+1:]), nil
+		case c == '\\' && quote == '"':
+			r, size, err := configEscape(raw[i:])
+			if err != nil {
+				return "", "", err
+			}
+			b.WriteRune(r)
+			i += size - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", errors.New("unterminated string")
+}
+
+// configEscape decodes the TOML escape sequence s starts with and returns its length.
+func configEscape(s string) (rune, int, error) {
+	if len(s) < 2 {
+		return 0, 0, errors.New("unterminated string")
+	}
+	switch s[1] {
+	case 'b':
+		return '\b', 2, nil
+	case 't':
+		return '\t', 2, nil
+	case 'n':
+		return '\n', 2, nil
+	case 'f':
+		return '\f', 2, nil
+	case 'r':
+		return '\r', 2, nil
+	case '"', '\\':
+		return rune(s[1]), 2, nil
+	case 'u', 'U':
+		size := 6
+		if s[1] == 'U' {
+			size = 10
+		}
+		if len(s) >= size {
+			if v, err := strconv.ParseUint(s[2:size], 16, 32); err == nil && utf8.ValidRune(rune(v)) {
+				return rune(v), size, nil
+			}
+		}
+		return 0, 0, fmt.Errorf("invalid escape %s", s[:min(len(s), size)])
+	}
+	return 0, 0, fmt.Errorf("invalid escape %s", s[:2])
+}
+
+// writeConfig prints the effective configuration as a config file, with secrets masked.
+func writeConfig(w io.Writer, c *config) error {
+	section := ""
+	for _, s := range settings {
+		sec, name, _ := strings.Cut(s.key, ".")
+		if sec != section {
+			if section != "" {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "[%s]\n", sec)
+			section = sec
+		}
+		if _, err := fmt.Fprintf(w, "%s = %s\n", name, strconv.Quote(s.display(c))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logAttrs is the effective configuration as log attributes, with secrets masked.
+func (c *config) logAttrs() []any {
+	attrs := make([]any, 0, len(settings))
+	for _, s := range settings {
+		attrs = append(attrs, slog.String(s.key, s.display(c)))
+	}
+	return attrs
+}
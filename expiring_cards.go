@@ -0,0 +1,126 @@
+package main
+
+import (
+	"authnet/authorizenet"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ExpiringCard is a saved card that expires in the reported month, joined to its owner's email.
+type ExpiringCard struct {
+	CustomerProfileID string `json:"customerProfileId"`
+	PaymentProfileID  string `json:"paymentProfileId"`
+	Email             string `json:"email"`
+	CardNumber        string `json:"cardNumber"`
+	CardType          string `json:"cardType,omitempty"`
+	ExpirationMonth   string `json:"expirationMonth"`
+}
+
+type ExpiringCardsReport struct {
+	Month       string         `json:"month"`
+	GeneratedAt time.Time      `json:"generatedAt"`
+	Cards       []ExpiringCard `json:"cards"`
+}
+
+// expiringCardsJob periodically collects the cards expiring this month so customers can be warned.
+type expiringCardsJob struct {
+	client   *authorizenet.APIClient
+	interval time.Duration
+
+	mu     sync.RWMutex
+	report *ExpiringCardsReport
+}
+
+func newExpiringCardsJob(client *authorizenet.APIClient, interval time.Duration) *expiringCardsJob {
+	return &expiringCardsJob{client: client, interval: interval}
+}
+
+// Run builds a report immediately and then once per interval until ctx is done.
+func (j *expiringCardsJob) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		month := time.Now().Format("2006-01")
+		report, err := j.build(month)
+		if err != nil {
+			slog.Error("Expiring cards job failed", "month", month, "error", err)
+		} else {
+			slog.Info("Expiring cards job finished", "month", month, "cards", len(report.Cards))
+			j.mu.Lock()
+			j.report = report
+			j.mu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *expiringCardsJob) Latest() *ExpiringCardsReport {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.report
+}
+
+func (j *expiringCardsJob) build(month string) (*ExpiringCardsReport, error) {
+	const pageSize = 1000
+
+	report := &ExpiringCardsReport{Month: month, GeneratedAt: time.Now()}
+	emails := make(map[string]string)
+	sorting := &authorizenet.Sorting{OrderBy: "id"}
+
+	for page := 1; ; page++ {
+		items, total, err := j.client.GetCardsExpiringInMonth(month, sorting, &authorizenet.Paging{Limit: pageSize, Offset: page})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range items {
+			profileID := strconv.Itoa(item.CustomerProfileId)
+			email, ok := emails[profileID]
+			if !ok {
+				profile, err := j.client.GetCustomerProfile(profileID)
+				if err != nil {
+					slog.Warn("Expiring cards job cannot load profile", "customer_profile_id", profileID, "error", err)
+				} else {
+					email = profile.Email
+				}
+				emails[profileID] = email
+			}
+
+			report.Cards = append(report.Cards, ExpiringCard{
+				CustomerProfileID: profileID,
+				PaymentProfileID:  strconv.Itoa(item.CustomerPaymentProfileId),
+				Email:             email,
+				CardNumber:        item.Payment.CreditCard.CardNumber,
+				CardType:          item.Payment.CreditCard.CardType,
+				ExpirationMonth:   month,
+			})
+		}
+
+		if len(items) < pageSize || page*pageSize >= total {
+			break
+		}
+	}
+
+	return report, nil
+}
+
+func (app *application) getExpiringCardsHandler(w http.ResponseWriter, r *http.Request) {
+	report := app.expiringCards.Latest()
+	if report == nil {
+		http.Error(w, "Expiring cards report has not been generated yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"authnet/authorizenet"
+	"iter"
+	"log/slog"
+	"net/http"
+)
+
+// PaymentGateway is the part of authorizenet.APIClient the HTTP handlers use.
+type PaymentGateway interface {
+	CreateCustomerProfile(profile authorizenet.CustomerProfile, validationMode string) (string, error)
+	GetCustomerProfile(profileID string) (*authorizenet.CustomerProfile, error)
+	GetCustomerProfileBy(lookup authorizenet.ProfileLookup) (*authorizenet.CustomerProfile, error)
+	GetAllCustomerProfileIds() ([]string, error)
+	GetAllCustomerProfilesWithOptions(opts authorizenet.FetchOptions) ([]authorizenet.CustomerProfile, error)
+	GetCustomerProfilesWithOptions(ids []string, opts authorizenet.FetchOptions) ([]authorizenet.CustomerProfile, error)
+	CustomerProfiles(pageSize int) iter.Seq2[*authorizenet.CustomerProfile, error]
+	UpdateCustomerProfile(profileID, email, description string) error
+
+	AddPaymentProfile(profileID string, creditCard authorizenet.CreditCard) (string, error)
+	UpdatePaymentProfile(customerProfileId string, paymentProfile *authorizenet.PaymentProfileUpdate) error
+	UpdateCustomerPaymentProfile(customerPaymentProfileId, customerProfileId string, creditCard authorizenet.CreditCard, billTo authorizenet.ShippingAddress) error
+	UpdateBillingAddress(customerprofileID string, paymentProfileID string, address authorizenet.ShippingAddress) error
+	DeletePaymentProfile(customerProfileId, paymentProfileId string) error
+
+	AddShippingAddress(profileID string, address authorizenet.ShippingAddress) (string, error)
+	DeleteShippingAddress(profileID, addressID string) error
+
+	// A declined transaction returns the gateway's transaction response along with the error.
+	ChargeCustomerProfile(profileID, paymentProfileID, amount, invoiceNumber, transactionType, description string) (*authorizenet.FullTransactionResponse, error)
+	AuthorizeCustomerProfile(profileID, paymentProfileID, amount string) (*authorizenet.FullTransactionResponse, error)
+	CapturePriorAuthTransaction(refTransId, amount string) (*authorizenet.FullTransactionResponse, error)
+	RefundTransaction(refTransId, amount, profileID, paymentProfileID string) (*authorizenet.FullTransactionResponse, error)
+	VoidTransaction(refTransId string) (*authorizenet.FullTransactionResponse, error)
+
+	GetTransactionDetails(transId string) (*authorizenet.TransactionDetails, error)
+	GetTransactionListForCustomer(customerProfileId string, opts authorizenet.TransactionListOptions) ([]authorizenet.TransactionSummary, int, error)
+	SendCustomerTransactionReceipt(transId, customerEmail string, opts authorizenet.ReceiptOptions) error
+	GetMerchantDetails() (*authorizenet.MerchantDetails, error)
+}
+
+// gateway returns the payment gateway for this request. The real client is bound to the
+// request's logger so its lines carry the request's correlation fields.
+func (app *application) gateway(r *http.Request) PaymentGateway {
+	if c, ok := app.client.(interface {
+		WithLogger(*slog.Logger) *authorizenet.APIClient
+	}); ok {
+		return c.WithLogger(requestLogger(r))
+	}
+	return app.client
+}
@@ -3,13 +3,13 @@ module authnet
 go 1.23.2
 
 require (
+	github.com/gorilla/handlers v1.5.2
 	github.com/gorilla/mux v1.8.1
 	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.10.9
 )
 
 require (
 	github.com/corazawaf/coraza/v3 v3.3.3 // indirect
 	github.com/felixge/httpsnoop v1.0.3 // indirect
-	github.com/gorilla/handlers v1.5.2 // indirect
-	github.com/lib/pq v1.10.9 // indirect
 )
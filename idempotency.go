@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// IdempotencyRecord is a request already made with an Idempotency-Key. StatusCode is zero
+// while the original request is still being processed.
+type IdempotencyRecord struct {
+	Fingerprint string
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyStore remembers the outcome of requests made with an Idempotency-Key. Keys are
+// scoped to the caller, so two callers can never see each other's responses.
+type IdempotencyStore interface {
+	// Begin claims key for a new request and returns nil. If the key is already claimed
+	// and has not expired, it returns the existing record instead.
+	Begin(caller, key, fingerprint string, expiresAt time.Time) (*IdempotencyRecord, error)
+	// Complete stores the response to replay for the rest of the window.
+	Complete(caller, key string, statusCode int, contentType string, body []byte) error
+	// Release forgets a claimed key so the request can be retried with it.
+	Release(caller, key string) error
+}
+
+type postgresIdempotencyStore struct {
+	db *sql.DB
+}
+
+func (s *postgresIdempotencyStore) Begin(caller, key, fingerprint string, expiresAt time.Time) (*IdempotencyRecord, error) {
+	// The existing row may expire or be released between the two statements; try again.
+	for attempt := 0; attempt < 3; attempt++ {
+		var claimed bool
+		err := s.db.QueryRow(`
+			INSERT INTO idempotency_keys (caller, key, fingerprint, expires_at)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (caller, key) DO UPDATE SET
+				fingerprint = EXCLUDED.fingerprint,
+				status_code = NULL,
+				content_type = '',
+				response_body = NULL,
+				created_at = now(),
+				completed_at = NULL,
+				expires_at = EXCLUDED.expires_at
+			WHERE idempotency_keys.expires_at < now()
+			RETURNING true`, caller, key, fingerprint, expiresAt).Scan(&claimed)
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+
+		var rec IdempotencyRecord
+		var statusCode sql.NullInt64
+		err = s.db.QueryRow(`
+			SELECT fingerprint, status_code, content_type, response_body
+			FROM idempotency_keys
+			WHERE caller = $1 AND key = $2 AND expires_at >= now()`, caller, key).
+			Scan(&rec.Fingerprint, &statusCode, &rec.ContentType, &rec.Body)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rec.StatusCode = int(statusCode.Int64)
+		return &rec, nil
+	}
+	return nil, errors.New("idempotency key changed state repeatedly, giving up")
+}
+
+func (s *postgresIdempotencyStore) Complete(caller, key string, statusCode int, contentType string, body []byte) error {
+	_, err := s.db.Exec(`
+		UPDATE idempotency_keys
+		SET status_code = $3, content_type = $4, response_body = $5, completed_at = now()
+		WHERE caller = $1 AND key = $2`, caller, key, statusCode, contentType, body)
+	return err
+}
+
+func (s *postgresIdempotencyStore) Release(caller, key string) error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE caller = $1 AND key = $2`, caller, key)
+	return err
+}
+
+// PurgeExpired deletes keys whose window has passed.
+func (s *postgresIdempotencyStore) PurgeExpired() (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at < now()`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// runPurge deletes expired keys once per interval until ctx is done.
+func (s *postgresIdempotencyStore) runPurge(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := s.PurgeExpired()
+		if err != nil {
+			slog.Error("Idempotency key purge failed", "error", err)
+			continue
+		}
+		if n > 0 {
+			slog.Info("Purged expired idempotency keys", "keys", n)
+		}
+	}
+}
+
+// requestFingerprint identifies what was asked for, so a reused key with a different
+// request can be told apart from a retry.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseCapture passes a response through while keeping a copy for the idempotency store.
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// maxIdempotencyKeyLen bounds the Idempotency-Key header; callers normally send a UUID.
+const maxIdempotencyKeyLen = 255
+
+// idempotent makes a money-moving handler safe to retry. A request carrying an
+// Idempotency-Key runs once per caller and key within the configured window; retries get
+// the original response back with Idempotent-Replayed: true. Reusing a key for a different
+// request is rejected with 422, and a retry while the original is still running gets 409.
+//
+// Client errors (4xx) are not remembered because nothing reached the gateway; the key can
+// be used again. Server errors are remembered, since the gateway may have acted.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			http.Error(w, "Idempotency-Key must be at most 255 characters", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Cannot read request body", http.StatusInternalServerError)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		caller := ""
+		if c := requestCaller(r); c != nil {
+			caller = c.Name
+		}
+		annotate(r, slog.String("idempotency_key", key))
+		logger := requestLogger(r)
+
+		fingerprint := requestFingerprint(r, body)
+		existing, err := app.idempotency.Begin(caller, key, fingerprint, time.Now().Add(app.config.IdempotencyWindow))
+		if err != nil {
+			logger.Error("Idempotency key lookup failed", "error", err)
+			http.Error(w, "Cannot check Idempotency-Key", http.StatusInternalServerError)
+			return
+		}
+
+		switch {
+		case existing == nil:
+			// Claimed; run the request below.
+		case existing.Fingerprint != fingerprint:
+			logger.Warn("Idempotency key reused for a different request")
+			http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+			return
+		case existing.StatusCode == 0:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+			return
+		default:
+			logger.Info("Replaying idempotent response", "status", existing.StatusCode)
+			if existing.ContentType != "" {
+				w.Header().Set("Content-Type", existing.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(existing.StatusCode)
+			w.Write(existing.Body)
+			return
+		}
+
+		capture := &responseCapture{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// The handler panicked, possibly after the gateway acted. Remember a server error
+			// so a retry can't charge again, then let the panic carry on.
+			body := []byte(http.StatusText(http.StatusInternalServerError) + "\n")
+			if err := app.idempotency.Complete(caller, key, http.StatusInternalServerError, "text/plain; charset=utf-8", body); err != nil {
+				logger.Error("Failed to store idempotent response", "error", err, "status", http.StatusInternalServerError)
+			}
+			panic(p)
+		}()
+
+		next(capture, r)
+
+		if capture.status >= 400 && capture.status < 500 {
+			if err := app.idempotency.Release(caller, key); err != nil {
+				logger.Error("Failed to release idempotency key", "error", err)
+			}
+			return
+		}
+		if capture.status == 0 {
+			capture.status = http.StatusOK
+		}
+		if err := app.idempotency.Complete(caller, key, capture.status, capture.Header().Get("Content-Type"), capture.body.Bytes()); err != nil {
+			logger.Error("Failed to store idempotent response", "error", err, "status", capture.status)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"authnet/authorizenet"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Ledger operations, one per kind of gateway transaction.
+const (
+	ledgerAuth    = "auth"
+	ledgerCharge  = "charge"
+	ledgerCapture = "capture"
+	ledgerRefund  = "refund"
+	ledgerVoid    = "void"
+)
+
+var ledgerOperations = []string{ledgerAuth, ledgerCharge, ledgerCapture, ledgerRefund, ledgerVoid}
+
+// LedgerEntry is one gateway transaction attempt, successful or not. The ledger is the
+// source of truth for reporting on money moved through the portal.
+type LedgerEntry struct {
+	ID                int64     `json:"id"`
+	CreatedAt         time.Time `json:"createdAt"`
+	Operation         string    `json:"operation"`
+	RequestID         string    `json:"requestId,omitempty"`
+	Caller            string    `json:"caller,omitempty"`
+	CustomerProfileId string    `json:"customerProfileId,omitempty"`
+	PaymentProfileId  string    `json:"paymentProfileId,omitempty"`
+	InvoiceNumber     string    `json:"invoiceNumber,omitempty"`
+	Amount            string    `json:"amount,omitempty"`
+	TransId           string    `json:"transId,omitempty"`
+	RefTransId        string    `json:"refTransId,omitempty"`
+	ResponseCode      string    `json:"responseCode,omitempty"`
+	AuthCode          string    `json:"authCode,omitempty"`
+	AvsResultCode     string    `json:"avsResultCode,omitempty"`
+	CvvResultCode     string    `json:"cvvResultCode,omitempty"`
+	Success           bool      `json:"success"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// LedgerQuery selects ledger entries. Empty fields and zero times do not filter. TransId
+// matches entries for the transaction itself and entries referencing it.
+type LedgerQuery struct {
+	Operation         string
+	TransId           string
+	InvoiceNumber     string
+	CustomerProfileId string
+	From, To          time.Time
+	Limit, Offset     int
+}
+
+// LedgerSummary totals one operation over a period. Amount sums successful entries only.
+type LedgerSummary struct {
+	Operation string `json:"operation"`
+	Count     int    `json:"count"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+	Amount    string `json:"amount"`
+}
+
+type LedgerStore interface {
+	Record(e LedgerEntry) error
+	// Original returns the successful auth or charge that created transId, or nil.
+	Original(transId string) (*LedgerEntry, error)
+	Query(q LedgerQuery) ([]LedgerEntry, int, error)
+	Summary(from, to time.Time) ([]LedgerSummary, error)
+}
+
+type postgresLedgerStore struct {
+	db *sql.DB
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// ledgerAmount converts an amount for the NUMERIC column. Amounts the gateway would not
+// accept are stored as NULL rather than losing the entry.
+func ledgerAmount(amount string) sql.NullString {
+	if _, err := strconv.ParseFloat(amount, 64); err != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: amount, Valid: true}
+}
+
+func (s *postgresLedgerStore) Record(e LedgerEntry) error {
+	_, err := s.db.Exec(`
+		INSERT INTO gateway_ledger (
+			operation, request_id, caller, customer_profile_id, payment_profile_id, invoice_number,
+			amount, trans_id, ref_trans_id, response_code, auth_code, avs_result_code,
+			cvv_result_code, success, error
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+		e.Operation, e.RequestID, e.Caller, e.CustomerProfileId, e.PaymentProfileId, e.InvoiceNumber,
+		ledgerAmount(e.Amount), e.TransId, e.RefTransId, e.ResponseCode, e.AuthCode, e.AvsResultCode,
+		e.CvvResultCode, e.Success, e.Error)
+	return err
+}
+
+const ledgerColumns = `
+	id, created_at, operation, request_id, caller, customer_profile_id, payment_profile_id,
+	invoice_number, COALESCE(amount::text, ''), trans_id, ref_trans_id, response_code, auth_code,
+	avs_result_code, cvv_result_code, success, error`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanLedgerEntry(row rowScanner) (LedgerEntry, error) {
+	var e LedgerEntry
+	err := row.Scan(&e.ID, &e.CreatedAt, &e.Operation, &e.RequestID, &e.Caller, &e.CustomerProfileId,
+		&e.PaymentProfileId, &e.InvoiceNumber, &e.Amount, &e.TransId, &e.RefTransId, &e.ResponseCode,
+		&e.AuthCode, &e.AvsResultCode, &e.CvvResultCode, &e.Success, &e.Error)
+	return e, err
+}
+
+func (s *postgresLedgerStore) Original(transId string) (*LedgerEntry, error) {
+	row := s.db.QueryRow(`SELECT `+ledgerColumns+`
+		FROM gateway_ledger
+		WHERE trans_id = $1 AND operation IN ('auth', 'charge') AND success
+		ORDER BY id
+		LIMIT 1`, transId)
+	e, err := scanLedgerEntry(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// ledgerFilter is the WHERE clause shared by the count and page queries.
+const ledgerFilter = `
+	($1::text = '' OR operation = $1::text)
+	AND ($2::text = '' OR trans_id = $2::text OR ref_trans_id = $2::text)
+	AND ($3::text = '' OR invoice_number = $3::text)
+	AND ($4::text = '' OR customer_profile_id = $4::text)
+	AND ($5::timestamptz IS NULL OR created_at >= $5::timestamptz)
+	AND ($6::timestamptz IS NULL OR created_at < $6::timestamptz)`
+
+func (s *postgresLedgerStore) Query(q LedgerQuery) ([]LedgerEntry, int, error) {
+	args := []any{q.Operation, q.TransId, q.InvoiceNumber, q.CustomerProfileId, nullTime(q.From), nullTime(q.To)}
+
+	var total int
+	if err := s.db.QueryRow(`SELECT count(*) FROM gateway_ledger WHERE`+ledgerFilter, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`SELECT `+ledgerColumns+`
+		FROM gateway_ledger
+		WHERE`+ledgerFilter+`
+		ORDER BY id DESC
+		LIMIT $7 OFFSET $8`, append(args, q.Limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		e, err := scanLedgerEntry(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
+
+func (s *postgresLedgerStore) Summary(from, to time.Time) ([]LedgerSummary, error) {
+	rows, err := s.db.Query(`
+		SELECT operation,
+			count(*),
+			count(*) FILTER (WHERE success),
+			COALESCE(sum(amount) FILTER (WHERE success), 0)::numeric(14, 2)::text
+		FROM gateway_ledger
+		WHERE ($1::timestamptz IS NULL OR created_at >= $1::timestamptz)
+			AND ($2::timestamptz IS NULL OR created_at < $2::timestamptz)
+		GROUP BY operation
+		ORDER BY operation`, nullTime(from), nullTime(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []LedgerSummary{}
+	for rows.Next() {
+		var sum LedgerSummary
+		if err := rows.Scan(&sum.Operation, &sum.Count, &sum.Succeeded, &sum.Amount); err != nil {
+			return nil, err
+		}
+		sum.Failed = sum.Count - sum.Succeeded
+		summaries = append(summaries, sum)
+	}
+	return summaries, rows.Err()
+}
+
+// recordLedger writes the outcome of a gateway call to the ledger. Captures, refunds and
+// voids inherit the invoice and profile of the transaction they reference when the caller
+// did not send them, and a capture without an amount is recorded at the authorized amount.
+// A failed write is logged, never returned: the money has already moved.
+func (app *application) recordLedger(r *http.Request, e LedgerEntry, resp *authorizenet.FullTransactionResponse, gatewayErr error) {
+	logger := requestLogger(r)
+
+	e.RequestID = requestID(r)
+	if c := requestCaller(r); c != nil {
+		e.Caller = c.Name
+	}
+	if resp != nil {
+		e.TransId = resp.TransId
+		e.ResponseCode = resp.ResponseCode
+		e.AuthCode = resp.AuthCode
+		e.AvsResultCode = resp.AvsResultCode
+		e.CvvResultCode = resp.CvvResultCode
+	}
+	e.Success = gatewayErr == nil
+	if gatewayErr != nil {
+		e.Error = gatewayErr.Error()
+	}
+
+	fullCapture := e.Operation == ledgerCapture && e.Amount == ""
+	if e.RefTransId != "" && (e.InvoiceNumber == "" || e.CustomerProfileId == "" || fullCapture) {
+		original, err := app.ledger.Original(e.RefTransId)
+		if err != nil {
+			logger.Warn("Ledger lookup of original transaction failed", "ref_trans_id", e.RefTransId, "error", err)
+		} else if original != nil {
+			if e.InvoiceNumber == "" {
+				e.InvoiceNumber = original.InvoiceNumber
+			}
+			if e.CustomerProfileId == "" {
+				e.CustomerProfileId = original.CustomerProfileId
+				e.PaymentProfileId = original.PaymentProfileId
+			}
+			if fullCapture {
+				e.Amount = original.Amount
+			}
+		}
+	}
+
+	if err := app.ledger.Record(e); err != nil {
+		logger.Error("Ledger write failed",
+			"error", err,
+			"operation", e.Operation,
+			"trans_id", e.TransId,
+			"ref_trans_id", e.RefTransId,
+			"amount", e.Amount,
+			"success", e.Success,
+		)
+	}
+}
+
+// parseLedgerTime accepts RFC 3339 timestamps or plain dates.
+func parseLedgerTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+func parseLedgerRange(values url.Values) (from, to time.Time, err error) {
+	if v := values.Get("from"); v != "" {
+		if from, err = parseLedgerTime(v); err != nil {
+			return from, to, errors.New("from must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if to, err = parseLedgerTime(v); err != nil {
+			return from, to, errors.New("to must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+		}
+	}
+	return from, to, nil
+}
+
+type LedgerResponse struct {
+	Entries []LedgerEntry `json:"entries"`
+	Total   int           `json:"total"`
+	Limit   int           `json:"limit"`
+	Offset  int           `json:"offset"`
+}
+
+// getLedgerHandler serves GET /ledger. Filters: operation, transId, invoiceNumber,
+// customerProfileId, from, to (to is exclusive); paging with limit and offset. Newest first.
+func (app *application) getLedgerHandler(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	q := LedgerQuery{
+		Operation:         values.Get("operation"),
+		TransId:           values.Get("transId"),
+		InvoiceNumber:     values.Get("invoiceNumber"),
+		CustomerProfileId: values.Get("customerProfileId"),
+		Limit:             100,
+	}
+	if q.Operation != "" && !slices.Contains(ledgerOperations, q.Operation) {
+		http.Error(w, "operation must be one of auth, charge, capture, refund, void", http.StatusBadRequest)
+		return
+	}
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		q.Limit = limit
+	}
+	if v := values.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			http.Error(w, "offset must be zero or a positive integer", http.StatusBadRequest)
+			return
+		}
+		q.Offset = offset
+	}
+	var err error
+	if q.From, q.To, err = parseLedgerRange(values); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, total, err := app.ledger.Query(q)
+	if err != nil {
+		requestLogger(r).Error("Ledger query failed", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LedgerResponse{Entries: entries, Total: total, Limit: q.Limit, Offset: q.Offset})
+}
+
+// getLedgerSummaryHandler serves GET /ledger/summary?from=...&to=..., totals per operation.
+func (app *application) getLedgerSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseLedgerRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	summaries, err := app.ledger.Summary(from, to)
+	if err != nil {
+		requestLogger(r).Error("Ledger summary failed", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
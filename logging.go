@@ -0,0 +1,196 @@
+package main
+
+import (
+	"authnet/authorizenet"
+	"authnet/redact"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// newLogger builds the process logger. format is "json" or "text"; level is one of
+// debug, info, warn or error. Every attribute passes through redact.ReplaceAttr.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level == "" {
+		level = "info"
+	}
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redact.ReplaceAttr}
+	switch strings.ToLower(format) {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q, expected json or text", format)
+}
+
+type contextKey int
+
+const (
+	requestLogKey contextKey = iota
+	callerKey
+)
+
+// requestLog is the per-request logging state. Handlers add attributes to it as they learn
+// them (transId, gateway response code) so the completion line carries everything.
+type requestLog struct {
+	id     string
+	mu     sync.Mutex
+	logger *slog.Logger
+}
+
+// requestLogger returns the logger for this request, already carrying request_id, route and
+// customer_profile_id. Outside of a request it returns the default logger.
+func requestLogger(r *http.Request) *slog.Logger {
+	if rl, ok := r.Context().Value(requestLogKey).(*requestLog); ok {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		return rl.logger
+	}
+	return slog.Default()
+}
+
+// requestID returns the ID logRequests assigned to this request, or "" outside of one.
+func requestID(r *http.Request) string {
+	if rl, ok := r.Context().Value(requestLogKey).(*requestLog); ok {
+		return rl.id
+	}
+	return ""
+}
+
+// annotate adds attributes to this request's logger and to its completion line.
+func annotate(r *http.Request, attrs ...slog.Attr) {
+	rl, ok := r.Context().Value(requestLogKey).(*requestLog)
+	if !ok {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	args := make([]any, len(attrs))
+	for i, a := range attrs {
+		args[i] = a
+	}
+	rl.logger = rl.logger.With(args...)
+}
+
+// annotateTransaction records the gateway outcome of a transaction on the request log.
+func annotateTransaction(r *http.Request, resp *authorizenet.FullTransactionResponse) {
+	if resp == nil {
+		return
+	}
+	annotate(r,
+		slog.String("trans_id", resp.TransId),
+		slog.String("response_code", resp.ResponseCode),
+	)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to move write deadlines.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// logRequests is router middleware that assigns a request ID, attaches a correlated logger to
+// the request context and logs one line when the request completes.
+func (app *application) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		args := []any{
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("route", route),
+		}
+		vars := mux.Vars(r)
+		for _, key := range []string{"id", "customerProfileId"} {
+			if id := vars[key]; id != "" && strings.HasPrefix(route, "/customer-profiles") {
+				args = append(args, slog.String("customer_profile_id", id))
+				break
+			}
+		}
+
+		rl := &requestLog{id: id, logger: app.logger.With(args...)}
+		ctx := context.WithValue(r.Context(), requestLogKey, rl)
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		} else if status >= 400 {
+			level = slog.LevelWarn
+		}
+
+		rl.mu.Lock()
+		logger := rl.logger
+		rl.mu.Unlock()
+		logger.LogAttrs(ctx, level, "request completed",
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(started)),
+		)
+	})
+}
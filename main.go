@@ -2,12 +2,23 @@ package main
 
 import (
 	"authnet/authorizenet"
+	"authnet/orders"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/handlers"
 	_ "github.com/gorilla/handlers"
@@ -20,102 +31,221 @@ import (
 	_ "github.com/lib/pq"
 )
 
-type authNetConfig struct {
-	Endpoint       string
-	ValidationMode string
-	LoginID        string
-	TransactionKey string
-}
-
-type config struct {
-	AuthNet authNetConfig
-}
-
 type application struct {
 	config *config
-	client *authorizenet.APIClient
-	db     *sql.DB
+	client PaymentGateway
+	orders orders.Repository
+	outbox OrderOutbox
+	// apiKeys authenticates callers; see authenticate and requireScope.
+	apiKeys     APIKeyStore
+	idempotency IdempotencyStore
+	ledger      LedgerStore
+	db          *sql.DB
+	logger      *slog.Logger
+
+	expiringCards *expiringCardsJob
+	profiles      ProfileMirror
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
 func main() {
-	err := godotenv.Load()
+	envErr := godotenv.Load()
+
+	cfg, args, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Println("Error loading .env file", err)
+		fatal("Invalid configuration", "error", err)
 	}
-
-	cfg := &config{}
-	cfg.AuthNet.LoginID = os.Getenv("AUTHORIZENET_NAME")
-	cfg.AuthNet.TransactionKey = os.Getenv("AUTHORIZENET_TRANSACTION_KEY")
-
-	if cfg.AuthNet.LoginID == "" || cfg.AuthNet.TransactionKey == "" {
-		log.Fatal("Missing login-id or transaction-key")
+	if len(args) > 0 && args[0] == "config" {
+		if err := writeConfig(os.Stdout, cfg); err != nil {
+			fatal("config failed", "error", err)
+		}
+		return
 	}
 
-	authnetEnv := os.Getenv("AUTHORIZENET_ENVIRONMENT")
-	log.Printf("Main: authnetEnv: %s", authnetEnv)
-	if authnetEnv == "production" {
-		cfg.AuthNet.ValidationMode = "liveMode"
-		cfg.AuthNet.Endpoint = authorizenet.ProductionEndpoint
-	} else {
-		cfg.AuthNet.ValidationMode = "testMode"
-		cfg.AuthNet.Endpoint = authorizenet.SandboxEndpoint
+	logger, err := newLogger(os.Stderr, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
 	}
+	slog.SetDefault(logger)
 
-	db_dsn := os.Getenv("DB_DSN")
-	if db_dsn == "" {
-		log.Fatal("Missing DB_DSN")
+	if envErr != nil {
+		logger.Warn("Error loading .env file", "error", envErr)
 	}
+	logger.Info("Effective configuration", cfg.logAttrs()...)
 
-	db, err := sql.Open("postgres", db_dsn)
+	db, err := sql.Open("postgres", cfg.DatabaseDSN)
 	if err != nil {
-		log.Fatalf("Cannot connect to database: %v", err)
+		fatal("Cannot connect to database", "error", err)
 	}
 	defer db.Close()
 
-	log.Println("Database connected")
+	logger.Info("Database connected")
 
 	client := authorizenet.NewAPIClient(
 		cfg.AuthNet.LoginID,
 		cfg.AuthNet.TransactionKey,
 		cfg.AuthNet.Endpoint,
 	)
+	client.Logger = logger
 
 	app := &application{
-		config: cfg,
-		client: client,
-		db:     db,
+		config:  cfg,
+		client:  client,
+		orders:  orders.NewPostgres(db),
+		outbox:  &postgresOrderOutbox{db: db},
+		apiKeys: &postgresAPIKeyStore{db: db},
+		ledger:  &postgresLedgerStore{db: db},
+		db:      db,
+		logger:  logger,
+
+		expiringCards: newExpiringCardsJob(client, 24*time.Hour),
+		profiles:      &postgresProfileMirror{db: db},
 	}
 
-	r := mux.NewRouter()
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrateCommand(db, args[1:]); err != nil {
+			fatal("migrate failed", "error", err)
+		}
+		return
+	}
+	if err := checkSchema(db); err != nil {
+		fatal("Refusing to start", "error", err)
+	}
 
-	allowedOrigins := handlers.AllowedOrigins([]string{"https://www.handbellworld.com"})
-	allowedMethods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
-	allowedHeaders := handlers.AllowedHeaders([]string{"Content-Type", "Authorization"})
-	corsHandler := handlers.CORS(allowedOrigins, allowedMethods, allowedHeaders)(r)
+	if len(args) > 0 {
+		switch args[0] {
+		case "au-report":
+			if err := cfg.requireGateway(); err != nil {
+				fatal("Invalid configuration", "error", err)
+			}
+			if err := runAUReport(client, db, args[1:]); err != nil {
+				fatal("au-report failed", "error", err)
+			}
+			return
+		case "apikey":
+			if err := runAPIKeyCommand(db, args[1:]); err != nil {
+				fatal("apikey failed", "error", err)
+			}
+			return
+		default:
+			fatal("Unknown command", "command", args[0])
+		}
+	}
 
-	r.HandleFunc("/customer-profiles", app.createCustomerProfileHandler).Methods("POST")
-	r.HandleFunc("/customer-profiles/{id}", app.getCustomerProfileHandler).Methods("GET")
-	r.HandleFunc("/customer-profiles", app.getAllCustomerProfilesHandler).Methods("GET")
+	if err := cfg.requireGateway(); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
 
-	r.HandleFunc("/customer-profiles/{id}", app.updateCustomerProfileHandler).Methods("PUT")
-	r.HandleFunc("/customer-profiles/{id}/shipping-addresses", app.addShippingAddressHandler).Methods("POST")
-	r.HandleFunc("/customer-profiles/{id}/shipping-addresses/{addressId}", app.deleteShippingAddressHandler).Methods("DELETE")
-	r.HandleFunc("/customer-profiles/{id}/payment-profiles", app.addPaymentProfileHandler).Methods("POST")
-	r.HandleFunc("/customer-profiles/{id}/payment-profiles/{paymentProfileId}", app.updateBillingAddressHandler).Methods("PUT")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Background jobs stop with ctx; main waits for them before closing the database.
+	var workers sync.WaitGroup
+	runWorker := func(run func(context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run(ctx)
+		}()
+	}
 
-	r.HandleFunc("/customer-profiles/{customerProfileId}/payment-profiles/{paymentProfileId}", app.updateCustomerPaymentProfileHandler).Methods("PUT")
-	r.HandleFunc("/customer-profiles/{customerProfileId}/payment-profiles/{paymentProfileId}", app.deletePaymentProfileHandler).Methods("DELETE")
+	idempotency := &postgresIdempotencyStore{db: db}
+	app.idempotency = idempotency
+	runWorker(app.expiringCards.Run)
+	runWorker(func(ctx context.Context) { idempotency.runPurge(ctx, time.Hour) })
+	runWorker(newProfileSyncJob(client, app.profiles, cfg.ProfileFetch, cfg.ProfileSyncInterval).Run)
+	runWorker(func(ctx context.Context) { app.runOrderOutbox(ctx, 30*time.Second) })
 
-	r.HandleFunc("/update-payment-profile", app.updatePaymentProfileHandler).Methods("PUT")
+	tlsConfig, err := cfg.ClientCerts.serverTLSConfig()
+	if err != nil {
+		fatal("Cannot set up client certificate verification", "error", err)
+	}
+	srv := newServer(cfg, app.routes(), tlsConfig)
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		fatal("Cannot listen", "addr", srv.Addr, "error", err)
+	}
 
-	r.HandleFunc("/transactions", app.chargeCustomerProfileHandler).Methods("POST")
-	r.HandleFunc("/transactions/authorize", app.authorizeCustomerProfileHandler).Methods("POST")
-	r.HandleFunc("/transactions/capture", app.capturePriorAuthTransactionHandler).Methods("POST")
+	logger.Info("Server starting", "addr", srv.Addr, "mtls", tlsConfig != nil, "client_cert_required", cfg.ClientCerts.Require)
+	if err := serve(ctx, srv, ln, cfg.TLSCertFile, cfg.TLSKeyFile, cfg.ShutdownTimeout); err != nil {
+		if ctx.Err() == nil {
+			fatal("Server stopped", "error", err)
+		}
+		logger.Error("Requests still running at the shutdown deadline were cut off", "error", err)
+	}
+	stop()
+
+	// A job in the middle of a gateway call can't be interrupted; don't let one hold up
+	// the exit for longer than requests were given.
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(cfg.ShutdownTimeout):
+		logger.Warn("Background jobs still running at shutdown")
+	}
 
-	log.Println("Server starting on :1337")
-	if err := http.ListenAndServeTLS(":1337", "cert.pem", "key.pem", corsHandler); err != nil {
-		log.Fatal(err)
+	if err := db.Close(); err != nil {
+		logger.Error("Cannot close database", "error", err)
 	}
+	logger.Info("Server stopped")
+}
+
+// routes builds the router with every endpoint, wrapped in the CORS policy. Every route
+// needs an API key; requireScope decides which keys may use it.
+func (app *application) routes() http.Handler {
+	r := mux.NewRouter()
+	r.Use(app.logRequests)
+	r.Use(app.authenticate)
+
+	allowedOrigins := handlers.AllowedOrigins(app.config.CORSOrigins)
+	allowedMethods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
+	allowedHeaders := handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "Idempotency-Key"})
+	corsHandler := handlers.CORS(allowedOrigins, allowedMethods, allowedHeaders)(r)
+
+	r.HandleFunc("/customer-profiles", app.requireScope(scopeProfilesWrite, app.createCustomerProfileHandler)).Methods("POST")
+	r.HandleFunc("/customer-profiles/{id}", app.requireScope(scopeProfilesRead, app.getCustomerProfileHandler)).Methods("GET")
+	r.HandleFunc("/customer-profiles", app.requireScope(scopeProfilesRead, app.getAllCustomerProfilesHandler)).Methods("GET")
+
+	r.HandleFunc("/customer-profiles/{id}", app.requireScope(scopeProfilesWrite, app.updateCustomerProfileHandler)).Methods("PUT")
+	r.HandleFunc("/customer-profiles/{id}/shipping-addresses", app.requireScope(scopeProfilesWrite, app.addShippingAddressHandler)).Methods("POST")
+	r.HandleFunc("/customer-profiles/{id}/shipping-addresses/{addressId}", app.requireScope(scopeProfilesWrite, app.deleteShippingAddressHandler)).Methods("DELETE")
+	r.HandleFunc("/customer-profiles/{id}/payment-profiles", app.requireScope(scopeProfilesWrite, app.addPaymentProfileHandler)).Methods("POST")
+	r.HandleFunc("/customer-profiles/{id}/transactions", app.requireScope(scopeProfilesRead, app.getCustomerTransactionsHandler)).Methods("GET")
+	r.HandleFunc("/customer-profiles/{id}/payment-profiles/{paymentProfileId}", app.requireScope(scopeProfilesWrite, app.updateBillingAddressHandler)).Methods("PUT")
+
+	r.HandleFunc("/customer-profiles/{customerProfileId}/payment-profiles/{paymentProfileId}", app.requireScope(scopeProfilesWrite, app.updateCustomerPaymentProfileHandler)).Methods("PUT")
+	r.HandleFunc("/customer-profiles/{customerProfileId}/payment-profiles/{paymentProfileId}", app.requireScope(scopeProfilesWrite, app.deletePaymentProfileHandler)).Methods("DELETE")
+
+	r.HandleFunc("/update-payment-profile", app.requireScope(scopeProfilesWrite, app.updatePaymentProfileHandler)).Methods("PUT")
+
+	r.HandleFunc("/transactions", app.requireScope(scopeCharge, app.idempotent(app.chargeCustomerProfileHandler))).Methods("POST")
+	r.HandleFunc("/transactions/authorize", app.requireScope(scopeCharge, app.idempotent(app.authorizeCustomerProfileHandler))).Methods("POST")
+	r.HandleFunc("/transactions/capture", app.requireScope(scopeCapture, app.idempotent(app.capturePriorAuthTransactionHandler))).Methods("POST")
+	r.HandleFunc("/transactions/refund", app.requireScope(scopeRefund, app.idempotent(app.refundTransactionHandler))).Methods("POST")
+	r.HandleFunc("/transactions/void", app.requireScope(scopeRefund, app.idempotent(app.voidTransactionHandler))).Methods("POST")
+	r.HandleFunc("/transactions/{id}/receipt", app.requireScope(scopeCharge, app.sendTransactionReceiptHandler)).Methods("POST")
+
+	r.HandleFunc("/merchant", app.requireScope(scopeAdmin, app.getMerchantDetailsHandler)).Methods("GET")
+	r.HandleFunc("/ledger", app.requireScope(scopeAdmin, app.getLedgerHandler)).Methods("GET")
+	r.HandleFunc("/ledger/summary", app.requireScope(scopeAdmin, app.getLedgerSummaryHandler)).Methods("GET")
+	r.HandleFunc("/orders", app.requireScope(scopeAdmin, app.getOrderHandler)).Methods("GET")
+	r.HandleFunc("/order-outbox", app.requireScope(scopeAdmin, app.getOrderOutboxHandler)).Methods("GET")
+	r.HandleFunc("/order-outbox/{id}/retry", app.requireScope(scopeAdmin, app.retryOrderUpdateHandler)).Methods("POST")
+	r.HandleFunc("/payment-profiles/expiring", app.requireScope(scopeAdmin, app.getExpiringCardsHandler)).Methods("GET")
+
+	return corsHandler
 }
 
 type ApiResponse struct {
@@ -144,6 +274,38 @@ type CaptureRequest struct {
 	Amount     string `json:"amount,omitempty"`
 }
 
+type RefundRequest struct {
+	RefTransId       string `json:"refTransId"`
+	Amount           string `json:"amount"`
+	ProfileID        string `json:"profileId,omitempty"`
+	PaymentProfileID string `json:"paymentProfileId,omitempty"`
+	InvoiceNumber    string `json:"invoiceNumber,omitempty"`
+}
+
+type VoidRequest struct {
+	RefTransId    string `json:"refTransId"`
+	InvoiceNumber string `json:"invoiceNumber,omitempty"`
+}
+
+type CustomerTransaction struct {
+	authorizenet.TransactionSummary
+	OrderInvoiceNumber string `json:"orderInvoiceNumber,omitempty"`
+}
+
+type CustomerTransactionsResponse struct {
+	Transactions []CustomerTransaction `json:"transactions"`
+	Total        int                   `json:"total"`
+	Limit        int                   `json:"limit"`
+	Offset       int                   `json:"offset"`
+}
+
+type ReceiptRequest struct {
+	Email             string `json:"email,omitempty"`
+	CustomerProfileID string `json:"customerProfileId,omitempty"`
+	Header            string `json:"header,omitempty"`
+	Footer            string `json:"footer,omitempty"`
+}
+
 type UpdateProfileRequest struct {
 	Email       string `json:"email"`
 	Description string `json:"description"`
@@ -162,7 +324,7 @@ type UpdateBillingAddressRequest struct {
 }
 
 func (app *application) createCustomerProfileHandler(w http.ResponseWriter, r *http.Request) {
-	log.Print("Create New Customer Profile Handler")
+	logger := requestLogger(r)
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Cannot read request body", http.StatusInternalServerError)
@@ -174,32 +336,29 @@ func (app *application) createCustomerProfileHandler(w http.ResponseWriter, r *h
 	bodyStr = strings.Replace(bodyStr, "\\'", "'", -1)
 	body = []byte(bodyStr)
 
-	// log.Printf("Sanitized JSON payload: %s", string(body)) // Log for verification
+	logger.Debug("Sanitized JSON payload", "body", body)
 
 	var req CreateProfileRequest
 
 	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
-		log.Printf("--> JSON decoding error: %v", err)
+		logger.Warn("JSON decoding error", "error", err)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// log.Printf("Successfully decoded request.")
-
 	validationMode := app.config.AuthNet.ValidationMode
 	if req.ValidationMode != "" {
 		validationMode = req.ValidationMode
 	}
 
-	// log.Printf("Create Customer Profile: ValidationMode %s", validationMode)
-
-	profileID, err := app.client.CreateCustomerProfile(req.Profile, validationMode)
+	profileID, err := app.gateway(r).CreateCustomerProfile(req.Profile, validationMode)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Successfully created profile. Returning ID: %s to client.", profileID)
+	logger.Info("Created customer profile", "customer_profile_id", profileID)
+	app.mirrorProfile(r, profileID)
 
 	response := map[string]string{"customerProfileId": profileID}
 	w.Header().Set("Content-Type", "application/json")
@@ -208,7 +367,6 @@ func (app *application) createCustomerProfileHandler(w http.ResponseWriter, r *h
 }
 
 func (app *application) getCustomerProfileHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Get Customer Handler")
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
 	if !ok {
@@ -217,7 +375,7 @@ func (app *application) getCustomerProfileHandler(w http.ResponseWriter, r *http
 	}
 
 	// The 'profile' variable is now the *CustomerProfile object you want
-	profile, err := app.client.GetCustomerProfile(id)
+	profile, err := app.gateway(r).GetCustomerProfile(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -227,37 +385,168 @@ func (app *application) getCustomerProfileHandler(w http.ResponseWriter, r *http
 	// Just encode the profile object directly
 	json.NewEncoder(w).Encode(profile)
 }
-func (app *application) getAllCustomerProfilesHandler(w http.ResponseWriter, r *http.Request) {
-	profiles, err := app.client.GetAllCustomerProfiles()
+
+// isProfileLookup reports whether the request is GET /customer-profiles?merchantCustomerId=...
+// (or email=...) on its own, which returns that single profile from the gateway. Combined with
+// paging or a description filter, the same keys filter a search of the index instead.
+func isProfileLookup(values url.Values) bool {
+	for key := range values {
+		if key != "merchantCustomerId" && key != "email" {
+			return false
+		}
+	}
+	return strings.TrimSpace(values.Get("merchantCustomerId")) != "" || strings.TrimSpace(values.Get("email")) != ""
+}
+
+// lookupCustomerProfileHandler finds a profile by the ColdFusion customer number or email, so
+// callers don't need to store Authorize.Net profile IDs.
+func (app *application) lookupCustomerProfileHandler(w http.ResponseWriter, r *http.Request) {
+	lookup := authorizenet.ProfileLookup{
+		MerchantCustomerId: strings.TrimSpace(r.URL.Query().Get("merchantCustomerId")),
+		Email:              strings.TrimSpace(r.URL.Query().Get("email")),
+	}
+
+	profile, err := app.gateway(r).GetCustomerProfileBy(lookup)
+	if errors.Is(err, authorizenet.ErrProfileNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	annotate(r, slog.String("customer_profile_id", profile.CustomerProfileId))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+func (app *application) getAllCustomerProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	if isProfileLookup(r.URL.Query()) {
+		app.lookupCustomerProfileHandler(w, r)
+		return
+	}
+	if isProfileQuery(r.URL.Query()) {
+		app.searchCustomerProfilesHandler(w, r)
+		return
+	}
+	// Fetching every profile can outlast the server's write timeout.
+	noWriteDeadline(w)
+	if wantsNDJSON(r) {
+		app.streamCustomerProfiles(w, r)
+		return
+	}
+
+	opts := app.config.ProfileFetch
+	opts.Progress = func(done, total int) {
+		if done%100 == 0 || done == total {
+			logger.Debug("Fetching customer profiles", "done", done, "total", total)
+		}
+	}
+
+	profiles, err := app.gateway(r).GetAllCustomerProfilesWithOptions(opts)
+	var partial *authorizenet.PartialFetchError
+	if errors.As(err, &partial) && len(profiles) > 0 {
+		// Serve what we have; the header tells callers the list is incomplete.
+		for _, failed := range partial.Failed {
+			logger.Warn("Failed to fetch customer profile", "failed_profile_id", failed.ProfileId, "error", failed.Err)
+		}
+		w.Header().Set("X-Partial-Results", strconv.Itoa(len(partial.Failed)))
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(profiles)
 }
 
+// wantsNDJSON reports whether the caller asked for a newline-delimited JSON stream, either
+// with Accept: application/x-ndjson or ?stream=true.
+func wantsNDJSON(r *http.Request) bool {
+	if stream, _ := strconv.ParseBool(r.URL.Query().Get("stream")); stream {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// streamCustomerProfiles writes one profile per line as the gateway returns them. Once the
+// first line is out the status can no longer change, so failures are reported in-band as
+// {"error": ...} lines.
+func (app *application) streamCustomerProfiles(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	streamed, failed := 0, 0
+	for profile, err := range app.gateway(r).CustomerProfiles(authorizenet.DefaultProfileIdPageSize) {
+		if r.Context().Err() != nil {
+			logger.Info("Client went away while streaming customer profiles", "streamed", streamed)
+			return
+		}
+
+		if err != nil {
+			failed++
+			line := map[string]string{"error": err.Error()}
+			var fetchErr *authorizenet.ProfileFetchError
+			if errors.As(err, &fetchErr) {
+				line["customerProfileId"] = fetchErr.ProfileId
+			}
+			logger.Warn("Error while streaming customer profiles", "error", err)
+			enc.Encode(line)
+		} else {
+			streamed++
+			enc.Encode(profile)
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	logger.Info("Streamed customer profiles", "streamed", streamed, "failed", failed)
+}
+
 func (app *application) chargeCustomerProfileHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Charge Customer Profile Handler")
+	logger := requestLogger(r)
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Cannot read request body", http.StatusInternalServerError)
 		return
 	}
-	log.Printf("--- Raw /transactions request body: %s", string(body))
+	logger.Debug("Raw /transactions request body", "body", body)
 
 	var req ChargeRequest
 	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
-		log.Printf("!!! Failed to decode JSON body: %v", err)
+		logger.Warn("Failed to decode JSON body", "error", err)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Successfully decoded ChargeRequest: %+v", req)
+	annotate(r, slog.String("customer_profile_id", req.ProfileID), slog.String("invoice_number", req.InvoiceNumber))
+	logger = requestLogger(r)
+	logger.Debug("Decoded ChargeRequest", "request", req)
+
+	transactionResponse, err := app.gateway(r).ChargeCustomerProfile(req.ProfileID, req.PaymentProfileID, req.Amount, req.InvoiceNumber, req.TransactionType, req.Description)
+	annotateTransaction(r, transactionResponse)
 
-	transactionResponse, err := app.client.ChargeCustomerProfile(req.ProfileID, req.PaymentProfileID, req.Amount, req.InvoiceNumber, req.TransactionType, req.Description)
+	ledgerOperation, orderOperation := ledgerCharge, orders.Charge
+	if req.TransactionType == "authOnlyTransaction" {
+		ledgerOperation, orderOperation = ledgerAuth, orders.Auth
+	}
+	app.recordLedger(r, LedgerEntry{
+		Operation:         ledgerOperation,
+		CustomerProfileId: req.ProfileID,
+		PaymentProfileId:  req.PaymentProfileID,
+		InvoiceNumber:     req.InvoiceNumber,
+		Amount:            req.Amount,
+	}, transactionResponse, err)
 
 	w.Header().Set("Content-Type", "application/json")
 
@@ -271,6 +560,18 @@ func (app *application) chargeCustomerProfileHandler(w http.ResponseWriter, r *h
 		return
 	}
 
+	if req.InvoiceNumber != "" {
+		if err := app.recordOrder(r, orderResult(orderOperation, req.InvoiceNumber, "", req.Amount, transactionResponse)); err != nil {
+			logger.Error("Database update failed", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ApiResponse{
+				IsSuccess: false,
+				Message:   "CRITICAL:Payment was processed but failed to update order record.",
+			})
+			return
+		}
+	}
+
 	// Determine the action for the response
 	action := "authCaptureTransaction"
 	if req.TransactionType == "authOnlyTransaction" {
@@ -298,8 +599,18 @@ func (app *application) authorizeCustomerProfileHandler(w http.ResponseWriter, r
 		return
 	}
 
+	annotate(r, slog.String("customer_profile_id", req.ProfileID), slog.String("invoice_number", req.InvoiceNumber))
+
 	// The function now returns the full transaction response object
-	fullResponse, err := app.client.AuthorizeCustomerProfile(req.ProfileID, req.PaymentProfileID, req.Amount)
+	fullResponse, err := app.gateway(r).AuthorizeCustomerProfile(req.ProfileID, req.PaymentProfileID, req.Amount)
+	annotateTransaction(r, fullResponse)
+	app.recordLedger(r, LedgerEntry{
+		Operation:         ledgerAuth,
+		CustomerProfileId: req.ProfileID,
+		PaymentProfileId:  req.PaymentProfileID,
+		InvoiceNumber:     req.InvoiceNumber,
+		Amount:            req.Amount,
+	}, fullResponse, err)
 
 	w.Header().Set("Content-Type", "application/json")
 
@@ -313,6 +624,19 @@ func (app *application) authorizeCustomerProfileHandler(w http.ResponseWriter, r
 		return
 	}
 
+	// Link the authorization to its order now, so the capture can find it by transId.
+	if req.InvoiceNumber != "" {
+		if err := app.recordOrder(r, orderResult(orders.Auth, req.InvoiceNumber, "", req.Amount, fullResponse)); err != nil {
+			requestLogger(r).Error("Database update failed", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ApiResponse{
+				IsSuccess: false,
+				Message:   "CRITICAL:Payment was authorized but failed to update order record.",
+			})
+			return
+		}
+	}
+
 	// On success, send a structured success response
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(ApiResponse{
@@ -329,19 +653,27 @@ func (app *application) capturePriorAuthTransactionHandler(w http.ResponseWriter
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	log.Printf("Version 2 Handler:Capture Prior Auth Transaction %+v", req)
+	annotate(r, slog.String("ref_trans_id", req.RefTransId))
+	logger := requestLogger(r)
+	logger.Debug("Capture prior auth transaction", "request", req)
 	if req.RefTransId == "" {
 		// Add a version marker to the error message
 		http.Error(w, "V2 Error: Missing required field: refTransId", http.StatusBadRequest)
 		return
 	}
 	// This function also returns the full response now
-	fullResponse, err := app.client.CapturePriorAuthTransaction(req.RefTransId, req.Amount)
+	fullResponse, err := app.gateway(r).CapturePriorAuthTransaction(req.RefTransId, req.Amount)
+	annotateTransaction(r, fullResponse)
+	app.recordLedger(r, LedgerEntry{
+		Operation:  ledgerCapture,
+		RefTransId: req.RefTransId,
+		Amount:     req.Amount,
+	}, fullResponse, err)
 
 	w.Header().Set("Content-Type", "application/json")
 
 	if err != nil {
-		log.Printf("Error Capturing Prior Auth Transaction: %+v", err.Error())
+		logger.Error("Error capturing prior auth transaction", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ApiResponse{
 			IsSuccess: false,
@@ -350,49 +682,301 @@ func (app *application) capturePriorAuthTransactionHandler(w http.ResponseWriter
 		return
 	}
 
-	responseBytes, err := json.Marshal(ApiResponse{
+	// The order update is queued before it is tried, so a database failure now is retried
+	// by the outbox worker instead of leaving the order out of step with the gateway.
+	if err := app.recordOrder(r, orderResult(orders.Capture, "", req.RefTransId, req.Amount, fullResponse)); err != nil {
+		logger.Error("Database update failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ApiResponse{
+			IsSuccess: false,
+			Message:   "CRITICAL:Payment was processed but failed to update order record.",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ApiResponse{
 		IsSuccess:   true,
 		Message:     "Previously authorized transaction captured successfully.",
 		Action:      "priorAuthCaptureTransaction",
 		Transaction: fullResponse,
 	})
+}
+
+func (app *application) refundTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	var req RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.RefTransId == "" || req.Amount == "" {
+		http.Error(w, "Missing required fields: refTransId or amount", http.StatusBadRequest)
+		return
+	}
+	annotate(r, slog.String("ref_trans_id", req.RefTransId))
+	logger := requestLogger(r)
+
+	fullResponse, err := app.gateway(r).RefundTransaction(req.RefTransId, req.Amount, req.ProfileID, req.PaymentProfileID)
+	annotateTransaction(r, fullResponse)
+	app.recordLedger(r, LedgerEntry{
+		Operation:         ledgerRefund,
+		CustomerProfileId: req.ProfileID,
+		PaymentProfileId:  req.PaymentProfileID,
+		InvoiceNumber:     req.InvoiceNumber,
+		Amount:            req.Amount,
+		RefTransId:        req.RefTransId,
+	}, fullResponse, err)
+
+	w.Header().Set("Content-Type", "application/json")
+
 	if err != nil {
-		log.Printf("Failed to carshal capture response: %v", err)
+		logger.Error("Error refunding transaction", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ApiResponse{
 			IsSuccess: false,
-			Message:   "Failed to process transaction response internally.",
+			Message:   err.Error(),
 		})
 		return
 	}
 
-	originalTransId := req.RefTransId
-	newTransId := fullResponse.TransId
+	if err := app.recordOrder(r, orderResult(orders.Refund, req.InvoiceNumber, req.RefTransId, req.Amount, fullResponse)); err != nil {
+		logger.Error("Database update failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ApiResponse{
+			IsSuccess: false,
+			Message:   "CRITICAL:Refund was processed but failed to update order record.",
+		})
+		return
+	}
 
-	stmt := `
-		UPDATE header
-			SET authorizenet_results = authorizenet_results || '|' || $1,
-			authorizenet_ts = now(),
-			transactionnum = $2
-		WHERE transactionnum = $3;
-	`
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ApiResponse{
+		IsSuccess:   true,
+		Message:     "Transaction refunded successfully.",
+		Action:      "refundTransaction",
+		Transaction: fullResponse,
+	})
+}
 
-	_, dbErr := app.db.Exec(stmt, string(responseBytes), newTransId, originalTransId)
+func (app *application) voidTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	var req VoidRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.RefTransId == "" {
+		http.Error(w, "Missing required field: refTransId", http.StatusBadRequest)
+		return
+	}
+	annotate(r, slog.String("ref_trans_id", req.RefTransId))
+	logger := requestLogger(r)
 
-	if dbErr != nil {
-		log.Printf("Database update failed: %v", dbErr)
+	fullResponse, err := app.gateway(r).VoidTransaction(req.RefTransId)
+	annotateTransaction(r, fullResponse)
+	app.recordLedger(r, LedgerEntry{
+		Operation:     ledgerVoid,
+		InvoiceNumber: req.InvoiceNumber,
+		RefTransId:    req.RefTransId,
+	}, fullResponse, err)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err != nil {
+		logger.Error("Error voiding transaction", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ApiResponse{
 			IsSuccess: false,
-			Message:   "CRITICAL:Payment was processed but failed to update order record.",
+			Message:   err.Error(),
 		})
 		return
 	}
 
-	log.Printf("Successfully updated order record for transaction %s", originalTransId)
+	if err := app.recordOrder(r, orderResult(orders.Void, req.InvoiceNumber, req.RefTransId, "", fullResponse)); err != nil {
+		logger.Error("Database update failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ApiResponse{
+			IsSuccess: false,
+			Message:   "CRITICAL:Void was processed but failed to update order record.",
+		})
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
-	w.Write(responseBytes)
+	json.NewEncoder(w).Encode(ApiResponse{
+		IsSuccess:   true,
+		Message:     "Transaction voided successfully.",
+		Action:      "voidTransaction",
+		Transaction: fullResponse,
+	})
+}
+
+func (app *application) getCustomerTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		http.Error(w, "Missing customer profile ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	opts := authorizenet.TransactionListOptions{
+		PaymentProfileId: query.Get("paymentProfileId"),
+		OrderBy:          "submitTimeUTC",
+		OrderDescending:  true,
+		Limit:            100,
+		Offset:           1,
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		opts.Limit = limit
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 1 {
+			http.Error(w, "offset must be a page number starting at 1", http.StatusBadRequest)
+			return
+		}
+		opts.Offset = offset
+	}
+	if v := query.Get("orderBy"); v != "" {
+		if v != "id" && v != "submitTimeUTC" {
+			http.Error(w, "orderBy must be id or submitTimeUTC", http.StatusBadRequest)
+			return
+		}
+		opts.OrderBy = v
+	}
+	if v := query.Get("orderDescending"); v != "" {
+		desc, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "orderDescending must be true or false", http.StatusBadRequest)
+			return
+		}
+		opts.OrderDescending = desc
+	}
+
+	summaries, total, err := app.gateway(r).GetTransactionListForCustomer(id, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	transIds := make([]string, 0, len(summaries))
+	for _, t := range summaries {
+		transIds = append(transIds, t.TransId)
+	}
+	invoices, err := app.orders.InvoicesByTransactionNum(transIds)
+	if err != nil {
+		// The gateway history is still useful without our order numbers.
+		requestLogger(r).Warn("Failed to look up invoice numbers", "error", err)
+	}
+
+	transactions := make([]CustomerTransaction, 0, len(summaries))
+	for _, t := range summaries {
+		transactions = append(transactions, CustomerTransaction{
+			TransactionSummary: t,
+			OrderInvoiceNumber: invoices[t.TransId],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CustomerTransactionsResponse{
+		Transactions: transactions,
+		Total:        total,
+		Limit:        opts.Limit,
+		Offset:       opts.Offset,
+	})
+}
+
+// getOrderHandler serves GET /orders?invoiceNumber=... or GET /orders?transId=..., an
+// order's current transaction and the gateway results recorded against it.
+func (app *application) getOrderHandler(w http.ResponseWriter, r *http.Request) {
+	invoiceNumber := r.URL.Query().Get("invoiceNumber")
+	transId := r.URL.Query().Get("transId")
+	if (invoiceNumber == "") == (transId == "") {
+		http.Error(w, "Exactly one of invoiceNumber or transId is required", http.StatusBadRequest)
+		return
+	}
+
+	var order *orders.Order
+	var err error
+	if invoiceNumber != "" {
+		order, err = app.orders.ByInvoice(invoiceNumber)
+	} else {
+		order, err = app.orders.ByTransactionNum(transId)
+	}
+	if errors.Is(err, orders.ErrNotFound) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Order lookup failed", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+func (app *application) sendTransactionReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	transId, ok := vars["id"]
+	if !ok {
+		http.Error(w, "Missing transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ReceiptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	email := req.Email
+	if email == "" {
+		// Fall back to the email on the customer profile the transaction was charged against.
+		profileID := req.CustomerProfileID
+		if profileID == "" {
+			details, err := app.gateway(r).GetTransactionDetails(transId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if details.Profile != nil {
+				profileID = details.Profile.CustomerProfileId
+			}
+		}
+		if profileID == "" {
+			http.Error(w, "Missing email and transaction is not linked to a customer profile", http.StatusBadRequest)
+			return
+		}
+
+		profile, err := app.gateway(r).GetCustomerProfile(profileID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		email = profile.Email
+	}
+	if email == "" {
+		http.Error(w, "Customer profile has no email address", http.StatusBadRequest)
+		return
+	}
+
+	opts := authorizenet.ReceiptOptions{Header: req.Header, Footer: req.Footer}
+	if err := app.gateway(r).SendCustomerTransactionReceipt(transId, email, opts); err != nil {
+		requestLogger(r).Error("Error sending receipt", "trans_id", transId, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Receipt sent successfully", "email": email})
 }
 
 func (app *application) updateCustomerProfileHandler(w http.ResponseWriter, r *http.Request) {
@@ -409,10 +993,11 @@ func (app *application) updateCustomerProfileHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	if err := app.client.UpdateCustomerProfile(id, req.Email, req.Description); err != nil {
+	if err := app.gateway(r).UpdateCustomerProfile(id, req.Email, req.Description); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	app.mirrorProfile(r, id)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -431,46 +1016,45 @@ func (app *application) updateCustomerPaymentProfileHandler(w http.ResponseWrite
 		return
 	}
 
-	err := app.client.UpdateCustomerPaymentProfile(customerProfileId, paymentProfileId, req.CreditCard, req.BillTo)
+	err := app.gateway(r).UpdateCustomerPaymentProfile(customerProfileId, paymentProfileId, req.CreditCard, req.BillTo)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	app.mirrorProfile(r, customerProfileId)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Payment profile updated successfully"})
 }
 
 func (app *application) addShippingAddressHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Add Shipping Address Handler reached.")
+	logger := requestLogger(r)
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
 	if !ok {
 		http.Error(w, "Missing customer profile ID in URL path", http.StatusBadRequest)
 		return
 	}
-	log.Println("Profile ID from URL:", id)
-
-	// Add logging to see the raw request body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Cannot read request body", http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Received raw JSON for shipping address: %s", string(body))
+	logger.Debug("Received raw JSON for shipping address", "body", body)
 
 	var req AddShippingAddressRequest
 	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
-		log.Printf("--> JSON decoding error: %v", err)
+		logger.Warn("JSON decoding error", "error", err)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	addressID, err := app.client.AddShippingAddress(id, req.Address)
+	addressID, err := app.gateway(r).AddShippingAddress(id, req.Address)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	app.mirrorProfile(r, id)
 
 	response := map[string]string{"customerAddressId": addressID}
 	w.Header().Set("Content-Type", "application/json")
@@ -479,7 +1063,6 @@ func (app *application) addShippingAddressHandler(w http.ResponseWriter, r *http
 }
 
 func (app *application) deleteShippingAddressHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Delete Shipping Address Handler")
 	vars := mux.Vars(r)
 	profileId, ok1 := vars["id"]
 	addressId, ok2 := vars["addressId"]
@@ -489,11 +1072,14 @@ func (app *application) deleteShippingAddressHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	err := app.client.DeleteShippingAddress(profileId, addressId)
+	err := app.gateway(r).DeleteShippingAddress(profileId, addressId)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := app.profiles.DeleteShippingAddress(profileId, addressId); err != nil {
+		requestLogger(r).Warn("Customer profile mirror update failed", "error", err)
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -512,11 +1098,12 @@ func (app *application) addPaymentProfileHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
-	paymentProfileID, err := app.client.AddPaymentProfile(id, req.CreditCard)
+	paymentProfileID, err := app.gateway(r).AddPaymentProfile(id, req.CreditCard)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	app.mirrorProfile(r, id)
 
 	response := map[string]string{"customerPaymentProfileId": paymentProfileID}
 	w.Header().Set("Content-Type", "application/json")
@@ -525,14 +1112,14 @@ func (app *application) addPaymentProfileHandler(w http.ResponseWriter, r *http.
 }
 
 func (app *application) updatePaymentProfileHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("=== UPDATE PAYMENT PROFILE HANDLER REACHED ===")
+	logger := requestLogger(r)
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Failed to read body: %v", err)
+		logger.Error("Failed to read body", "error", err)
 		http.Error(w, "Cannot read request body", http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Raw body for update: %s", string(body))
+	logger.Debug("Raw body for update", "body", body)
 
 	// FIXED: Nest Payment to match incoming JSON: "payment": { "creditCard": { ... } }
 	var req struct {
@@ -545,38 +1132,31 @@ func (app *application) updatePaymentProfileHandler(w http.ResponseWriter, r *ht
 	}
 
 	if err := json.Unmarshal(body, &req); err != nil {
-		log.Printf("Decode error: %v", err)
+		logger.Warn("Decode error", "error", err)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	log.Printf("Decoded req: |%+v|", req) // Now CardNumber should log as populated
+	annotate(r, slog.String("customer_profile_id", req.CustomerProfileId))
+	logger = requestLogger(r)
+	logger.Debug("Decoded payment profile update", "request", req) // CardNumber is logged masked to its last four digits
 
 	customerProfileId := req.CustomerProfileId
-	paymentProfile := struct {
-		BillTo  *authorizenet.ShippingAddress `json:"billTo,omitempty"`
-		Payment struct {
-			CreditCard authorizenet.CreditCard `json:"creditCard,omitempty"`
-		} `json:"payment,omitempty"`
-		CustomerPaymentProfileId string `json:"customerPaymentProfileId,omitempty"`
-	}{
-		BillTo: &req.BillTo,
-		// FIXED: Access the nested CreditCard
-		Payment: struct {
-			CreditCard authorizenet.CreditCard `json:"creditCard,omitempty"`
-		}{
-			CreditCard: req.Payment.CreditCard, // Now passes the actual card details
-		},
+	paymentProfile := authorizenet.PaymentProfileUpdate{
+		BillTo:                   &req.BillTo,
 		CustomerPaymentProfileId: req.PaymentProfileId,
 	}
+	// FIXED: Access the nested CreditCard
+	paymentProfile.Payment.CreditCard = req.Payment.CreditCard // Now passes the actual card details
 
-	err = app.client.UpdatePaymentProfile(customerProfileId, &paymentProfile)
+	err = app.gateway(r).UpdatePaymentProfile(customerProfileId, &paymentProfile)
 	if err != nil {
-		log.Printf("API error: %v", err)
+		logger.Error("API error", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	log.Println("Payment profile updated successfully")
+	logger.Info("Payment profile updated successfully", "payment_profile_id", req.PaymentProfileId)
+	app.mirrorProfile(r, customerProfileId)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Payment profile updated successfully"})
 }
@@ -591,12 +1171,15 @@ func (app *application) deletePaymentProfileHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
-	err := app.client.DeletePaymentProfile(customerProfileId, paymentProfileId)
+	err := app.gateway(r).DeletePaymentProfile(customerProfileId, paymentProfileId)
 	if err != nil {
-		log.Printf("Error deleting payment profile: %v", err)
+		requestLogger(r).Error("Error deleting payment profile", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := app.profiles.DeletePaymentProfile(customerProfileId, paymentProfileId); err != nil {
+		requestLogger(r).Warn("Customer profile mirror update failed", "error", err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -604,18 +1187,18 @@ func (app *application) deletePaymentProfileHandler(w http.ResponseWriter, r *ht
 }
 
 func (app *application) updateBillingAddressHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Updating Customer Billing Address")
+	logger := requestLogger(r)
 
 	// Read the raw body from the request
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("!!! Could not read request body: %v", err)
+		logger.Error("Could not read request body", "error", err)
 		http.Error(w, "Cannot read request body", http.StatusInternalServerError)
 		return
 	}
 
 	// Log the raw body so we can see exactly what ColdFusion is sending
-	log.Printf("--- Raw request body received: %s", string(body))
+	logger.Debug("Raw request body received", "body", body)
 
 	vars := mux.Vars(r)
 	customerProfileId, ok1 := vars["id"]
@@ -629,15 +1212,28 @@ func (app *application) updateBillingAddressHandler(w http.ResponseWriter, r *ht
 	var req UpdateBillingAddressRequest
 	// We now use bytes.NewReader(body) because the original r.Body has already been read
 	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
-		log.Printf("!!! Failed to decode billing address JSON body: %v", err)
+		logger.Warn("Failed to decode billing address JSON body", "error", err)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	err = app.client.UpdateBillingAddress(customerProfileId, paymentProfileId, req.Address)
+	err = app.gateway(r).UpdateBillingAddress(customerProfileId, paymentProfileId, req.Address)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	app.mirrorProfile(r, customerProfileId)
 	w.WriteHeader(http.StatusOK)
 }
+
+func (app *application) getMerchantDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	details, err := app.gateway(r).GetMerchantDetails()
+	if err != nil {
+		requestLogger(r).Error("Error getting merchant details", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(details)
+}
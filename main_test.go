@@ -0,0 +1,2586 @@
+package main
+
+import (
+	"authnet/authorizenet"
+	"authnet/authorizenet/fakegateway"
+	"authnet/orders"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// API keys seeded into every test environment. env.do sends testKey unless the request
+// sets its own Authorization header.
+const (
+	testKey       = "hbw_test-portal"
+	testAdminKey  = "hbw_test-admin"
+	testReaderKey = "hbw_test-reader"
+)
+
+// memoryAPIKeyStore is an APIKeyStore over a map keyed by key hash.
+type memoryAPIKeyStore map[string]*APIKey
+
+func (s memoryAPIKeyStore) LookupAPIKey(keyHash string) (*APIKey, error) {
+	if key, ok := s[keyHash]; ok {
+		return key, nil
+	}
+	return nil, errAPIKeyNotFound
+}
+
+// memoryIdempotencyStore is an IdempotencyStore over a map keyed by caller and key.
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[[2]string]*memoryIdempotencyRecord
+}
+
+type memoryIdempotencyRecord struct {
+	IdempotencyRecord
+	expiresAt time.Time
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{records: map[[2]string]*memoryIdempotencyRecord{}}
+}
+
+func (s *memoryIdempotencyStore) Begin(caller, key, fingerprint string, expiresAt time.Time) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.records[[2]string{caller, key}]; ok && time.Now().Before(rec.expiresAt) {
+		existing := rec.IdempotencyRecord
+		return &existing, nil
+	}
+	s.records[[2]string{caller, key}] = &memoryIdempotencyRecord{IdempotencyRecord{Fingerprint: fingerprint}, expiresAt}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(caller, key string, statusCode int, contentType string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.records[[2]string{caller, key}]; ok {
+		rec.StatusCode, rec.ContentType, rec.Body = statusCode, contentType, body
+	}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(caller, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, [2]string{caller, key})
+	return nil
+}
+
+// memoryOrderOutbox is an OrderOutbox over a slice in ID order.
+type memoryOrderOutbox struct {
+	mu        sync.Mutex
+	updates   []OrderUpdate
+	delivered map[int64]bool
+	err       error
+}
+
+func (o *memoryOrderOutbox) Enqueue(u OrderUpdate, notBefore time.Time) (OrderUpdate, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return OrderUpdate{}, o.err
+	}
+	u.ID = int64(len(o.updates) + 1)
+	u.CreatedAt = time.Now()
+	u.NextAttemptAt = notBefore
+	o.updates = append(o.updates, u)
+	return u, nil
+}
+
+func (o *memoryOrderOutbox) Claim(limit int, lease time.Duration) ([]OrderUpdate, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return nil, o.err
+	}
+	var claimed []OrderUpdate
+	now := time.Now()
+	for i := range o.updates {
+		u := &o.updates[i]
+		if len(claimed) == limit || o.delivered[u.ID] || u.NextAttemptAt.After(now) {
+			continue
+		}
+		u.NextAttemptAt = now.Add(lease)
+		claimed = append(claimed, *u)
+	}
+	return claimed, nil
+}
+
+func (o *memoryOrderOutbox) Delivered(id int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.delivered == nil {
+		o.delivered = map[int64]bool{}
+	}
+	o.delivered[id] = true
+	return nil
+}
+
+func (o *memoryOrderOutbox) Failed(id int64, cause string, next time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	u := &o.updates[id-1]
+	u.Attempts++
+	u.LastError = cause
+	u.NextAttemptAt = next
+	return nil
+}
+
+func (o *memoryOrderOutbox) Pending(minAttempts int) ([]OrderUpdate, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	pending := []OrderUpdate{}
+	for _, u := range o.updates {
+		if !o.delivered[u.ID] && u.Attempts >= minAttempts {
+			pending = append(pending, u)
+		}
+	}
+	return pending, nil
+}
+
+func (o *memoryOrderOutbox) Retry(id int64) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if id < 1 || id > int64(len(o.updates)) || o.delivered[id] {
+		return false, nil
+	}
+	o.updates[id-1].NextAttemptAt = time.Now()
+	return true, nil
+}
+
+// memoryLedgerStore is a LedgerStore over a slice in insertion order.
+type memoryLedgerStore struct {
+	mu      sync.Mutex
+	entries []LedgerEntry
+	err     error
+}
+
+func (s *memoryLedgerStore) Record(e LedgerEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	e.ID = int64(len(s.entries) + 1)
+	e.CreatedAt = time.Now()
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+func (s *memoryLedgerStore) Original(transId string) (*LedgerEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if e.TransId == transId && e.Success && (e.Operation == ledgerAuth || e.Operation == ledgerCharge) {
+			return &e, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryLedgerStore) Query(q LedgerQuery) ([]LedgerEntry, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, 0, s.err
+	}
+	var matched []LedgerEntry
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		e := s.entries[i]
+		if (q.Operation != "" && e.Operation != q.Operation) ||
+			(q.TransId != "" && e.TransId != q.TransId && e.RefTransId != q.TransId) ||
+			(q.InvoiceNumber != "" && e.InvoiceNumber != q.InvoiceNumber) ||
+			(q.CustomerProfileId != "" && e.CustomerProfileId != q.CustomerProfileId) ||
+			(!q.From.IsZero() && e.CreatedAt.Before(q.From)) ||
+			(!q.To.IsZero() && !e.CreatedAt.Before(q.To)) {
+			continue
+		}
+		matched = append(matched, e)
+	}
+	page := []LedgerEntry{}
+	for i := q.Offset; i < len(matched) && len(page) < q.Limit; i++ {
+		page = append(page, matched[i])
+	}
+	return page, len(matched), nil
+}
+
+func (s *memoryLedgerStore) Summary(from, to time.Time) ([]LedgerSummary, error) {
+	entries, _, err := s.Query(LedgerQuery{From: from, To: to, Limit: math.MaxInt})
+	if err != nil {
+		return nil, err
+	}
+	byOp := map[string]*LedgerSummary{}
+	amounts := map[string]float64{}
+	for _, e := range entries {
+		sum, ok := byOp[e.Operation]
+		if !ok {
+			sum = &LedgerSummary{Operation: e.Operation}
+			byOp[e.Operation] = sum
+		}
+		sum.Count++
+		if e.Success {
+			sum.Succeeded++
+			amount, _ := strconv.ParseFloat(e.Amount, 64)
+			amounts[e.Operation] += amount
+		} else {
+			sum.Failed++
+		}
+	}
+	summaries := []LedgerSummary{}
+	for _, op := range ledgerOperations {
+		if sum, ok := byOp[op]; ok {
+			sum.Amount = strconv.FormatFloat(amounts[op], 'f', 2, 64)
+			summaries = append(summaries, *sum)
+		}
+	}
+	return summaries, nil
+}
+
+// profileIDLess orders numeric gateway IDs numerically.
+func profileIDLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func (q ProfileQuery) matches(p *authorizenet.CustomerProfile) bool {
+	if q.Email != "" && !strings.EqualFold(p.Email, q.Email) {
+		return false
+	}
+	if q.MerchantCustomerId != "" && p.MerchantCustomerId != q.MerchantCustomerId {
+		return false
+	}
+	if q.Description != "" && !strings.Contains(strings.ToLower(p.Description), strings.ToLower(q.Description)) {
+		return false
+	}
+	return true
+}
+
+// memoryProfileIndex is a ProfileMirror over a slice in profile ID order. Like the Postgres
+// mirror, it is ready once the first full sync has completed.
+type memoryProfileIndex struct {
+	mu       sync.RWMutex
+	profiles []authorizenet.CustomerProfile
+	syncedAt map[string]time.Time
+	builtAt  time.Time
+}
+
+func newMemoryProfileIndex() *memoryProfileIndex {
+	return &memoryProfileIndex{syncedAt: map[string]time.Time{}}
+}
+
+func (idx *memoryProfileIndex) find(profileID string) int {
+	i := sort.Search(len(idx.profiles), func(i int) bool {
+		return !profileIDLess(idx.profiles[i].CustomerProfileId, profileID)
+	})
+	if i < len(idx.profiles) && idx.profiles[i].CustomerProfileId == profileID {
+		return i
+	}
+	return -1
+}
+
+func (idx *memoryProfileIndex) SaveProfile(profile authorizenet.CustomerProfile) error {
+	profile = maskProfile(profile)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.syncedAt[profile.CustomerProfileId] = time.Now()
+	if i := idx.find(profile.CustomerProfileId); i >= 0 {
+		idx.profiles[i] = profile
+		return nil
+	}
+	idx.profiles = append(idx.profiles, profile)
+	sort.Slice(idx.profiles, func(i, j int) bool {
+		return profileIDLess(idx.profiles[i].CustomerProfileId, idx.profiles[j].CustomerProfileId)
+	})
+	return nil
+}
+
+func (idx *memoryProfileIndex) DeletePaymentProfile(customerProfileId, paymentProfileId string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if i := idx.find(customerProfileId); i >= 0 {
+		p := &idx.profiles[i]
+		p.PaymentProfiles = slices.DeleteFunc(slices.Clone(p.PaymentProfiles), func(pp authorizenet.PaymentProfile) bool {
+			return pp.CustomerPaymentProfileId == paymentProfileId
+		})
+	}
+	return nil
+}
+
+func (idx *memoryProfileIndex) DeleteShippingAddress(customerProfileId, addressId string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if i := idx.find(customerProfileId); i >= 0 {
+		p := &idx.profiles[i]
+		p.ShipToList = slices.DeleteFunc(slices.Clone(p.ShipToList), func(a authorizenet.ShippingAddress) bool {
+			return a.CustomerAddressId == addressId
+		})
+	}
+	return nil
+}
+
+func (idx *memoryProfileIndex) ReplaceAll(started time.Time, ids []string, profiles []authorizenet.CustomerProfile) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	now := time.Now()
+	listed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		listed[id] = true
+	}
+	byID := make(map[string]authorizenet.CustomerProfile, len(ids))
+	for _, p := range idx.profiles {
+		// A profile saved since the sync started may be missing from its ID list.
+		if listed[p.CustomerProfileId] || !idx.syncedAt[p.CustomerProfileId].Before(started) {
+			byID[p.CustomerProfileId] = p
+		}
+	}
+	for _, p := range profiles {
+		// Keep a copy saved after the sync fetched this one.
+		if saved, ok := idx.syncedAt[p.CustomerProfileId]; ok && !saved.Before(started) {
+			continue
+		}
+		byID[p.CustomerProfileId] = maskProfile(p)
+		idx.syncedAt[p.CustomerProfileId] = now
+	}
+
+	next := make([]authorizenet.CustomerProfile, 0, len(byID))
+	for _, p := range byID {
+		next = append(next, p)
+	}
+	sort.Slice(next, func(i, j int) bool {
+		return profileIDLess(next[i].CustomerProfileId, next[j].CustomerProfileId)
+	})
+	for id := range idx.syncedAt {
+		if _, ok := byID[id]; !ok {
+			delete(idx.syncedAt, id)
+		}
+	}
+
+	idx.profiles = next
+	idx.builtAt = now
+	return nil
+}
+
+func (idx *memoryProfileIndex) Search(q ProfileQuery) (*ProfilePage, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if idx.builtAt.IsZero() {
+		return nil, errIndexNotReady
+	}
+
+	after := ""
+	if q.Cursor != "" {
+		var err error
+		if after, err = decodeCursor(q.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	page := &ProfilePage{Profiles: []authorizenet.CustomerProfile{}, Limit: q.Limit}
+	if q.Cursor == "" {
+		page.Offset = q.Offset
+	}
+
+	skipped := 0
+	for i := range idx.profiles {
+		p := &idx.profiles[i]
+		if !q.matches(p) {
+			continue
+		}
+		page.Total++
+
+		if after != "" && !profileIDLess(after, p.CustomerProfileId) {
+			continue
+		}
+		if after == "" && skipped < q.Offset {
+			skipped++
+			continue
+		}
+		if len(page.Profiles) < q.Limit {
+			page.Profiles = append(page.Profiles, *p)
+		} else if page.NextCursor == "" {
+			page.NextCursor = encodeCursor(page.Profiles[len(page.Profiles)-1].CustomerProfileId)
+		}
+	}
+
+	return page, nil
+}
+
+func newMemoryAPIKeyStore() memoryAPIKeyStore {
+	return memoryAPIKeyStore{
+		hashAPIKey(testKey):       {Name: "portal", Scopes: []string{scopeProfilesRead, scopeProfilesWrite, scopeCharge, scopeCapture, scopeRefund}},
+		hashAPIKey(testAdminKey):  {Name: "admin", Scopes: []string{scopeAdmin}},
+		hashAPIKey(testReaderKey): {Name: "reader", Scopes: []string{scopeProfilesRead}},
+	}
+}
+
+type testEnv struct {
+	t       *testing.T
+	fake    *fakegateway.Server
+	client  *authorizenet.APIClient
+	orders  *orders.Memory
+	ledger  *memoryLedgerStore
+	outbox  *memoryOrderOutbox
+	app     *application
+	handler http.Handler
+
+	profileID        string
+	paymentProfileID string
+	addressID        string
+}
+
+// newTestEnv wires the application to a fake gateway holding one customer profile with
+// one approved card and one shipping address.
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	fake := fakegateway.New()
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	client := authorizenet.NewAPIClient("test-login", "test-key", srv.URL)
+	client.Logger = logger
+
+	env := &testEnv{
+		t:      t,
+		fake:   fake,
+		client: client,
+		orders: orders.NewMemory(),
+		ledger: &memoryLedgerStore{},
+		outbox: &memoryOrderOutbox{},
+	}
+	cfg := defaultConfig()
+	cfg.AuthNet.ValidationMode = "testMode"
+	cfg.IdempotencyWindow = time.Hour
+	env.app = &application{
+		config:        cfg,
+		client:        client,
+		orders:        env.orders,
+		outbox:        env.outbox,
+		apiKeys:       newMemoryAPIKeyStore(),
+		idempotency:   newMemoryIdempotencyStore(),
+		ledger:        env.ledger,
+		logger:        logger,
+		expiringCards: newExpiringCardsJob(client, time.Hour),
+		profiles:      newMemoryProfileIndex(),
+	}
+	env.handler = env.app.routes()
+
+	var err error
+	env.profileID, err = client.CreateCustomerProfile(authorizenet.CustomerProfile{
+		MerchantCustomerId: "CF-1001",
+		Email:              "ringer@example.com",
+		Description:        "Test ringer",
+	}, "testMode")
+	if err != nil {
+		t.Fatalf("seed profile: %v", err)
+	}
+	env.paymentProfileID, err = client.AddPaymentProfile(env.profileID, authorizenet.CreditCard{
+		CardNumber:     fakegateway.ApprovedCard,
+		ExpirationDate: "2030-12",
+	})
+	if err != nil {
+		t.Fatalf("seed payment profile: %v", err)
+	}
+	env.addressID, err = client.AddShippingAddress(env.profileID, authorizenet.ShippingAddress{
+		FirstName: "Ada", LastName: "Ringer", Address: "1 Bell St", City: "Tower", State: "MI", Zip: "49000", Country: "US",
+	})
+	if err != nil {
+		t.Fatalf("seed shipping address: %v", err)
+	}
+	return env
+}
+
+// breakGateway points the application at a gateway that is not listening.
+func (env *testEnv) breakGateway() {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	client := authorizenet.NewAPIClient("test-login", "test-key", srv.URL)
+	client.Logger = env.app.logger
+	env.app.client = client
+}
+
+// fetchHookGateway runs beforeFetch when a profile sync starts fetching profiles, after
+// it has listed their IDs.
+type fetchHookGateway struct {
+	PaymentGateway
+	beforeFetch, afterFetch func()
+}
+
+func (g fetchHookGateway) GetCustomerProfilesWithOptions(ids []string, opts authorizenet.FetchOptions) ([]authorizenet.CustomerProfile, error) {
+	if g.beforeFetch != nil {
+		g.beforeFetch()
+	}
+	profiles, err := g.PaymentGateway.GetCustomerProfilesWithOptions(ids, opts)
+	if g.afterFetch != nil {
+		g.afterFetch()
+	}
+	return profiles, err
+}
+
+// sync runs a full customer profile sync into the application's mirror.
+func (env *testEnv) sync() error {
+	return newProfileSyncJob(env.client, env.app.profiles, authorizenet.FetchOptions{Workers: 2}, time.Hour).Sync()
+}
+
+// addCard stores another card on the seeded profile and returns its payment profile ID.
+func (env *testEnv) addCard(number string) string {
+	env.t.Helper()
+	id, err := env.client.AddPaymentProfile(env.profileID, authorizenet.CreditCard{CardNumber: number, ExpirationDate: "2030-12"})
+	if err != nil {
+		env.t.Fatalf("add card %s: %v", number, err)
+	}
+	return id
+}
+
+func (env *testEnv) authorize(amount string) string {
+	env.t.Helper()
+	resp, err := env.client.AuthorizeCustomerProfile(env.profileID, env.paymentProfileID, amount)
+	if err != nil {
+		env.t.Fatalf("authorize: %v", err)
+	}
+	return resp.TransId
+}
+
+func (env *testEnv) do(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	env.t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testKey)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	env.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if rec.Code != want {
+		t.Fatalf("status = %d, want %d; body: %s", rec.Code, want, rec.Body.String())
+	}
+}
+
+func decodeBody[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decode response %q: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+func TestAuthentication(t *testing.T) {
+	env := newTestEnv(t)
+	profilePath := "/customer-profiles/" + env.profileID
+	charge := `{"profileId":"` + env.profileID + `","paymentProfileId":"` + env.paymentProfileID + `","amount":"10.00"}`
+
+	t.Run("missing key", func(t *testing.T) {
+		rec := env.do("GET", profilePath, "", "Authorization", "")
+		expectStatus(t, rec, http.StatusUnauthorized)
+		if rec.Header().Get("WWW-Authenticate") == "" {
+			t.Error("missing WWW-Authenticate header")
+		}
+	})
+	t.Run("unknown key", func(t *testing.T) {
+		expectStatus(t, env.do("GET", profilePath, "", "Authorization", "Bearer hbw_nope"), http.StatusUnauthorized)
+	})
+	t.Run("scope allows", func(t *testing.T) {
+		expectStatus(t, env.do("GET", profilePath, "", "Authorization", "Bearer "+testReaderKey), http.StatusOK)
+	})
+	t.Run("scope denies", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions", charge, "Authorization", "Bearer "+testReaderKey), http.StatusForbidden)
+		expectStatus(t, env.do("PUT", profilePath, `{"email":"x@example.com"}`, "Authorization", "Bearer "+testReaderKey), http.StatusForbidden)
+	})
+	t.Run("admin implies every scope", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions", charge, "Authorization", "Bearer "+testAdminKey), http.StatusCreated)
+	})
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := parseScopes(" charge, capture,charge ")
+	if err != nil || len(scopes) != 2 {
+		t.Errorf("scopes = %v, err = %v", scopes, err)
+	}
+	if _, err := parseScopes("charge,settle"); err == nil {
+		t.Error("unknown scope accepted")
+	}
+	if _, err := parseScopes(""); err == nil {
+		t.Error("empty scope list accepted")
+	}
+}
+
+func TestParseCertScopes(t *testing.T) {
+	scopes, err := parseCertScopes("CN=coldfusion,O=Handbell World=profiles:read,charge; CN=ops=admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := scopes["CN=coldfusion,O=Handbell World"]; len(got) != 2 || got[1] != scopeCharge {
+		t.Errorf("coldfusion scopes = %v", got)
+	}
+	if got := scopes["CN=ops"]; len(got) != 1 || got[0] != scopeAdmin {
+		t.Errorf("ops scopes = %v", got)
+	}
+	for _, spec := range []string{"CN=ops", "CN=ops=settle", "=admin"} {
+		if _, err := parseCertScopes(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
+
+// newTestCert issues a certificate for cn, signed by parent (self-signed when parent is nil).
+func newTestCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertificates(t *testing.T) {
+	env := newTestEnv(t)
+	ca := newTestCert(t, "Test CA", nil)
+	coldfusion := newTestCert(t, "coldfusion", &ca)
+	stranger := newTestCert(t, "stranger", &ca)
+	rogue := newTestCert(t, "coldfusion", nil)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	start := func(t *testing.T, require bool) *httptest.Server {
+		t.Helper()
+		env.app.config.ClientCerts = clientCertConfig{
+			CAFile:  caFile,
+			Require: require,
+			Scopes:  map[string][]string{"CN=coldfusion": {scopeProfilesRead}},
+		}
+		tlsConfig, err := env.app.config.ClientCerts.serverTLSConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewUnstartedServer(env.app.routes())
+		srv.TLS = tlsConfig
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	get := func(srv *httptest.Server, path string, cert *tls.Certificate) (*http.Response, error) {
+		// A fresh transport per request so no connection is reused with another certificate.
+		transport := srv.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		defer transport.CloseIdleConnections()
+		return (&http.Client{Transport: transport}).Get(srv.URL + path)
+	}
+
+	t.Run("optional", func(t *testing.T) {
+		srv := start(t, false)
+		for _, tc := range []struct {
+			name string
+			cert *tls.Certificate
+			path string
+			want int
+		}{
+			{"mapped subject", &coldfusion, "/customer-profiles/" + env.profileID, http.StatusOK},
+			{"mapped subject lacks scope", &coldfusion, "/merchant", http.StatusForbidden},
+			{"unmapped subject needs API key", &stranger, "/customer-profiles/" + env.profileID, http.StatusUnauthorized},
+			{"no certificate needs API key", nil, "/customer-profiles/" + env.profileID, http.StatusUnauthorized},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				resp, err := get(srv, tc.path, tc.cert)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tc.want {
+					t.Errorf("status = %d, want %d", resp.StatusCode, tc.want)
+				}
+			})
+		}
+		// Go clients only offer certificates issued by a CA the server asks for, so the
+		// rogue certificate is either withheld or rejected; it must never authenticate.
+		if resp, err := get(srv, "/customer-profiles/"+env.profileID, &rogue); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("certificate from an unknown CA: status = %d, want 401", resp.StatusCode)
+			}
+		}
+	})
+	t.Run("required", func(t *testing.T) {
+		srv := start(t, true)
+		if resp, err := get(srv, "/customer-profiles/"+env.profileID, nil); err == nil {
+			resp.Body.Close()
+			t.Error("connection without a client certificate was accepted")
+		}
+	})
+}
+
+func TestCreateCustomerProfile(t *testing.T) {
+	env := newTestEnv(t)
+
+	t.Run("success", func(t *testing.T) {
+		rec := env.do("POST", "/customer-profiles", `{"profile":{"merchantCustomerId":"CF-2002","email":"o\'brien@example.com","description":"New"}}`)
+		expectStatus(t, rec, http.StatusCreated)
+		body := decodeBody[map[string]string](t, rec)
+		profile, err := env.client.GetCustomerProfile(body["customerProfileId"])
+		if err != nil {
+			t.Fatalf("profile not created: %v", err)
+		}
+		if profile.Email != "o'brien@example.com" {
+			t.Errorf("escaped quote not sanitized: email = %q", profile.Email)
+		}
+	})
+	t.Run("malformed JSON", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/customer-profiles", `{"profile":`), http.StatusBadRequest)
+	})
+	t.Run("gateway rejects duplicate", func(t *testing.T) {
+		rec := env.do("POST", "/customer-profiles", `{"profile":{"merchantCustomerId":"CF-1001","email":"x@example.com"}}`)
+		expectStatus(t, rec, http.StatusInternalServerError)
+		if !strings.Contains(rec.Body.String(), "E00039") {
+			t.Errorf("expected duplicate error, got %s", rec.Body.String())
+		}
+	})
+}
+
+func TestGetCustomerProfile(t *testing.T) {
+	env := newTestEnv(t)
+
+	t.Run("success", func(t *testing.T) {
+		rec := env.do("GET", "/customer-profiles/"+env.profileID, "")
+		expectStatus(t, rec, http.StatusOK)
+		profile := decodeBody[authorizenet.CustomerProfile](t, rec)
+		if profile.Email != "ringer@example.com" || len(profile.PaymentProfiles) != 1 || len(profile.ShipToList) != 1 {
+			t.Errorf("unexpected profile %+v", profile)
+		}
+		if profile.PaymentProfiles[0].Payment.CreditCard.CardNumber != "XXXX1111" {
+			t.Errorf("card number not masked: %+v", profile.PaymentProfiles[0])
+		}
+	})
+	t.Run("unknown profile", func(t *testing.T) {
+		expectStatus(t, env.do("GET", "/customer-profiles/999", ""), http.StatusInternalServerError)
+	})
+	t.Run("gateway unavailable", func(t *testing.T) {
+		env.breakGateway()
+		expectStatus(t, env.do("GET", "/customer-profiles/"+env.profileID, ""), http.StatusInternalServerError)
+	})
+}
+
+func TestLookupCustomerProfile(t *testing.T) {
+	env := newTestEnv(t)
+
+	t.Run("by merchantCustomerId", func(t *testing.T) {
+		rec := env.do("GET", "/customer-profiles?merchantCustomerId=CF-1001", "")
+		expectStatus(t, rec, http.StatusOK)
+		if profile := decodeBody[authorizenet.CustomerProfile](t, rec); profile.CustomerProfileId != env.profileID {
+			t.Errorf("unexpected profile %+v", profile)
+		}
+	})
+	t.Run("by email", func(t *testing.T) {
+		rec := env.do("GET", "/customer-profiles?email=ringer@example.com", "")
+		expectStatus(t, rec, http.StatusOK)
+		if profile := decodeBody[authorizenet.CustomerProfile](t, rec); profile.CustomerProfileId != env.profileID {
+			t.Errorf("unexpected profile %+v", profile)
+		}
+	})
+	t.Run("unknown customer", func(t *testing.T) {
+		expectStatus(t, env.do("GET", "/customer-profiles?merchantCustomerId=CF-9999", ""), http.StatusNotFound)
+	})
+	t.Run("paging searches the index instead", func(t *testing.T) {
+		// The index has not been built yet, so a search is not ready.
+		expectStatus(t, env.do("GET", "/customer-profiles?merchantCustomerId=CF-1001&limit=1", ""), http.StatusServiceUnavailable)
+	})
+	t.Run("client lookup by email", func(t *testing.T) {
+		profile, err := env.client.GetCustomerProfileBy(authorizenet.ProfileLookup{Email: "RINGER@example.com"})
+		if err != nil || profile.CustomerProfileId != env.profileID {
+			t.Errorf("profile = %+v, err = %v", profile, err)
+		}
+	})
+	t.Run("gateway unavailable", func(t *testing.T) {
+		env.breakGateway()
+		expectStatus(t, env.do("GET", "/customer-profiles?merchantCustomerId=CF-1001", ""), http.StatusInternalServerError)
+	})
+}
+
+func TestGetAllCustomerProfiles(t *testing.T) {
+	env := newTestEnv(t)
+	if _, err := env.client.CreateCustomerProfile(authorizenet.CustomerProfile{MerchantCustomerId: "CF-1002", Email: "second@example.com"}, "testMode"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		rec := env.do("GET", "/customer-profiles", "")
+		expectStatus(t, rec, http.StatusOK)
+		if profiles := decodeBody[[]authorizenet.CustomerProfile](t, rec); len(profiles) != 2 || profiles[0].CustomerProfileId != env.profileID {
+			t.Errorf("unexpected profiles %+v", profiles)
+		}
+	})
+	t.Run("stream", func(t *testing.T) {
+		rec := env.do("GET", "/customer-profiles", "", "Accept", "application/x-ndjson")
+		expectStatus(t, rec, http.StatusOK)
+		if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("got %d lines, want 2: %s", len(lines), rec.Body.String())
+		}
+		var profile authorizenet.CustomerProfile
+		if err := json.Unmarshal([]byte(lines[1]), &profile); err != nil || profile.Email != "second@example.com" {
+			t.Errorf("unexpected second line %s (%v)", lines[1], err)
+		}
+	})
+	t.Run("stream reports gateway failure in-band", func(t *testing.T) {
+		env.breakGateway()
+		rec := env.do("GET", "/customer-profiles?stream=true", "")
+		expectStatus(t, rec, http.StatusOK)
+		if !strings.Contains(rec.Body.String(), `"error"`) {
+			t.Errorf("expected error line, got %s", rec.Body.String())
+		}
+	})
+	t.Run("gateway unavailable", func(t *testing.T) {
+		env.breakGateway()
+		expectStatus(t, env.do("GET", "/customer-profiles", ""), http.StatusInternalServerError)
+	})
+}
+
+func TestUpdateCustomerProfile(t *testing.T) {
+	env := newTestEnv(t)
+
+	t.Run("success", func(t *testing.T) {
+		expectStatus(t, env.do("PUT", "/customer-profiles/"+env.profileID, `{"email":"new@example.com","description":"Updated"}`), http.StatusOK)
+		profile, _ := env.client.GetCustomerProfile(env.profileID)
+		if profile.Email != "new@example.com" {
+			t.Errorf("email = %q", profile.Email)
+		}
+	})
+	t.Run("malformed JSON", func(t *testing.T) {
+		expectStatus(t, env.do("PUT", "/customer-profiles/"+env.profileID, `{"email":`), http.StatusBadRequest)
+	})
+	t.Run("unknown profile", func(t *testing.T) {
+		expectStatus(t, env.do("PUT", "/customer-profiles/999", `{"email":"a@example.com"}`), http.StatusInternalServerError)
+	})
+}
+
+func TestShippingAddresses(t *testing.T) {
+	env := newTestEnv(t)
+
+	t.Run("add", func(t *testing.T) {
+		rec := env.do("POST", "/customer-profiles/"+env.profileID+"/shipping-addresses", `{"address":{"firstName":"Bo","lastName":"Bell","address":"2 Peal Rd","city":"Chime","state":"OH","zip":"43000","country":"US"}}`)
+		expectStatus(t, rec, http.StatusCreated)
+		if decodeBody[map[string]string](t, rec)["customerAddressId"] == "" {
+			t.Error("missing customerAddressId")
+		}
+	})
+	t.Run("add malformed JSON", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/customer-profiles/"+env.profileID+"/shipping-addresses", `{"address":[`), http.StatusBadRequest)
+	})
+	t.Run("add to unknown profile", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/customer-profiles/999/shipping-addresses", `{"address":{"firstName":"Bo"}}`), http.StatusInternalServerError)
+	})
+	t.Run("delete", func(t *testing.T) {
+		expectStatus(t, env.do("DELETE", "/customer-profiles/"+env.profileID+"/shipping-addresses/"+env.addressID, ""), http.StatusOK)
+		profile, _ := env.client.GetCustomerProfile(env.profileID)
+		for _, addr := range profile.ShipToList {
+			if addr.CustomerAddressId == env.addressID {
+				t.Error("address still present after delete")
+			}
+		}
+	})
+	t.Run("delete with gateway unavailable", func(t *testing.T) {
+		env.breakGateway()
+		expectStatus(t, env.do("DELETE", "/customer-profiles/"+env.profileID+"/shipping-addresses/"+env.addressID, ""), http.StatusInternalServerError)
+	})
+}
+
+func TestPaymentProfiles(t *testing.T) {
+	env := newTestEnv(t)
+
+	t.Run("add", func(t *testing.T) {
+		rec := env.do("POST", "/customer-profiles/"+env.profileID+"/payment-profiles", `{"creditCard":{"cardNumber":"5424000000000015","expirationDate":"2029-04"}}`)
+		expectStatus(t, rec, http.StatusCreated)
+		if decodeBody[map[string]string](t, rec)["customerPaymentProfileId"] == "" {
+			t.Error("missing customerPaymentProfileId")
+		}
+	})
+	t.Run("add malformed JSON", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/customer-profiles/"+env.profileID+"/payment-profiles", `{"creditCard":`), http.StatusBadRequest)
+	})
+	t.Run("add invalid card", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/customer-profiles/"+env.profileID+"/payment-profiles", `{"creditCard":{"cardNumber":"12","expirationDate":"2029-04"}}`), http.StatusInternalServerError)
+	})
+	t.Run("update billing address", func(t *testing.T) {
+		expectStatus(t, env.do("PUT", "/customer-profiles/"+env.profileID+"/payment-profiles/"+env.paymentProfileID, `{"address":{"firstName":"Ada","lastName":"Ringer","address":"9 New St","city":"Tower","state":"MI","zip":"49001","country":"US"}}`), http.StatusOK)
+		profile, _ := env.client.GetCustomerProfile(env.profileID)
+		if billTo := profile.PaymentProfiles[0].BillTo; billTo == nil || billTo.Address != "9 New St" {
+			t.Errorf("billing address not updated: %+v", billTo)
+		}
+	})
+	t.Run("update billing address malformed JSON", func(t *testing.T) {
+		expectStatus(t, env.do("PUT", "/customer-profiles/"+env.profileID+"/payment-profiles/"+env.paymentProfileID, `{"address"`), http.StatusBadRequest)
+	})
+	t.Run("update billing address unknown payment profile", func(t *testing.T) {
+		expectStatus(t, env.do("PUT", "/customer-profiles/"+env.profileID+"/payment-profiles/999", `{"address":{"zip":"1"}}`), http.StatusInternalServerError)
+	})
+	t.Run("update payment profile", func(t *testing.T) {
+		body := `{"customerProfileId":"` + env.profileID + `","paymentProfileId":"` + env.paymentProfileID + `","payment":{"creditCard":{"cardNumber":"XXXX1111","expirationDate":"2031-01"}},"billTo":{"firstName":"Ada","zip":"49002"}}`
+		expectStatus(t, env.do("PUT", "/update-payment-profile", body), http.StatusOK)
+	})
+	t.Run("update payment profile malformed JSON", func(t *testing.T) {
+		expectStatus(t, env.do("PUT", "/update-payment-profile", `{"payment":`), http.StatusBadRequest)
+	})
+	t.Run("update payment profile unknown profile", func(t *testing.T) {
+		expectStatus(t, env.do("PUT", "/update-payment-profile", `{"customerProfileId":"999","paymentProfileId":"1"}`), http.StatusInternalServerError)
+	})
+	t.Run("delete", func(t *testing.T) {
+		id := env.addCard("6011000000000012")
+		expectStatus(t, env.do("DELETE", "/customer-profiles/"+env.profileID+"/payment-profiles/"+id, ""), http.StatusOK)
+	})
+	t.Run("delete unknown", func(t *testing.T) {
+		expectStatus(t, env.do("DELETE", "/customer-profiles/"+env.profileID+"/payment-profiles/999", ""), http.StatusInternalServerError)
+	})
+}
+
+func TestChargeCustomerProfile(t *testing.T) {
+	env := newTestEnv(t)
+
+	t.Run("success", func(t *testing.T) {
+		rec := env.do("POST", "/transactions", `{"profileId":"`+env.profileID+`","paymentProfileId":"`+env.paymentProfileID+`","amount":"25.00","invoiceNumber":"INV-1"}`)
+		expectStatus(t, rec, http.StatusCreated)
+		resp := decodeBody[ApiResponse](t, rec)
+		if !resp.IsSuccess || resp.Action != "authCaptureTransaction" || resp.Transaction == nil || resp.Transaction.TransId == "" {
+			t.Errorf("unexpected response %+v", resp)
+		}
+		if rec.Header().Get("X-Request-ID") == "" {
+			t.Error("missing X-Request-ID header")
+		}
+	})
+	t.Run("auth only", func(t *testing.T) {
+		rec := env.do("POST", "/transactions", `{"profileId":"`+env.profileID+`","paymentProfileId":"`+env.paymentProfileID+`","amount":"25.00","transactionType":"authOnlyTransaction"}`)
+		expectStatus(t, rec, http.StatusCreated)
+		resp := decodeBody[ApiResponse](t, rec)
+		if tx, _ := env.fake.Transaction(resp.Transaction.TransId); tx.Status != fakegateway.StatusAuthorized {
+			t.Errorf("status = %s, want %s", tx.Status, fakegateway.StatusAuthorized)
+		}
+	})
+	t.Run("declined", func(t *testing.T) {
+		rec := env.do("POST", "/transactions", `{"profileId":"`+env.profileID+`","paymentProfileId":"`+env.paymentProfileID+`","amount":"25.02"}`)
+		expectStatus(t, rec, http.StatusInternalServerError)
+		if resp := decodeBody[ApiResponse](t, rec); resp.IsSuccess {
+			t.Errorf("declined charge reported success: %+v", resp)
+		}
+	})
+	t.Run("malformed JSON", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions", `{"amount":`), http.StatusBadRequest)
+	})
+}
+
+func TestAuthorizeCustomerProfile(t *testing.T) {
+	env := newTestEnv(t)
+
+	t.Run("success", func(t *testing.T) {
+		rec := env.do("POST", "/transactions/authorize", `{"profileId":"`+env.profileID+`","paymentProfileId":"`+env.paymentProfileID+`","amount":"40.00"}`)
+		expectStatus(t, rec, http.StatusCreated)
+		if resp := decodeBody[ApiResponse](t, rec); !resp.IsSuccess || resp.Action != "AUTH_ONLY" {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	})
+	t.Run("declined card", func(t *testing.T) {
+		declined := env.addCard(fakegateway.DeclinedCard)
+		rec := env.do("POST", "/transactions/authorize", `{"profileId":"`+env.profileID+`","paymentProfileId":"`+declined+`","amount":"40.00"}`)
+		expectStatus(t, rec, http.StatusInternalServerError)
+	})
+	t.Run("AVS mismatch", func(t *testing.T) {
+		rec := env.do("POST", "/transactions/authorize", `{"profileId":"`+env.profileID+`","paymentProfileId":"`+env.paymentProfileID+`","amount":"40.27"}`)
+		expectStatus(t, rec, http.StatusInternalServerError)
+	})
+	t.Run("missing fields", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions/authorize", `{"profileId":"`+env.profileID+`"}`), http.StatusBadRequest)
+	})
+	t.Run("malformed JSON", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions/authorize", `not json`), http.StatusBadRequest)
+	})
+}
+
+func TestCapturePriorAuthTransaction(t *testing.T) {
+	env := newTestEnv(t)
+
+	t.Run("success updates order", func(t *testing.T) {
+		transId := env.authorize("30.00")
+		env.orders.Put(orders.Order{InvoiceNumber: "INV-30", TransactionNum: transId})
+
+		rec := env.do("POST", "/transactions/capture", `{"refTransId":"`+transId+`"}`)
+		expectStatus(t, rec, http.StatusCreated)
+		resp := decodeBody[ApiResponse](t, rec)
+		if !resp.IsSuccess || resp.Action != "priorAuthCaptureTransaction" {
+			t.Errorf("unexpected response %+v", resp)
+		}
+		order, err := env.orders.ByInvoice("INV-30")
+		if err != nil || order.TransactionNum != resp.Transaction.TransId || len(order.Results) != 1 {
+			t.Fatalf("order = %+v, err = %v", order, err)
+		}
+		if result := order.Results[0]; result.Operation != orders.Capture || result.RefTransId != transId || result.ResponseCode != "1" {
+			t.Errorf("unexpected capture result %+v", result)
+		}
+	})
+	t.Run("capture without an order", func(t *testing.T) {
+		transId := env.authorize("33.00")
+		expectStatus(t, env.do("POST", "/transactions/capture", `{"refTransId":"`+transId+`"}`), http.StatusCreated)
+		if pending, _ := env.outbox.Pending(0); len(pending) != 0 {
+			t.Errorf("unexpected outbox contents %+v", pending)
+		}
+	})
+	t.Run("unknown authorization", func(t *testing.T) {
+		rec := env.do("POST", "/transactions/capture", `{"refTransId":"999"}`)
+		expectStatus(t, rec, http.StatusInternalServerError)
+	})
+	t.Run("missing refTransId", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions/capture", `{"amount":"1.00"}`), http.StatusBadRequest)
+	})
+	t.Run("malformed JSON", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions/capture", `{"refTransId":`), http.StatusBadRequest)
+	})
+	t.Run("database failure after capture is queued", func(t *testing.T) {
+		transId := env.authorize("31.00")
+		env.orders.Put(orders.Order{InvoiceNumber: "INV-31", TransactionNum: transId})
+		env.orders.Err = errors.New("connection refused")
+
+		rec := env.do("POST", "/transactions/capture", `{"refTransId":"`+transId+`"}`)
+		expectStatus(t, rec, http.StatusCreated)
+		newTransId := decodeBody[ApiResponse](t, rec).Transaction.TransId
+		if tx, _ := env.fake.Transaction(transId); tx.Status != fakegateway.StatusCaptured {
+			t.Errorf("gateway status = %s, want captured", tx.Status)
+		}
+
+		pending, _ := env.outbox.Pending(1)
+		if len(pending) != 1 || pending[0].Result.RefTransId != transId || pending[0].LastError != "connection refused" {
+			t.Fatalf("unexpected outbox contents %+v", pending)
+		}
+		id := strconv.FormatInt(pending[0].ID, 10)
+
+		// Still failing: the worker counts another attempt.
+		expectStatus(t, env.do("POST", "/order-outbox/"+id+"/retry", "", "Authorization", "Bearer "+testAdminKey), http.StatusNoContent)
+		if n, err := env.app.drainOrderOutbox(); n != 0 || err != nil {
+			t.Errorf("drain = %d, %v; want nothing applied", n, err)
+		}
+		if pending, _ := env.outbox.Pending(2); len(pending) != 1 {
+			t.Errorf("expected a second failed attempt, got %+v", pending)
+		}
+
+		env.orders.Err = nil
+		expectStatus(t, env.do("POST", "/order-outbox/"+id+"/retry", "", "Authorization", "Bearer "+testAdminKey), http.StatusNoContent)
+		if n, err := env.app.drainOrderOutbox(); n != 1 || err != nil {
+			t.Errorf("drain = %d, %v; want one update applied", n, err)
+		}
+		if order, _ := env.orders.ByInvoice("INV-31"); order.TransactionNum != newTransId || len(order.Results) != 1 {
+			t.Errorf("order = %+v, want the capture recorded", order)
+		}
+		expectStatus(t, env.do("POST", "/order-outbox/"+id+"/retry", "", "Authorization", "Bearer "+testAdminKey), http.StatusNotFound)
+	})
+	t.Run("outbox and database both failing", func(t *testing.T) {
+		transId := env.authorize("32.00")
+		env.orders.Err = errors.New("connection refused")
+		env.outbox.err = errors.New("connection refused")
+		defer func() { env.orders.Err, env.outbox.err = nil, nil }()
+
+		rec := env.do("POST", "/transactions/capture", `{"refTransId":"`+transId+`"}`)
+		expectStatus(t, rec, http.StatusInternalServerError)
+		if !strings.Contains(rec.Body.String(), "CRITICAL") {
+			t.Errorf("expected critical message, got %s", rec.Body.String())
+		}
+	})
+}
+
+func TestOrderStatus(t *testing.T) {
+	env := newTestEnv(t)
+	payment := func(amount, invoice, transactionType string) string {
+		return `{"profileId":"` + env.profileID + `","paymentProfileId":"` + env.paymentProfileID +
+			`","amount":"` + amount + `","invoiceNumber":"` + invoice + `","transactionType":"` + transactionType + `"}`
+	}
+	transId := func(t *testing.T, rec *httptest.ResponseRecorder) string {
+		t.Helper()
+		expectStatus(t, rec, http.StatusCreated)
+		return decodeBody[ApiResponse](t, rec).Transaction.TransId
+	}
+	expectOrder := func(t *testing.T, invoice, transactionNum, status string, results int) {
+		t.Helper()
+		order, err := env.orders.ByInvoice(invoice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order.TransactionNum != transactionNum || order.Status != status || len(order.Results) != results {
+			t.Errorf("order = %+v, want transactionNum %s, status %s, %d results", order, transactionNum, status, results)
+		}
+	}
+
+	t.Run("authorize, capture, refund", func(t *testing.T) {
+		env.orders.Put(orders.Order{InvoiceNumber: "INV-50"})
+		auth := transId(t, env.do("POST", "/transactions/authorize", payment("50.00", "INV-50", "")))
+		expectOrder(t, "INV-50", auth, orders.StatusAuthorized, 1)
+
+		capture := transId(t, env.do("POST", "/transactions/capture", `{"refTransId":"`+auth+`"}`))
+		expectOrder(t, "INV-50", capture, orders.StatusCaptured, 2)
+
+		env.fake.Settle()
+		transId(t, env.do("POST", "/transactions/refund", `{"refTransId":"`+capture+`","amount":"50.00"}`))
+		expectOrder(t, "INV-50", capture, orders.StatusRefunded, 3)
+	})
+	t.Run("charge", func(t *testing.T) {
+		env.orders.Put(orders.Order{InvoiceNumber: "INV-51"})
+		charge := transId(t, env.do("POST", "/transactions", payment("51.00", "INV-51", "")))
+		expectOrder(t, "INV-51", charge, orders.StatusCaptured, 1)
+	})
+	t.Run("auth-only charge, then void", func(t *testing.T) {
+		env.orders.Put(orders.Order{InvoiceNumber: "INV-52"})
+		auth := transId(t, env.do("POST", "/transactions", payment("52.00", "INV-52", "authOnlyTransaction")))
+		expectOrder(t, "INV-52", auth, orders.StatusAuthorized, 1)
+
+		transId(t, env.do("POST", "/transactions/void", `{"refTransId":"`+auth+`"}`))
+		expectOrder(t, "INV-52", auth, orders.StatusVoided, 2)
+	})
+	t.Run("declined charge leaves the order alone", func(t *testing.T) {
+		env.orders.Put(orders.Order{InvoiceNumber: "INV-53"})
+		expectStatus(t, env.do("POST", "/transactions", payment("53.02", "INV-53", "")), http.StatusInternalServerError)
+		expectOrder(t, "INV-53", "", "", 0)
+	})
+	t.Run("charge for an unknown invoice still succeeds", func(t *testing.T) {
+		transId(t, env.do("POST", "/transactions", payment("54.00", "INV-404", "")))
+	})
+	t.Run("order database down", func(t *testing.T) {
+		env.orders.Put(orders.Order{InvoiceNumber: "INV-55"})
+		env.orders.Err = errors.New("connection refused")
+		env.outbox.err = errors.New("connection refused")
+		defer func() { env.orders.Err, env.outbox.err = nil, nil }()
+
+		rec := env.do("POST", "/transactions/authorize", payment("55.00", "INV-55", ""))
+		expectStatus(t, rec, http.StatusInternalServerError)
+		if !strings.Contains(rec.Body.String(), "CRITICAL") {
+			t.Errorf("expected critical message, got %s", rec.Body.String())
+		}
+	})
+}
+
+func TestGetOrder(t *testing.T) {
+	env := newTestEnv(t)
+	env.orders.Put(orders.Order{
+		InvoiceNumber:  "INV-7",
+		TransactionNum: "700",
+		Results:        []orders.Result{{Operation: orders.Auth, InvoiceNumber: "INV-7", TransId: "700", Amount: "7.00"}},
+	})
+	admin := []string{"Authorization", "Bearer " + testAdminKey}
+
+	for _, query := range []string{"invoiceNumber=INV-7", "transId=700"} {
+		t.Run(query, func(t *testing.T) {
+			rec := env.do("GET", "/orders?"+query, "", admin...)
+			expectStatus(t, rec, http.StatusOK)
+			if order := decodeBody[orders.Order](t, rec); order.InvoiceNumber != "INV-7" || len(order.Results) != 1 {
+				t.Errorf("unexpected order %+v", order)
+			}
+		})
+	}
+	t.Run("not found", func(t *testing.T) {
+		expectStatus(t, env.do("GET", "/orders?transId=999", "", admin...), http.StatusNotFound)
+	})
+	t.Run("needs exactly one key", func(t *testing.T) {
+		expectStatus(t, env.do("GET", "/orders", "", admin...), http.StatusBadRequest)
+		expectStatus(t, env.do("GET", "/orders?invoiceNumber=INV-7&transId=700", "", admin...), http.StatusBadRequest)
+	})
+	t.Run("database failure", func(t *testing.T) {
+		env.orders.Err = errors.New("connection refused")
+		defer func() { env.orders.Err = nil }()
+		expectStatus(t, env.do("GET", "/orders?invoiceNumber=INV-7", "", admin...), http.StatusInternalServerError)
+	})
+	t.Run("requires admin scope", func(t *testing.T) {
+		expectStatus(t, env.do("GET", "/orders?invoiceNumber=INV-7", ""), http.StatusForbidden)
+	})
+}
+
+func TestOrderOutboxAdmin(t *testing.T) {
+	env := newTestEnv(t)
+	env.outbox.Enqueue(OrderUpdate{Result: orders.Result{Operation: orders.Capture, RefTransId: "1", TransId: "2"}}, time.Now())
+	env.outbox.Enqueue(OrderUpdate{Result: orders.Result{Operation: orders.Capture, RefTransId: "3", TransId: "4"}}, time.Now())
+	for range orderOutboxStuckAttempts {
+		env.outbox.Failed(2, "relation \"header\" does not exist", time.Now())
+	}
+
+	t.Run("lists pending updates", func(t *testing.T) {
+		rec := env.do("GET", "/order-outbox", "", "Authorization", "Bearer "+testAdminKey)
+		expectStatus(t, rec, http.StatusOK)
+		if updates := decodeBody[[]OrderUpdate](t, rec); len(updates) != 2 {
+			t.Errorf("unexpected updates %+v", updates)
+		}
+	})
+	t.Run("stuck only", func(t *testing.T) {
+		rec := env.do("GET", "/order-outbox?stuck=true", "", "Authorization", "Bearer "+testAdminKey)
+		expectStatus(t, rec, http.StatusOK)
+		if updates := decodeBody[[]OrderUpdate](t, rec); len(updates) != 1 || updates[0].Result.RefTransId != "3" {
+			t.Errorf("unexpected updates %+v", updates)
+		}
+	})
+	t.Run("invalid stuck", func(t *testing.T) {
+		expectStatus(t, env.do("GET", "/order-outbox?stuck=maybe", "", "Authorization", "Bearer "+testAdminKey), http.StatusBadRequest)
+	})
+	t.Run("unknown id", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/order-outbox/99/retry", "", "Authorization", "Bearer "+testAdminKey), http.StatusNotFound)
+	})
+	t.Run("requires admin scope", func(t *testing.T) {
+		expectStatus(t, env.do("GET", "/order-outbox", ""), http.StatusForbidden)
+	})
+}
+
+func TestOrderOutboxBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 4: 4 * time.Minute, 20: time.Hour} {
+		if got := orderOutboxBackoff(attempts); got != want {
+			t.Errorf("orderOutboxBackoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	env := newTestEnv(t)
+	charge := func(amount string) string {
+		return `{"profileId":"` + env.profileID + `","paymentProfileId":"` + env.paymentProfileID + `","amount":"` + amount + `"}`
+	}
+	transId := func(t *testing.T, rec *httptest.ResponseRecorder) string {
+		t.Helper()
+		resp := decodeBody[ApiResponse](t, rec)
+		if resp.Transaction == nil {
+			t.Fatalf("no transaction in %s", rec.Body.String())
+		}
+		return resp.Transaction.TransId
+	}
+
+	t.Run("retry replays the original charge", func(t *testing.T) {
+		first := env.do("POST", "/transactions", charge("10.00"), "Idempotency-Key", "order-1")
+		expectStatus(t, first, http.StatusCreated)
+		retry := env.do("POST", "/transactions", charge("10.00"), "Idempotency-Key", "order-1")
+		expectStatus(t, retry, http.StatusCreated)
+
+		if retry.Header().Get("Idempotent-Replayed") != "true" {
+			t.Error("retry was not marked as replayed")
+		}
+		if a, b := transId(t, first), transId(t, retry); a != b {
+			t.Errorf("retry charged again: %s then %s", a, b)
+		}
+	})
+	t.Run("reuse for a different request", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions", charge("99.00"), "Idempotency-Key", "order-1"), http.StatusUnprocessableEntity)
+		expectStatus(t, env.do("POST", "/transactions/authorize", charge("10.00"), "Idempotency-Key", "order-1"), http.StatusUnprocessableEntity)
+	})
+	t.Run("original still in progress", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/transactions", nil)
+		env.app.idempotency.Begin("portal", "order-2", requestFingerprint(req, []byte(charge("12.00"))), time.Now().Add(time.Hour))
+		rec := env.do("POST", "/transactions", charge("12.00"), "Idempotency-Key", "order-2")
+		expectStatus(t, rec, http.StatusConflict)
+		if rec.Header().Get("Retry-After") == "" {
+			t.Error("missing Retry-After")
+		}
+	})
+	t.Run("client errors are not remembered", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions/authorize", `{"amount":"5.00"}`, "Idempotency-Key", "order-3"), http.StatusBadRequest)
+		expectStatus(t, env.do("POST", "/transactions/authorize", charge("5.00"), "Idempotency-Key", "order-3"), http.StatusCreated)
+	})
+	t.Run("declines are replayed", func(t *testing.T) {
+		first := env.do("POST", "/transactions", charge("10.02"), "Idempotency-Key", "order-4")
+		expectStatus(t, first, http.StatusInternalServerError)
+		retry := env.do("POST", "/transactions", charge("10.02"), "Idempotency-Key", "order-4")
+		expectStatus(t, retry, http.StatusInternalServerError)
+		if retry.Header().Get("Idempotent-Replayed") != "true" || retry.Body.String() != first.Body.String() {
+			t.Errorf("decline not replayed: %s", retry.Body.String())
+		}
+	})
+	t.Run("keys are scoped to the caller", func(t *testing.T) {
+		rec := env.do("POST", "/transactions", charge("10.00"), "Idempotency-Key", "order-1", "Authorization", "Bearer "+testAdminKey)
+		expectStatus(t, rec, http.StatusCreated)
+		if rec.Header().Get("Idempotent-Replayed") != "" {
+			t.Error("another caller's response was replayed")
+		}
+	})
+	t.Run("window expires", func(t *testing.T) {
+		env.app.config.IdempotencyWindow = time.Nanosecond
+		expectStatus(t, env.do("POST", "/transactions", charge("11.00"), "Idempotency-Key", "order-5"), http.StatusCreated)
+		time.Sleep(time.Millisecond)
+		rec := env.do("POST", "/transactions", charge("11.00"), "Idempotency-Key", "order-5")
+		expectStatus(t, rec, http.StatusCreated)
+		if rec.Header().Get("Idempotent-Replayed") != "" {
+			t.Error("expired key was replayed")
+		}
+	})
+	t.Run("panics are remembered as server errors", func(t *testing.T) {
+		env.app.config.IdempotencyWindow = time.Hour
+		calls := 0
+		handler := env.app.idempotent(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			panic("after the gateway call")
+		})
+		send := func() *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "/transactions", strings.NewReader(charge("13.00")))
+			req.Header.Set("Idempotency-Key", "order-6")
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			return rec
+		}
+
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("panic was swallowed")
+				}
+			}()
+			send()
+		}()
+		retry := send()
+		expectStatus(t, retry, http.StatusInternalServerError)
+		if calls != 1 || retry.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("retry after a panic ran the handler again (%d calls)", calls)
+		}
+	})
+	t.Run("capture", func(t *testing.T) {
+		env.app.config.IdempotencyWindow = time.Hour
+		body := `{"refTransId":"` + env.authorize("20.00") + `","amount":"20.00"}`
+		first := env.do("POST", "/transactions/capture", body, "Idempotency-Key", "capture-1")
+		expectStatus(t, first, http.StatusCreated)
+		retry := env.do("POST", "/transactions/capture", body, "Idempotency-Key", "capture-1")
+		expectStatus(t, retry, http.StatusCreated)
+		if retry.Header().Get("Idempotent-Replayed") != "true" {
+			t.Error("capture retry was not replayed")
+		}
+	})
+}
+
+func TestRefundTransaction(t *testing.T) {
+	env := newTestEnv(t)
+	capture := func(amount string) string {
+		transId := env.authorize(amount)
+		if _, err := env.client.CapturePriorAuthTransaction(transId, ""); err != nil {
+			t.Fatal(err)
+		}
+		return transId
+	}
+
+	t.Run("settled transaction", func(t *testing.T) {
+		transId := env.authorize("40.00")
+		env.orders.Put(orders.Order{InvoiceNumber: "INV-40", TransactionNum: transId})
+		expectStatus(t, env.do("POST", "/transactions/capture", `{"refTransId":"`+transId+`"}`), http.StatusCreated)
+		order, _ := env.orders.ByInvoice("INV-40")
+		transId = order.TransactionNum
+		env.fake.Settle()
+		rec := env.do("POST", "/transactions/refund", `{"refTransId":"`+transId+`","amount":"15.00"}`)
+		expectStatus(t, rec, http.StatusCreated)
+		resp := decodeBody[ApiResponse](t, rec)
+		if tx, _ := env.fake.Transaction(resp.Transaction.TransId); tx.Status != fakegateway.StatusRefunded || tx.RefTransId != transId {
+			t.Errorf("unexpected refund %+v", tx)
+		}
+		order, _ = env.orders.ByInvoice("INV-40")
+		if len(order.Results) != 2 || order.Results[1].Operation != orders.Refund || order.Results[1].Amount != "15.00" {
+			t.Errorf("order = %+v, want the refund recorded", order)
+		}
+	})
+	t.Run("unsettled transaction", func(t *testing.T) {
+		transId := capture("41.00")
+		rec := env.do("POST", "/transactions/refund", `{"refTransId":"`+transId+`","amount":"41.00"}`)
+		expectStatus(t, rec, http.StatusInternalServerError)
+		if !strings.Contains(rec.Body.String(), "criteria for issuing a credit") {
+			t.Errorf("expected the gateway's reason, got %s", rec.Body.String())
+		}
+	})
+	t.Run("missing fields", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions/refund", `{"refTransId":"1"}`), http.StatusBadRequest)
+	})
+	t.Run("requires refund scope", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions/refund", `{"refTransId":"1","amount":"1.00"}`, "Authorization", "Bearer "+testReaderKey), http.StatusForbidden)
+	})
+}
+
+func TestVoidTransaction(t *testing.T) {
+	env := newTestEnv(t)
+
+	t.Run("authorization", func(t *testing.T) {
+		transId := env.authorize("50.00")
+		expectStatus(t, env.do("POST", "/transactions/void", `{"refTransId":"`+transId+`"}`), http.StatusCreated)
+		if tx, _ := env.fake.Transaction(transId); tx.Status != fakegateway.StatusVoided {
+			t.Errorf("gateway status = %s, want voided", tx.Status)
+		}
+	})
+	t.Run("unknown transaction", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions/void", `{"refTransId":"999"}`), http.StatusInternalServerError)
+	})
+	t.Run("missing refTransId", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions/void", `{}`), http.StatusBadRequest)
+	})
+}
+
+func TestLedger(t *testing.T) {
+	env := newTestEnv(t)
+	charge := func(amount, invoice, transactionType string) *httptest.ResponseRecorder {
+		return env.do("POST", "/transactions", `{"profileId":"`+env.profileID+`","paymentProfileId":"`+env.paymentProfileID+
+			`","amount":"`+amount+`","invoiceNumber":"`+invoice+`","transactionType":"`+transactionType+`"}`)
+	}
+
+	expectStatus(t, charge("25.00", "INV-1", ""), http.StatusCreated)
+	expectStatus(t, charge("25.02", "INV-2", ""), http.StatusInternalServerError)
+	auth := decodeBody[ApiResponse](t, charge("60.00", "INV-3", "authOnlyTransaction")).Transaction.TransId
+	expectStatus(t, env.do("POST", "/transactions/capture", `{"refTransId":"`+auth+`","amount":"60.00"}`), http.StatusCreated)
+	env.fake.Settle()
+	expectStatus(t, env.do("POST", "/transactions/refund", `{"refTransId":"`+auth+`","amount":"10.00"}`), http.StatusCreated)
+
+	t.Run("every operation is recorded", func(t *testing.T) {
+		var ops []string
+		for _, e := range env.ledger.entries {
+			ops = append(ops, e.Operation)
+		}
+		if got := strings.Join(ops, ","); got != "charge,charge,auth,capture,refund" {
+			t.Errorf("operations = %s", got)
+		}
+		decline := env.ledger.entries[1]
+		if decline.Success || decline.Error == "" || decline.InvoiceNumber != "INV-2" {
+			t.Errorf("unexpected decline entry %+v", decline)
+		}
+		if decline.TransId == "" || decline.ResponseCode != "2" || decline.AvsResultCode != "Y" || decline.CvvResultCode != "P" {
+			t.Errorf("decline entry lost the gateway's result: %+v", decline)
+		}
+		for _, e := range env.ledger.entries {
+			if e.Caller != "portal" || e.RequestID == "" {
+				t.Errorf("entry missing caller or request ID: %+v", e)
+			}
+		}
+	})
+	t.Run("follow-ups inherit the invoice", func(t *testing.T) {
+		for _, e := range env.ledger.entries[3:] {
+			if e.InvoiceNumber != "INV-3" || e.CustomerProfileId != env.profileID || e.RefTransId != auth {
+				t.Errorf("unexpected entry %+v", e)
+			}
+		}
+	})
+	t.Run("query by transaction", func(t *testing.T) {
+		rec := env.do("GET", "/ledger?transId="+auth, "", "Authorization", "Bearer "+testAdminKey)
+		expectStatus(t, rec, http.StatusOK)
+		if resp := decodeBody[LedgerResponse](t, rec); resp.Total != 3 || resp.Entries[0].Operation != ledgerRefund {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	})
+	t.Run("query by invoice and operation", func(t *testing.T) {
+		rec := env.do("GET", "/ledger?invoiceNumber=INV-1&operation=charge", "", "Authorization", "Bearer "+testAdminKey)
+		expectStatus(t, rec, http.StatusOK)
+		if resp := decodeBody[LedgerResponse](t, rec); resp.Total != 1 || resp.Entries[0].Amount != "25.00" {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	})
+	t.Run("summary", func(t *testing.T) {
+		rec := env.do("GET", "/ledger/summary?from=2000-01-01", "", "Authorization", "Bearer "+testAdminKey)
+		expectStatus(t, rec, http.StatusOK)
+		summaries := decodeBody[[]LedgerSummary](t, rec)
+		if len(summaries) != 4 {
+			t.Fatalf("unexpected summaries %+v", summaries)
+		}
+		if charges := summaries[1]; charges.Operation != ledgerCharge || charges.Count != 2 || charges.Failed != 1 || charges.Amount != "25.00" {
+			t.Errorf("unexpected charge summary %+v", charges)
+		}
+	})
+	t.Run("invalid parameters", func(t *testing.T) {
+		for _, query := range []string{"operation=settle", "limit=0", "from=yesterday"} {
+			expectStatus(t, env.do("GET", "/ledger?"+query, "", "Authorization", "Bearer "+testAdminKey), http.StatusBadRequest)
+		}
+	})
+	t.Run("requires admin scope", func(t *testing.T) {
+		expectStatus(t, env.do("GET", "/ledger", ""), http.StatusForbidden)
+	})
+	t.Run("ledger failure does not fail the charge", func(t *testing.T) {
+		env.ledger.err = errors.New("connection refused")
+		defer func() { env.ledger.err = nil }()
+		expectStatus(t, charge("26.00", "INV-4", ""), http.StatusCreated)
+	})
+	t.Run("full capture records the authorized amount", func(t *testing.T) {
+		auth := decodeBody[ApiResponse](t, charge("70.00", "INV-6", "authOnlyTransaction")).Transaction.TransId
+		expectStatus(t, env.do("POST", "/transactions/capture", `{"refTransId":"`+auth+`"}`), http.StatusCreated)
+		if e := env.ledger.entries[len(env.ledger.entries)-1]; e.Operation != ledgerCapture || e.Amount != "70.00" || e.InvoiceNumber != "INV-6" {
+			t.Errorf("unexpected entry %+v", e)
+		}
+	})
+	t.Run("AVS decline keeps the gateway's codes", func(t *testing.T) {
+		expectStatus(t, charge("26.27", "INV-5", "authOnlyTransaction"), http.StatusInternalServerError)
+		e := env.ledger.entries[len(env.ledger.entries)-1]
+		if e.Success || e.Operation != ledgerAuth || e.TransId == "" || e.ResponseCode != "2" || e.AvsResultCode != "N" {
+			t.Errorf("unexpected entry %+v", e)
+		}
+	})
+}
+
+func TestCustomerTransactions(t *testing.T) {
+	env := newTestEnv(t)
+	transId := env.authorize("12.00")
+	env.orders.Put(orders.Order{InvoiceNumber: "INV-12", TransactionNum: transId})
+
+	t.Run("success merges invoice numbers", func(t *testing.T) {
+		rec := env.do("GET", "/customer-profiles/"+env.profileID+"/transactions?limit=10", "")
+		expectStatus(t, rec, http.StatusOK)
+		resp := decodeBody[CustomerTransactionsResponse](t, rec)
+		if resp.Total != 1 || len(resp.Transactions) != 1 || resp.Transactions[0].OrderInvoiceNumber != "INV-12" {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	})
+	t.Run("invalid limit", func(t *testing.T) {
+		expectStatus(t, env.do("GET", "/customer-profiles/"+env.profileID+"/transactions?limit=0", ""), http.StatusBadRequest)
+	})
+	t.Run("database failure still returns history", func(t *testing.T) {
+		env.orders.Err = errors.New("connection refused")
+		defer func() { env.orders.Err = nil }()
+
+		rec := env.do("GET", "/customer-profiles/"+env.profileID+"/transactions", "")
+		expectStatus(t, rec, http.StatusOK)
+		if resp := decodeBody[CustomerTransactionsResponse](t, rec); len(resp.Transactions) != 1 || resp.Transactions[0].OrderInvoiceNumber != "" {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	})
+	t.Run("unknown profile", func(t *testing.T) {
+		expectStatus(t, env.do("GET", "/customer-profiles/999/transactions", ""), http.StatusInternalServerError)
+	})
+}
+
+func TestSendTransactionReceipt(t *testing.T) {
+	env := newTestEnv(t)
+	transId := env.authorize("15.00")
+
+	t.Run("explicit email", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions/"+transId+"/receipt", `{"email":"other@example.com","header":"Thanks!"}`), http.StatusOK)
+		receipts := env.fake.Receipts()
+		if last := receipts[len(receipts)-1]; last.Email != "other@example.com" || last.Header != "Thanks!" {
+			t.Errorf("unexpected receipt %+v", last)
+		}
+	})
+	t.Run("falls back to profile email", func(t *testing.T) {
+		rec := env.do("POST", "/transactions/"+transId+"/receipt", `{}`)
+		expectStatus(t, rec, http.StatusOK)
+		if email := decodeBody[map[string]string](t, rec)["email"]; email != "ringer@example.com" {
+			t.Errorf("email = %q", email)
+		}
+	})
+	t.Run("malformed JSON", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions/"+transId+"/receipt", `{"email"`), http.StatusBadRequest)
+	})
+	t.Run("unknown transaction", func(t *testing.T) {
+		expectStatus(t, env.do("POST", "/transactions/999/receipt", `{"email":"a@example.com"}`), http.StatusInternalServerError)
+	})
+}
+
+func TestMerchantDetails(t *testing.T) {
+	env := newTestEnv(t)
+
+	t.Run("requires admin scope", func(t *testing.T) {
+		expectStatus(t, env.do("GET", "/merchant", ""), http.StatusForbidden)
+	})
+	t.Run("success", func(t *testing.T) {
+		rec := env.do("GET", "/merchant", "", "Authorization", "Bearer "+testAdminKey)
+		expectStatus(t, rec, http.StatusOK)
+		if details := decodeBody[authorizenet.MerchantDetails](t, rec); !details.IsTestMode || len(details.Currencies) == 0 {
+			t.Errorf("unexpected details %+v", details)
+		}
+	})
+	t.Run("gateway unavailable", func(t *testing.T) {
+		env.breakGateway()
+		expectStatus(t, env.do("GET", "/merchant", "", "Authorization", "Bearer "+testAdminKey), http.StatusInternalServerError)
+	})
+}
+
+func TestExpiringCards(t *testing.T) {
+	env := newTestEnv(t)
+
+	expectStatus(t, env.do("GET", "/payment-profiles/expiring", ""), http.StatusForbidden)
+	expectStatus(t, env.do("GET", "/payment-profiles/expiring", "", "Authorization", "Bearer "+testAdminKey), http.StatusServiceUnavailable)
+
+	env.app.expiringCards.report = &ExpiringCardsReport{Month: "2030-12", Cards: []ExpiringCard{{CustomerProfileID: env.profileID, Email: "ringer@example.com"}}}
+	rec := env.do("GET", "/payment-profiles/expiring", "", "Authorization", "Bearer "+testAdminKey)
+	expectStatus(t, rec, http.StatusOK)
+	if report := decodeBody[ExpiringCardsReport](t, rec); len(report.Cards) != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+func TestSearchCustomerProfiles(t *testing.T) {
+	env := newTestEnv(t)
+	for i, email := range []string{"choir@example.com", "CHOIR@example.com", "solo@example.com"} {
+		profile := authorizenet.CustomerProfile{MerchantCustomerId: "CF-20" + strconv.Itoa(i), Email: email, Description: "Handbell choir " + strconv.Itoa(i)}
+		if _, err := env.client.CreateCustomerProfile(profile, "testMode"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectStatus(t, env.do("GET", "/customer-profiles?limit=2", ""), http.StatusServiceUnavailable)
+
+	if err := env.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(t *testing.T, query string) ProfilePage {
+		t.Helper()
+		rec := env.do("GET", "/customer-profiles?"+query, "")
+		expectStatus(t, rec, http.StatusOK)
+		return decodeBody[ProfilePage](t, rec)
+	}
+
+	t.Run("email is case-insensitive", func(t *testing.T) {
+		if page := search(t, "email=choir@example.com&limit=10"); page.Total != 2 {
+			t.Errorf("total = %d, want 2", page.Total)
+		}
+	})
+	t.Run("merchantCustomerId", func(t *testing.T) {
+		page := search(t, "merchantCustomerId=CF-1001&limit=10")
+		if page.Total != 1 || page.Profiles[0].CustomerProfileId != env.profileID {
+			t.Errorf("unexpected page %+v", page)
+		}
+	})
+	t.Run("description substring", func(t *testing.T) {
+		if page := search(t, "description=CHOIR"); page.Total != 3 {
+			t.Errorf("total = %d, want 3", page.Total)
+		}
+	})
+	t.Run("cursor paging", func(t *testing.T) {
+		first := search(t, "limit=3")
+		if first.Total != 4 || len(first.Profiles) != 3 || first.NextCursor == "" {
+			t.Fatalf("unexpected first page %+v", first)
+		}
+		second := search(t, "limit=3&cursor="+first.NextCursor)
+		if len(second.Profiles) != 1 || second.NextCursor != "" {
+			t.Fatalf("unexpected second page %+v", second)
+		}
+		if second.Profiles[0].CustomerProfileId == first.Profiles[2].CustomerProfileId {
+			t.Error("second page repeats the first")
+		}
+	})
+	t.Run("offset", func(t *testing.T) {
+		if page := search(t, "limit=10&offset=3"); len(page.Profiles) != 1 || page.Offset != 3 {
+			t.Errorf("unexpected page %+v", page)
+		}
+	})
+	t.Run("invalid parameters", func(t *testing.T) {
+		expectStatus(t, env.do("GET", "/customer-profiles?limit=5000", ""), http.StatusBadRequest)
+		expectStatus(t, env.do("GET", "/customer-profiles?offset=-1", ""), http.StatusBadRequest)
+		expectStatus(t, env.do("GET", "/customer-profiles?cursor=!!!", ""), http.StatusBadRequest)
+	})
+}
+
+func TestProfileMirror(t *testing.T) {
+	env := newTestEnv(t)
+	if err := env.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Paging sends the query to the mirror rather than to the gateway lookup.
+	lookup := func(t *testing.T, query string) ProfilePage {
+		t.Helper()
+		rec := env.do("GET", "/customer-profiles?limit=10&"+query, "")
+		expectStatus(t, rec, http.StatusOK)
+		return decodeBody[ProfilePage](t, rec)
+	}
+
+	t.Run("full sync stores masked cards", func(t *testing.T) {
+		page := lookup(t, "email=ringer@example.com")
+		if page.Total != 1 || len(page.Profiles[0].PaymentProfiles) != 1 || len(page.Profiles[0].ShipToList) != 1 {
+			t.Fatalf("unexpected page %+v", page)
+		}
+		card := page.Profiles[0].PaymentProfiles[0].Payment.CreditCard
+		if card.CardNumber != "XXXX1111" || card.ExpirationDate != "" {
+			t.Errorf("card not masked: %+v", card)
+		}
+	})
+
+	t.Run("create is mirrored", func(t *testing.T) {
+		rec := env.do("POST", "/customer-profiles", `{"profile":{"merchantCustomerId":"CF-3001","email":"new@example.com","description":"New ringer"}}`)
+		expectStatus(t, rec, http.StatusCreated)
+		if page := lookup(t, "email=new@example.com"); page.Total != 1 {
+			t.Errorf("new profile not mirrored: %+v", page)
+		}
+	})
+
+	t.Run("update is mirrored", func(t *testing.T) {
+		rec := env.do("PUT", "/customer-profiles/"+env.profileID, `{"email":"changed@example.com","description":"Test ringer"}`)
+		expectStatus(t, rec, http.StatusOK)
+		if page := lookup(t, "email=changed@example.com"); page.Total != 1 {
+			t.Errorf("update not mirrored: %+v", page)
+		}
+	})
+
+	t.Run("payment profile add and delete are mirrored", func(t *testing.T) {
+		rec := env.do("POST", "/customer-profiles/"+env.profileID+"/payment-profiles",
+			`{"creditCard":{"cardNumber":"5424000000000015","expirationDate":"2031-01"}}`)
+		expectStatus(t, rec, http.StatusCreated)
+		id := decodeBody[map[string]string](t, rec)["customerPaymentProfileId"]
+
+		if page := lookup(t, "merchantCustomerId=CF-1001"); len(page.Profiles[0].PaymentProfiles) != 2 {
+			t.Fatalf("added card not mirrored: %+v", page)
+		}
+		expectStatus(t, env.do("DELETE", "/customer-profiles/"+env.profileID+"/payment-profiles/"+id, ""), http.StatusOK)
+		if page := lookup(t, "merchantCustomerId=CF-1001"); len(page.Profiles[0].PaymentProfiles) != 1 {
+			t.Errorf("deleted card still mirrored: %+v", page)
+		}
+	})
+
+	t.Run("shipping address delete is mirrored", func(t *testing.T) {
+		expectStatus(t, env.do("DELETE", "/customer-profiles/"+env.profileID+"/shipping-addresses/"+env.addressID, ""), http.StatusOK)
+		if page := lookup(t, "merchantCustomerId=CF-1001"); len(page.Profiles[0].ShipToList) != 0 {
+			t.Errorf("deleted address still mirrored: %+v", page)
+		}
+	})
+
+	t.Run("profiles created during a sync are kept", func(t *testing.T) {
+		gateway := fetchHookGateway{PaymentGateway: env.client, beforeFetch: func() {
+			rec := env.do("POST", "/customer-profiles", `{"profile":{"merchantCustomerId":"CF-3002","email":"during@example.com"}}`)
+			expectStatus(t, rec, http.StatusCreated)
+		}}
+		if err := newProfileSyncJob(gateway, env.app.profiles, authorizenet.FetchOptions{Workers: 2}, time.Hour).Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if page := lookup(t, "email=during@example.com"); page.Total != 1 {
+			t.Errorf("profile created during the sync was dropped: %+v", page)
+		}
+	})
+
+	t.Run("profiles updated during a sync keep the newer copy", func(t *testing.T) {
+		gateway := fetchHookGateway{PaymentGateway: env.client, afterFetch: func() {
+			rec := env.do("PUT", "/customer-profiles/"+env.profileID, `{"email":"changed@example.com","description":"Updated during sync"}`)
+			expectStatus(t, rec, http.StatusOK)
+		}}
+		if err := newProfileSyncJob(gateway, env.app.profiles, authorizenet.FetchOptions{Workers: 2}, time.Hour).Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if page := lookup(t, "merchantCustomerId=CF-1001"); page.Profiles[0].Description != "Updated during sync" {
+			t.Errorf("sync overwrote a newer copy: %+v", page)
+		}
+	})
+
+	t.Run("sync drops missing profiles and keeps unfetched ones", func(t *testing.T) {
+		mirror := env.app.profiles
+		if err := mirror.ReplaceAll(time.Now(), []string{env.profileID}, nil); err != nil {
+			t.Fatal(err)
+		}
+		page := lookup(t, "")
+		if page.Total != 1 || page.Profiles[0].Email != "changed@example.com" {
+			t.Errorf("unexpected page %+v", page)
+		}
+	})
+}
+
+func TestMigrations(t *testing.T) {
+	m, err := newMigrator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"header", "account_updater_events", "api_keys", "gateway_ledger", "idempotency_keys", "customer_profiles", "order_outbox"} {
+		found := false
+		for _, mig := range m.migrations {
+			found = found || strings.Contains(mig.Up, "CREATE TABLE IF NOT EXISTS "+table+" ")
+		}
+		if !found {
+			t.Errorf("no migration creates %s", table)
+		}
+	}
+
+	t.Run("plan up", func(t *testing.T) {
+		steps, err := m.plan(2, m.latest())
+		if err != nil || len(steps) != m.latest()-2 || steps[0].Version != 3 || !steps[0].up {
+			t.Errorf("steps = %+v, err = %v", steps, err)
+		}
+	})
+	t.Run("plan down", func(t *testing.T) {
+		steps, err := m.plan(3, 1)
+		if err != nil || len(steps) != 2 || steps[0].Version != 3 || steps[1].Version != 2 || steps[0].up {
+			t.Errorf("steps = %+v, err = %v", steps, err)
+		}
+	})
+	t.Run("database ahead of build", func(t *testing.T) {
+		if _, err := m.plan(m.latest()+1, m.latest()); err == nil {
+			t.Error("expected an error")
+		}
+	})
+	t.Run("target out of range", func(t *testing.T) {
+		if _, err := m.plan(0, m.latest()+1); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestLoadMigrationsRejectsBadSets(t *testing.T) {
+	for name, files := range map[string]fstest.MapFS{
+		"gap": {
+			"m/0001_a.up.sql": {Data: []byte("SELECT 1")}, "m/0001_a.down.sql": {Data: []byte("SELECT 1")},
+			"m/0003_c.up.sql": {Data: []byte("SELECT 1")}, "m/0003_c.down.sql": {Data: []byte("SELECT 1")},
+		},
+		"missing down": {"m/0001_a.up.sql": {Data: []byte("SELECT 1")}},
+		"name mismatch": {
+			"m/0001_a.up.sql": {Data: []byte("SELECT 1")}, "m/0001_b.down.sql": {Data: []byte("SELECT 1")},
+		},
+		"stray file": {"m/README.md": {Data: []byte("notes")}},
+	} {
+		if _, err := loadMigrations(files, "m"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "authnet.toml")
+	if err := os.WriteFile(file, []byte(`
+# Production settings
+[server]
+addr = ":8443"
+cors_origins = ["https://www.handbellworld.com", "https://handbellworld.com"]
+
+[authorizenet]
+environment = "production"
+login_id = "file-login"
+transaction_key = 'file-key'
+
+[idempotency]
+window = "1h"
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env := func(vars map[string]string) func(string) string {
+		return func(name string) string { return vars[name] }
+	}
+	required := map[string]string{"DB_DSN": "postgres://portal:secret@db/portal"}
+
+	t.Run("defaults", func(t *testing.T) {
+		cfg, args, err := loadConfig(nil, env(map[string]string{
+			"DB_DSN": "postgres://db", "AUTHORIZENET_NAME": "login", "AUTHORIZENET_TRANSACTION_KEY": "key",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Addr != ":1337" || cfg.TLSCertFile != "cert.pem" || len(cfg.CORSOrigins) != 1 || len(args) != 0 {
+			t.Errorf("unexpected config %+v, args %v", cfg, args)
+		}
+		if cfg.AuthNet.Endpoint != authorizenet.SandboxEndpoint || cfg.AuthNet.ValidationMode != "testMode" {
+			t.Errorf("unexpected gateway config %+v", cfg.AuthNet)
+		}
+		if cfg.ReadTimeout != 15*time.Second || cfg.WriteTimeout != 90*time.Second || cfg.ShutdownTimeout != 30*time.Second {
+			t.Errorf("unexpected timeouts %+v", cfg)
+		}
+	})
+	t.Run("file, then environment, then flags", func(t *testing.T) {
+		cfg, args, err := loadConfig(
+			[]string{"-config", file, "-server-addr", ":9443", "migrate", "up"},
+			env(map[string]string{"DB_DSN": required["DB_DSN"], "LISTEN_ADDR": ":7443", "IDEMPOTENCY_WINDOW": "2h"}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Addr != ":9443" || cfg.IdempotencyWindow != 2*time.Hour || cfg.AuthNet.LoginID != "file-login" || len(cfg.CORSOrigins) != 2 {
+			t.Errorf("unexpected config %+v", cfg)
+		}
+		if cfg.AuthNet.Endpoint != authorizenet.ProductionEndpoint || cfg.AuthNet.ValidationMode != "liveMode" {
+			t.Errorf("unexpected gateway config %+v", cfg.AuthNet)
+		}
+		if strings.Join(args, " ") != "migrate up" {
+			t.Errorf("args = %v", args)
+		}
+	})
+	t.Run("gateway credentials are only needed for gateway commands", func(t *testing.T) {
+		cfg, args, err := loadConfig([]string{"migrate", "up"}, env(required))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(args) != 2 || args[0] != "migrate" {
+			t.Errorf("args = %v", args)
+		}
+		err = cfg.requireGateway()
+		if err == nil || !strings.Contains(err.Error(), "authorizenet.login_id, authorizenet.transaction_key") {
+			t.Errorf("requireGateway() = %v", err)
+		}
+	})
+	t.Run("any environment but production is the sandbox", func(t *testing.T) {
+		cfg, _, err := loadConfig(nil, env(map[string]string{"DB_DSN": required["DB_DSN"], "AUTHORIZENET_ENVIRONMENT": "staging"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.AuthNet.Environment != "sandbox" || cfg.AuthNet.Endpoint != authorizenet.SandboxEndpoint || cfg.AuthNet.ValidationMode != "testMode" {
+			t.Errorf("unexpected gateway config %+v", cfg.AuthNet)
+		}
+	})
+	t.Run("config file from the environment", func(t *testing.T) {
+		cfg, _, err := loadConfig(nil, env(map[string]string{"CONFIG_FILE": file, "DB_DSN": required["DB_DSN"]}))
+		if err != nil || cfg.Addr != ":8443" {
+			t.Errorf("cfg = %+v, err = %v", cfg, err)
+		}
+	})
+	for name, tc := range map[string]struct {
+		args []string
+		vars map[string]string
+		want string
+	}{
+		"missing settings":    {nil, map[string]string{}, "missing required settings: database.dsn"},
+		"invalid environment": {[]string{"-config", file}, map[string]string{"DB_DSN": "x", "PROFILE_FETCH_WORKERS": "0"}, "PROFILE_FETCH_WORKERS must be a positive integer"},
+		"invalid flag":        {[]string{"-config", file, "-log-format", "xml"}, required, "-log-format must be json or text"},
+		"invalid origin":      {[]string{"-config", file, "-server-cors-origins", "handbellworld.com"}, required, "invalid origin"},
+		"invalid timeout":     {[]string{"-config", file, "-server-write-timeout", "0s"}, required, "-server-write-timeout must be a positive duration"},
+		"client cert scopes without a CA": {
+			[]string{"-config", file, "-client-certs-scopes", "CN=ops=admin"}, required, "need client_certs.ca_file",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := loadConfig(tc.args, env(tc.vars))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("err = %v, want it to mention %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	values, err := parseConfigFile(strings.NewReader(`
+log.level = "debug"  # top-level keys may be dotted
+[client_certs]
+required = true
+scopes = "CN=coldfusion=profiles:read,charge;CN=ops=admin"
+[profiles]
+fetch_rps = 2.5
+[server]
+cors_origins = ["https://a.example", 'https://b.example' ] # trailing comment
+tls_cert = "C:\\certs\\\u00e9t\u00e9.pem"
+[idempotency]
+window = '1h' 
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"log.level":             "debug",
+		"client_certs.required": "true",
+		"client_certs.scopes":   "CN=coldfusion=profiles:read,charge;CN=ops=admin",
+		"profiles.fetch_rps":    "2.5",
+		"server.cors_origins":   "https://a.example,https://b.example",
+		"server.tls_cert":       `C:\certs\été.pem`,
+		"idempotency.window":    "1h",
+	}
+	for key, v := range want {
+		if values[key] != v {
+			t.Errorf("%s = %q, want %q", key, values[key], v)
+		}
+	}
+
+	for bad, want := range map[string]string{
+		"[server\naddr = \":1\"":                 "line 1: unterminated section header",
+		"[server]\nport = 1337":                  "line 2: unknown setting server.port",
+		"[server]\naddr = \":1\"\naddr = \":2\"": "line 3: server.addr is set twice",
+		"[server]\naddr = :1337 # unquoted":      "line 2: server.addr: invalid value :1337",
+		"[server]\ncors_origins = [\"https://a.example\",\n\"https://b.example\"]": "line 2: server.cors_origins: arrays must be on one line",
+		"addr":                      "line 1: expected key = value",
+		"[[server]]\naddr = \":1\"": "line 1: arrays of tables are not supported",
+		"[server]\naddr = { host = \"\", port = 1 }":                             "line 2: server.addr: inline tables are not supported",
+		"[server]\n\naddr = \"\"\"\n:1\"\"\"":                                    "line 3: server.addr: multi-line strings are not supported",
+		"[server]\naddr = ''':1'''":                                              "line 2: server.addr: multi-line strings are not supported",
+		"[server]\naddr = \":1\" \":2\"":                                         "line 2: server.addr: unexpected \":2\" after the string",
+		"[server]\naddr = \"\\x41\"":                                             "line 2: server.addr: invalid escape \\x",
+		"[server]\naddr = [\":1\"]":                                              "line 2: server.addr takes a single value, not an array",
+		"[server]\ncors_origins = [[\"https://a.example\"]]":                     "line 2: server.cors_origins: array items must be one-line strings",
+		"[server]\ncors_origins = [\"https://a.example,https://b.example\"]":     "cannot contain a comma",
+		"[server]\ncors_origins = [\"https://a.example\" \"https://b.example\"]": "expected , or ]",
+		"[server]\n\"addr\" = \":1\"":                                            "line 2: invalid key",
+		"[\"server\"]\naddr = \":1\"":                                            "line 1: invalid section name",
+		"[log]\nlevel = 1979-05-27":                                              "line 2: log.level: invalid value 1979-05-27",
+	} {
+		_, err := parseConfigFile(strings.NewReader(bad))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseConfigFile(%q) = %v, want it to mention %q", bad, err, want)
+		}
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	cfg, _, err := loadConfig([]string{"-client-certs-ca-file", "ca.pem", "-client-certs-scopes", "CN=ops=admin;CN=cf=charge,capture"}, func(name string) string {
+		return map[string]string{
+			"DB_DSN": "postgres://portal:secret@db/portal", "AUTHORIZENET_NAME": "login", "AUTHORIZENET_TRANSACTION_KEY": "very-secret",
+		}[name]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := writeConfig(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "secret") {
+		t.Errorf("secrets printed:\n%s", out)
+	}
+	if !strings.Contains(out, "[authorizenet]\n") || !strings.Contains(out, `login_id = "login"`) || !strings.Contains(out, `transaction_key = "[REDACTED]"`) {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	// Apart from the secrets, the output reads back as the same configuration.
+	values, err := parseConfigFile(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["client_certs.scopes"] != "CN=cf=charge,capture;CN=ops=admin" || values["profiles.sync_interval"] != "15m0s" {
+		t.Errorf("unexpected values %v", values)
+	}
+}
+
+func TestServe(t *testing.T) {
+	cert := newTestCert(t, "localhost", nil)
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	// start serves a handler that blocks until release is closed, sends one request and
+	// cancels the server's context once the request is in flight.
+	start := func(t *testing.T, timeout time.Duration) (addr string, release chan struct{}, served, body chan error) {
+		started, release := make(chan struct{}), make(chan struct{})
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			io.WriteString(w, "captured")
+		})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		served = make(chan error, 1)
+		go func() {
+			served <- serve(ctx, newServer(defaultConfig(), handler, nil), ln, certFile, keyFile, timeout)
+		}()
+
+		body = make(chan error, 1)
+		go func() {
+			resp, err := client.Get("https://" + ln.Addr().String())
+			if err != nil {
+				body <- err
+				return
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			if err == nil && string(b) != "captured" {
+				err = fmt.Errorf("body = %q", b)
+			}
+			body <- err
+		}()
+		<-started
+		cancel()
+		return ln.Addr().String(), release, served, body
+	}
+
+	t.Run("drains in-flight requests", func(t *testing.T) {
+		addr, release, served, body := start(t, 5*time.Second)
+		select {
+		case err := <-served:
+			t.Fatalf("serve returned %v with a request in flight", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(release)
+		if err := <-body; err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+		}
+		if err := <-served; err != nil {
+			t.Errorf("serve = %v", err)
+		}
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Error("still accepting connections after shutdown")
+		}
+	})
+	t.Run("cuts off requests at the deadline", func(t *testing.T) {
+		_, release, served, body := start(t, 50*time.Millisecond)
+		defer close(release)
+		if err := <-served; !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("serve = %v, want the deadline error", err)
+		}
+		if err := <-body; err == nil {
+			t.Error("request still succeeded after the deadline")
+		}
+	})
+}
+
+func TestWorkersStopWithContext(t *testing.T) {
+	env := newTestEnv(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		env.app.runOrderOutbox(ctx, time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("order outbox worker still running after cancel")
+	}
+}
+
+// recordingConnector is a database/sql connector that records every statement and answers
+// queries from rows, so query arguments and scanning can be checked without Postgres.
+type recordingConnector struct {
+	mu         sync.Mutex
+	statements []recordedStatement
+	rows       func(query string) [][]driver.Value
+}
+
+type recordedStatement struct {
+	query string
+	args  []driver.Value
+}
+
+func (c *recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	return recordingConn{c}, nil
+}
+func (c *recordingConnector) Driver() driver.Driver { return nil }
+
+// find returns the first recorded statement containing fragment.
+func (c *recordingConnector) find(t *testing.T, fragment string) recordedStatement {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.statements {
+		if strings.Contains(s.query, fragment) {
+			return s
+		}
+	}
+	t.Fatalf("no statement containing %q", fragment)
+	return recordedStatement{}
+}
+
+type recordingConn struct{ c *recordingConnector }
+
+func (conn recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return recordingStmt{conn.c, query}, nil
+}
+func (conn recordingConn) Close() error              { return nil }
+func (conn recordingConn) Begin() (driver.Tx, error) { return recordingTx{}, nil }
+
+type recordingTx struct{}
+
+func (recordingTx) Commit() error   { return nil }
+func (recordingTx) Rollback() error { return nil }
+
+type recordingStmt struct {
+	c     *recordingConnector
+	query string
+}
+
+func (s recordingStmt) Close() error  { return nil }
+func (s recordingStmt) NumInput() int { return -1 }
+
+func (s recordingStmt) record(args []driver.Value) {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	s.c.statements = append(s.c.statements, recordedStatement{s.query, args})
+}
+
+func (s recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.record(args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.record(args)
+	var rows [][]driver.Value
+	if s.c.rows != nil {
+		rows = s.c.rows(s.query)
+	}
+	return &recordingRows{rows: rows}, nil
+}
+
+type recordingRows struct {
+	rows [][]driver.Value
+}
+
+func (r *recordingRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+func (r *recordingRows) Close() error { return nil }
+
+func (r *recordingRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// placeholders is the highest $N in query.
+func placeholders(query string) int {
+	highest := 0
+	for _, m := range regexp.MustCompile(`\$(\d+)`).FindAllStringSubmatch(query, -1) {
+		n, _ := strconv.Atoi(m[1])
+		highest = max(highest, n)
+	}
+	return highest
+}
+
+func TestPostgresProfileMirrorStatements(t *testing.T) {
+	var syncedAt time.Time
+	conn := &recordingConnector{rows: func(query string) [][]driver.Value {
+		switch {
+		case strings.Contains(query, "FROM customer_profile_sync"):
+			if syncedAt.IsZero() {
+				return nil
+			}
+			return [][]driver.Value{{syncedAt}}
+		case strings.Contains(query, "count(*)"):
+			return [][]driver.Value{{int64(3)}}
+		case strings.Contains(query, "FROM customer_profiles"):
+			// One more row than the limit of 1, so the page gets a cursor.
+			return [][]driver.Value{
+				{"43", "CF-43", "choir@example.com", "50% off", "regular"},
+				{"44", "CF-44", "choir@example.com", "50% off", "regular"},
+			}
+		case strings.Contains(query, "FROM customer_payment_profiles"):
+			return [][]driver.Value{{"43", "430", "individual", "XXXX1111", []byte(`{"zip":"90210"}`)}}
+		}
+		return nil
+	}}
+	mirror := &postgresProfileMirror{db: sql.OpenDB(conn)}
+
+	if _, err := mirror.Search(ProfileQuery{Limit: 1}); !errors.Is(err, errIndexNotReady) {
+		t.Fatalf("search before the first sync: err = %v, want errIndexNotReady", err)
+	}
+	syncedAt = time.Now()
+
+	page, err := mirror.Search(ProfileQuery{Email: "choir@example.com", Description: `50%_\`, Limit: 1, Offset: 5, Cursor: encodeCursor("42")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.Profiles) != 1 || page.Profiles[0].CustomerProfileId != "43" || page.NextCursor != encodeCursor("43") || page.Offset != 0 {
+		t.Errorf("unexpected page %+v", page)
+	}
+	if pp := page.Profiles[0].PaymentProfiles; len(pp) != 1 || pp[0].BillTo == nil || pp[0].BillTo.Zip != "90210" {
+		t.Errorf("payment profiles not loaded: %+v", pp)
+	}
+
+	count := conn.find(t, "count(*)")
+	if want := []driver.Value{"choir@example.com", "", `50\%\_\\`}; !slices.Equal(count.args, want) {
+		t.Errorf("count args = %q, want %q", count.args, want)
+	}
+	pageQuery := conn.find(t, "ORDER BY length(customer_profile_id)")
+	// The cursor replaces the offset, and one extra row is asked for to detect a next page.
+	if want := []driver.Value{"choir@example.com", "", `50\%\_\\`, "42", int64(2), int64(0)}; !slices.Equal(pageQuery.args, want) {
+		t.Errorf("page args = %q, want %q", pageQuery.args, want)
+	}
+
+	started := time.Now()
+	if err := mirror.ReplaceAll(started, []string{"43"}, []authorizenet.CustomerProfile{{
+		CustomerProfileId: "43",
+		PaymentProfiles:   []authorizenet.PaymentProfile{{CustomerPaymentProfileId: "430", Payment: authorizenet.Payment{CreditCard: authorizenet.CreditCard{CardNumber: "4111111111111111", ExpirationDate: "2030-12"}}}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if card := conn.find(t, "INSERT INTO customer_payment_profiles"); card.args[3] != "XXXX1111" {
+		t.Errorf("card stored unmasked: %q", card.args[3])
+	}
+	if del := conn.find(t, "DELETE FROM customer_profiles"); len(del.args) != 2 || del.args[1] != started {
+		t.Errorf("delete args = %v, want the sync start", del.args)
+	}
+	// The fetched copy only replaces a profile last saved before the sync started.
+	if upsert := conn.find(t, "INSERT INTO customer_profiles"); upsert.args[6] != started {
+		t.Errorf("upsert args = %v, want the sync start last", upsert.args)
+	}
+	if state := conn.find(t, "INSERT INTO customer_profile_sync"); state.args[0] != started {
+		t.Errorf("sync state args = %v, want the sync start first", state.args)
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for _, s := range conn.statements {
+		if n := placeholders(s.query); n != len(s.args) {
+			t.Errorf("%d placeholders but %d args in %s", n, len(s.args), s.query)
+		}
+	}
+}
+
+// testDatabase opens the Postgres database named by AUTHNET_TEST_DSN and migrates it to
+// the latest version, skipping the test when the variable is unset. Tests may delete
+// anything in it.
+func testDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("AUTHNET_TEST_DSN")
+	if dsn == "" {
+		t.Skip("AUTHNET_TEST_DSN is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := newMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.migrateTo(m.latest()); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPostgresProfileMirror(t *testing.T) {
+	db := testDatabase(t)
+	if _, err := db.Exec(`TRUNCATE customer_profiles, customer_profile_sync CASCADE`); err != nil {
+		t.Fatal(err)
+	}
+	mirror := &postgresProfileMirror{db: db}
+
+	if _, err := mirror.Search(ProfileQuery{Limit: 10}); !errors.Is(err, errIndexNotReady) {
+		t.Fatalf("search before the first sync: err = %v, want errIndexNotReady", err)
+	}
+	// A new mirror finds the completed sync in the database.
+	defer func() {
+		if _, err := (&postgresProfileMirror{db: db}).Search(ProfileQuery{Limit: 10}); err != nil {
+			t.Errorf("search after a sync: %v", err)
+		}
+	}()
+
+	card := func(id, number string) []authorizenet.PaymentProfile {
+		return []authorizenet.PaymentProfile{{
+			CustomerPaymentProfileId: id,
+			Payment:                  authorizenet.Payment{CreditCard: authorizenet.CreditCard{CardNumber: number, ExpirationDate: "2030-12"}},
+		}}
+	}
+	err := mirror.ReplaceAll(time.Now(), []string{"1", "2", "10", "11"}, []authorizenet.CustomerProfile{
+		{CustomerProfileId: "1", MerchantCustomerId: "CF-1", Email: "Choir@example.com", Description: "Handbell choir", PaymentProfiles: card("101", "4111111111111111")},
+		{CustomerProfileId: "2", MerchantCustomerId: "CF-2", Email: "solo@example.com", Description: "50% off"},
+		{CustomerProfileId: "10", MerchantCustomerId: "CF-10", Email: "choir@example.com", Description: "Handbell choir 2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(t *testing.T, q ProfileQuery) *ProfilePage {
+		t.Helper()
+		if q.Limit == 0 {
+			q.Limit = 10
+		}
+		page, err := mirror.Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+	ids := func(page *ProfilePage) string {
+		var ids []string
+		for _, p := range page.Profiles {
+			ids = append(ids, p.CustomerProfileId)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	t.Run("email is case-insensitive and cards are masked", func(t *testing.T) {
+		page := search(t, ProfileQuery{Email: "CHOIR@example.com"})
+		if page.Total != 2 || ids(page) != "1,10" {
+			t.Fatalf("unexpected page %+v", page)
+		}
+		if c := page.Profiles[0].PaymentProfiles[0].Payment.CreditCard; c.CardNumber != "XXXX1111" || c.ExpirationDate != "" {
+			t.Errorf("card not masked: %+v", c)
+		}
+	})
+	t.Run("merchant customer ID", func(t *testing.T) {
+		if page := search(t, ProfileQuery{MerchantCustomerId: "CF-10"}); ids(page) != "10" {
+			t.Errorf("unexpected page %+v", page)
+		}
+	})
+	t.Run("description wildcards are literal", func(t *testing.T) {
+		if page := search(t, ProfileQuery{Description: "%"}); ids(page) != "2" {
+			t.Errorf("unexpected page %+v", page)
+		}
+		if page := search(t, ProfileQuery{Description: "CHOIR"}); page.Total != 2 {
+			t.Errorf("unexpected page %+v", page)
+		}
+	})
+	t.Run("cursor pages in numeric order", func(t *testing.T) {
+		first := search(t, ProfileQuery{Limit: 2})
+		if ids(first) != "1,2" || first.NextCursor == "" {
+			t.Fatalf("unexpected first page %+v", first)
+		}
+		if next := search(t, ProfileQuery{Limit: 2, Cursor: first.NextCursor}); ids(next) != "10" || next.NextCursor != "" {
+			t.Errorf("unexpected next page %+v", next)
+		}
+		if offset := search(t, ProfileQuery{Limit: 2, Offset: 1}); ids(offset) != "2,10" {
+			t.Errorf("unexpected offset page %+v", offset)
+		}
+	})
+	t.Run("sync keeps unfetched profiles and ones saved after it started", func(t *testing.T) {
+		started := time.Now()
+		if err := mirror.SaveProfile(authorizenet.CustomerProfile{CustomerProfileId: "20", Email: "during@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mirror.ReplaceAll(started, []string{"1", "2"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if page := search(t, ProfileQuery{}); ids(page) != "1,2,20" {
+			t.Errorf("unexpected page %+v", page)
+		}
+	})
+	t.Run("sync keeps a copy saved after it started", func(t *testing.T) {
+		started := time.Now()
+		if err := mirror.SaveProfile(authorizenet.CustomerProfile{CustomerProfileId: "1", Email: "newer@example.com", PaymentProfiles: card("102", "5424000000000015")}); err != nil {
+			t.Fatal(err)
+		}
+		fetched := authorizenet.CustomerProfile{CustomerProfileId: "1", Email: "older@example.com", PaymentProfiles: card("101", "4111111111111111")}
+		if err := mirror.ReplaceAll(started, []string{"1", "2", "20"}, []authorizenet.CustomerProfile{fetched}); err != nil {
+			t.Fatal(err)
+		}
+		page := search(t, ProfileQuery{Email: "newer@example.com"})
+		if ids(page) != "1" || page.Profiles[0].PaymentProfiles[0].CustomerPaymentProfileId != "102" {
+			t.Errorf("sync overwrote a newer copy: %+v", page)
+		}
+	})
+}
+
+func TestAUOutcome(t *testing.T) {
+	for _, tc := range []struct {
+		changeType, reasonCode string
+		outcome                string
+		needsContact           bool
+	}{
+		{"update", authorizenet.AUNewAccountNumber, "updated", false},
+		{"update", authorizenet.AUNewExpirationDate, "expiration-updated", false},
+		{"update", authorizenet.AUAccountClosed, "closed", true},
+		{"update", authorizenet.AUContactCardholder, "contact-cardholder", true},
+		{"update", "XYZ", "unknown", true},
+		{"delete", authorizenet.AUNewAccountNumber, "deleted", true},
+	} {
+		outcome, needsContact := auOutcome(tc.changeType, tc.reasonCode)
+		if outcome != tc.outcome || needsContact != tc.needsContact {
+			t.Errorf("auOutcome(%s, %s) = %s, %v, want %s, %v", tc.changeType, tc.reasonCode, outcome, needsContact, tc.outcome, tc.needsContact)
+		}
+	}
+}
+
+func TestAUReport(t *testing.T) {
+	env := newTestEnv(t)
+	// One more change than runAUReport's page size, so the report needs a second page.
+	for i := range 1001 {
+		change := authorizenet.AUChange{
+			CustomerProfileId:        env.profileID,
+			CustomerPaymentProfileId: strconv.Itoa(1000 + i),
+			UpdateTimeUTC:            "2026-09-14T10:00:00Z",
+			AuReasonCode:             authorizenet.AUNewExpirationDate,
+			ReasonDescription:        "New Expiration Date",
+			OldCreditCard:            &authorizenet.MaskedCreditCard{CardNumber: "XXXX1111", ExpirationDate: "XXXX"},
+			NewCreditCard:            &authorizenet.MaskedCreditCard{CardNumber: "XXXX1111", ExpirationDate: "XXXX"},
+		}
+		if i == 1000 {
+			change.AuReasonCode, change.ReasonDescription = authorizenet.AUAccountClosed, "Account Closed"
+		}
+		env.fake.AddAUChange("2026-09", false, change)
+	}
+	env.fake.AddAUChange("2026-09", true, authorizenet.AUChange{CustomerProfileId: env.profileID, CustomerPaymentProfileId: "999", AuReasonCode: authorizenet.AUContactCardholder})
+
+	t.Run("summary", func(t *testing.T) {
+		summary, err := env.client.GetAUJobSummary("2026-09")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(summary) != 3 || summary[0].AuReasonCode != authorizenet.AUNewExpirationDate || summary[0].ProfileCount != 1000 {
+			t.Errorf("unexpected summary %+v", summary)
+		}
+	})
+	t.Run("records every page", func(t *testing.T) {
+		conn := &recordingConnector{}
+		if err := runAUReport(env.client, sql.OpenDB(conn), []string{"-month", "2026-09"}); err != nil {
+			t.Fatal(err)
+		}
+		contact := 0
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		for _, s := range conn.statements {
+			if needsContact, _ := s.args[12].(bool); needsContact {
+				contact++
+			}
+		}
+		if len(conn.statements) != 1002 || contact != 2 {
+			t.Errorf("recorded %d changes, %d needing contact; want 1002 and 2", len(conn.statements), contact)
+		}
+	})
+	t.Run("invalid month", func(t *testing.T) {
+		if err := runAUReport(env.client, nil, []string{"-month", "September"}); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
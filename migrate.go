@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Migrations are numbered from 1 without gaps; each has an up and a down file:
+//
+//	migrations/0008_add_something.up.sql
+//	migrations/0008_add_something.down.sql
+//
+// Released migrations are never edited; changes go in a new one.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock held while migrating, so two instances starting
+// together don't apply the same migration twice.
+const migrationLockID = 7236201
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// loadMigrations reads the migrations in dir, ordered by version.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		m := migrationName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected file %s in migrations, expected NNNN_name.up.sql or NNNN_name.down.sql", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		body, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for version := 1; version <= len(byVersion); version++ {
+		mig, ok := byVersion[version]
+		if !ok {
+			return nil, fmt.Errorf("migration %d is missing", version)
+		}
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %d (%s) needs both an up and a down file", version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	return migrations, nil
+}
+
+// migrator applies migrations to a database, recording each in schema_migrations.
+type migrator struct {
+	db         *sql.DB
+	migrations []migration
+}
+
+func newMigrator(db *sql.DB) (*migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{db: db, migrations: migrations}, nil
+}
+
+// latest is the version the code expects.
+func (m *migrator) latest() int {
+	return len(m.migrations)
+}
+
+// current returns the highest applied version, 0 for an unmigrated database.
+func (m *migrator) current() (int, error) {
+	if _, err := m.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`); err != nil {
+		return 0, err
+	}
+	var version int
+	err := m.db.QueryRow(`SELECT COALESCE(max(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// migrationStep is one migration to run in one direction.
+type migrationStep struct {
+	migration
+	up bool
+}
+
+// plan lists the steps that move the schema from version current to target.
+func (m *migrator) plan(current, target int) ([]migrationStep, error) {
+	if target < 0 || target > m.latest() {
+		return nil, fmt.Errorf("target version %d out of range 0-%d", target, m.latest())
+	}
+	if current > m.latest() {
+		return nil, fmt.Errorf("database is at version %d, newer than this build's %d", current, m.latest())
+	}
+	var steps []migrationStep
+	for v := current + 1; v <= target; v++ {
+		steps = append(steps, migrationStep{m.migrations[v-1], true})
+	}
+	for v := current; v > target; v-- {
+		steps = append(steps, migrationStep{m.migrations[v-1], false})
+	}
+	return steps, nil
+}
+
+// migrateTo moves the schema to target, one transaction per migration.
+func (m *migrator) migrateTo(target int) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	current, err := m.current()
+	if err != nil {
+		return fmt.Errorf("cannot read schema version: %v", err)
+	}
+	steps, err := m.plan(current, target)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		slog.Info("Schema is up to date", "version", current)
+		return nil
+	}
+
+	for _, step := range steps {
+		started := time.Now()
+		if err := m.apply(step); err != nil {
+			return err
+		}
+		direction := "up"
+		if !step.up {
+			direction = "down"
+		}
+		slog.Info("Applied migration", "version", step.Version, "name", step.Name, "direction", direction, "latency", time.Since(started))
+	}
+	return nil
+}
+
+func (m *migrator) apply(step migrationStep) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	body := step.Down
+	record, args := `DELETE FROM schema_migrations WHERE version = $1`, []any{step.Version}
+	if step.up {
+		body = step.Up
+		record, args = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, []any{step.Version, step.Name}
+	}
+	if _, err := tx.Exec(body); err != nil {
+		return fmt.Errorf("migration %d (%s) failed: %v", step.Version, step.Name, err)
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkSchema refuses to run against a database that hasn't been migrated to this build.
+func checkSchema(db *sql.DB) error {
+	m, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+	current, err := m.current()
+	if err != nil {
+		return fmt.Errorf("cannot read schema version: %v", err)
+	}
+	if current < m.latest() {
+		return fmt.Errorf("database schema is behind: at version %d, need %d; run `authnet migrate up`", current, m.latest())
+	}
+	if current > m.latest() {
+		slog.Warn("Database schema is newer than this build", "version", current, "expected", m.latest())
+	}
+	return nil
+}
+
+// runMigrateCommand implements the migrate subcommand:
+//
+//	authnet migrate up [-to N]
+//	authnet migrate down [-to N]
+//	authnet migrate status
+//
+// up migrates to the latest version by default; down rolls back one version.
+func runMigrateCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down|status")
+	}
+	m, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	to := flags.Int("to", -1, "target version")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		target := m.latest()
+		if *to >= 0 {
+			target = *to
+		}
+		current, err := m.current()
+		if err != nil {
+			return err
+		}
+		if target < current {
+			return fmt.Errorf("target version %d is below the current %d; use migrate down", target, current)
+		}
+		return m.migrateTo(target)
+
+	case "down":
+		current, err := m.current()
+		if err != nil {
+			return err
+		}
+		target := current - 1
+		if *to >= 0 {
+			target = *to
+		}
+		if target > current {
+			return fmt.Errorf("target version %d is above the current %d; use migrate up", target, current)
+		}
+		if current == 0 {
+			return errors.New("nothing to roll back")
+		}
+		return m.migrateTo(target)
+
+	case "status":
+		current, err := m.current()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS")
+		for _, mig := range m.migrations {
+			status := "pending"
+			if mig.Version <= current {
+				status = "applied"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", mig.Version, mig.Name, status)
+		}
+		return w.Flush()
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
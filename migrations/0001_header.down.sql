@@ -0,0 +1,2 @@
+-- Orders live in header, so rolling back leaves the table and its columns in place.
+DROP INDEX IF EXISTS header_transactionnum_idx;
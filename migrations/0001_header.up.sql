@@ -0,0 +1,13 @@
+-- The header table belongs to the ColdFusion storefront, which creates orders in it. On a
+-- fresh database this creates the columns the portal relies on; on an existing one it only
+-- adds whichever of them are missing.
+CREATE TABLE IF NOT EXISTS header (
+	invoicenum           TEXT PRIMARY KEY,
+	transactionnum       TEXT,
+	authorizenet_results TEXT NOT NULL DEFAULT '',
+	authorizenet_ts      TIMESTAMPTZ
+);
+ALTER TABLE header ADD COLUMN IF NOT EXISTS transactionnum TEXT;
+ALTER TABLE header ADD COLUMN IF NOT EXISTS authorizenet_results TEXT NOT NULL DEFAULT '';
+ALTER TABLE header ADD COLUMN IF NOT EXISTS authorizenet_ts TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS header_transactionnum_idx ON header (transactionnum);
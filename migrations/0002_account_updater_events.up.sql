@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS account_updater_events (
+	id                          BIGSERIAL PRIMARY KEY,
+	report_month                TEXT NOT NULL,
+	customer_profile_id         TEXT NOT NULL,
+	customer_payment_profile_id TEXT NOT NULL,
+	change_type                 TEXT NOT NULL,
+	outcome                     TEXT NOT NULL,
+	reason_code                 TEXT NOT NULL,
+	reason_description          TEXT NOT NULL DEFAULT '',
+	old_card_number             TEXT NOT NULL DEFAULT '',
+	old_expiration_date         TEXT NOT NULL DEFAULT '',
+	new_card_number             TEXT NOT NULL DEFAULT '',
+	new_expiration_date         TEXT NOT NULL DEFAULT '',
+	update_time_utc             TEXT NOT NULL,
+	needs_contact               BOOLEAN NOT NULL DEFAULT false,
+	contacted_at                TIMESTAMPTZ,
+	recorded_at                 TIMESTAMPTZ NOT NULL DEFAULT now(),
+	UNIQUE (customer_payment_profile_id, reason_code, update_time_utc)
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+	id           BIGSERIAL PRIMARY KEY,
+	name         TEXT NOT NULL UNIQUE,
+	key_hash     TEXT NOT NULL UNIQUE,
+	scopes       TEXT[] NOT NULL,
+	created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+	revoked_at   TIMESTAMPTZ
+);
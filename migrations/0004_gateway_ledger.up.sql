@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS gateway_ledger (
+	id                  BIGSERIAL PRIMARY KEY,
+	created_at          TIMESTAMPTZ NOT NULL DEFAULT now(),
+	operation           TEXT NOT NULL,
+	request_id          TEXT NOT NULL DEFAULT '',
+	caller              TEXT NOT NULL DEFAULT '',
+	customer_profile_id TEXT NOT NULL DEFAULT '',
+	payment_profile_id  TEXT NOT NULL DEFAULT '',
+	invoice_number      TEXT NOT NULL DEFAULT '',
+	amount              NUMERIC(12, 2),
+	trans_id            TEXT NOT NULL DEFAULT '',
+	ref_trans_id        TEXT NOT NULL DEFAULT '',
+	response_code       TEXT NOT NULL DEFAULT '',
+	auth_code           TEXT NOT NULL DEFAULT '',
+	avs_result_code     TEXT NOT NULL DEFAULT '',
+	cvv_result_code     TEXT NOT NULL DEFAULT '',
+	success             BOOLEAN NOT NULL,
+	error               TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS gateway_ledger_created_at_idx ON gateway_ledger (created_at);
+CREATE INDEX IF NOT EXISTS gateway_ledger_trans_id_idx ON gateway_ledger (trans_id);
+CREATE INDEX IF NOT EXISTS gateway_ledger_ref_trans_id_idx ON gateway_ledger (ref_trans_id);
+CREATE INDEX IF NOT EXISTS gateway_ledger_invoice_number_idx ON gateway_ledger (invoice_number);
+CREATE INDEX IF NOT EXISTS gateway_ledger_customer_profile_id_idx ON gateway_ledger (customer_profile_id);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	caller          TEXT NOT NULL,
+	key             TEXT NOT NULL,
+	fingerprint     TEXT NOT NULL,
+	status_code     INTEGER,
+	content_type    TEXT NOT NULL DEFAULT '',
+	response_body   BYTEA,
+	created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+	completed_at    TIMESTAMPTZ,
+	expires_at      TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (caller, key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS customer_shipping_addresses;
+DROP TABLE IF EXISTS customer_payment_profiles;
+DROP TABLE IF EXISTS customer_profiles;
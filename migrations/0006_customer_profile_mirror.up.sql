@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS customer_profiles (
+	customer_profile_id  text PRIMARY KEY,
+	merchant_customer_id text NOT NULL DEFAULT '',
+	email                text NOT NULL DEFAULT '',
+	description          text NOT NULL DEFAULT '',
+	profile_type         text NOT NULL DEFAULT '',
+	synced_at            timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS customer_profiles_email_idx ON customer_profiles (lower(email));
+CREATE INDEX IF NOT EXISTS customer_profiles_merchant_customer_id_idx ON customer_profiles (merchant_customer_id);
+
+CREATE TABLE IF NOT EXISTS customer_payment_profiles (
+	customer_payment_profile_id text PRIMARY KEY,
+	customer_profile_id         text NOT NULL REFERENCES customer_profiles ON DELETE CASCADE,
+	customer_type               text NOT NULL DEFAULT '',
+	card_number                 text NOT NULL DEFAULT '',
+	bill_to                     jsonb
+);
+CREATE INDEX IF NOT EXISTS customer_payment_profiles_profile_idx ON customer_payment_profiles (customer_profile_id);
+
+CREATE TABLE IF NOT EXISTS customer_shipping_addresses (
+	customer_address_id text PRIMARY KEY,
+	customer_profile_id text NOT NULL REFERENCES customer_profiles ON DELETE CASCADE,
+	first_name          text NOT NULL DEFAULT '',
+	last_name           text NOT NULL DEFAULT '',
+	address             text NOT NULL DEFAULT '',
+	city                text NOT NULL DEFAULT '',
+	state               text NOT NULL DEFAULT '',
+	zip                 text NOT NULL DEFAULT '',
+	country             text NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS customer_shipping_addresses_profile_idx ON customer_shipping_addresses (customer_profile_id);
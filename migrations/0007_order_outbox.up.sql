@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS order_outbox (
+	id                  BIGSERIAL PRIMARY KEY,
+	created_at          TIMESTAMPTZ NOT NULL DEFAULT now(),
+	original_trans_id   TEXT NOT NULL,
+	new_trans_id        TEXT NOT NULL,
+	result              TEXT NOT NULL,
+	attempts            INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at     TIMESTAMPTZ NOT NULL,
+	last_error          TEXT NOT NULL DEFAULT '',
+	delivered_at        TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS order_outbox_pending_idx ON order_outbox (next_attempt_at) WHERE delivered_at IS NULL;
@@ -0,0 +1,3 @@
+-- Gateway results recorded against an order as a JSON array, replacing the '|'-joined
+-- authorizenet_results string. Existing rows keep their old results in authorizenet_results.
+ALTER TABLE header ADD COLUMN IF NOT EXISTS gateway_results JSONB NOT NULL DEFAULT '[]';
@@ -0,0 +1 @@
+ALTER TABLE header DROP COLUMN IF EXISTS payment_status;
@@ -0,0 +1,4 @@
+-- Where the order's payment stands, set whenever a gateway result is recorded against it.
+ALTER TABLE header ADD COLUMN IF NOT EXISTS payment_status TEXT
+	CHECK (payment_status IN ('authorized', 'captured', 'voided', 'refunded'));
+CREATE INDEX IF NOT EXISTS header_payment_status_idx ON header (payment_status);
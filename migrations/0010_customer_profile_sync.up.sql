@@ -0,0 +1,7 @@
+-- The last completed full sync of the customer profile mirror. Until the row exists the
+-- mirror is still being built and searches are refused.
+CREATE TABLE IF NOT EXISTS customer_profile_sync (
+	id           BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+	started_at   TIMESTAMPTZ NOT NULL,
+	completed_at TIMESTAMPTZ NOT NULL
+);
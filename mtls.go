@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// clientCertConfig enables mutual TLS. With a CA bundle configured, client certificates
+// signed by it are verified during the handshake and their subjects mapped to scopes.
+type clientCertConfig struct {
+	// CAFile is a PEM bundle of the CAs allowed to sign client certificates. Empty disables mTLS.
+	CAFile string
+	// Require rejects connections without a valid client certificate. Otherwise a
+	// certificate is optional and callers may still use an API key.
+	Require bool
+	// Scopes maps a certificate subject, either the full RFC 2253 subject or "CN=<name>",
+	// to the scopes it grants.
+	Scopes map[string][]string
+}
+
+// parseCertScopes reads CLIENT_CERT_SCOPES, a ';'-separated list of subject=scopes pairs:
+//
+//	CN=coldfusion.handbellworld.com=profiles:read,profiles:write,charge,capture;CN=ops,O=Handbell World=admin
+//
+// Subjects contain '=' themselves, so the scopes start after the last one.
+func parseCertScopes(spec string) (map[string][]string, error) {
+	mapping := map[string][]string{}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid certificate scope entry %q, expected subject=scopes", entry)
+		}
+		subject := strings.TrimSpace(entry[:i])
+		scopes, err := parseScopes(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("certificate subject %q: %v", subject, err)
+		}
+		mapping[subject] = scopes
+	}
+	return mapping, nil
+}
+
+// formatCertScopes is the inverse of parseCertScopes, with subjects sorted.
+func formatCertScopes(mapping map[string][]string) string {
+	entries := make([]string, 0, len(mapping))
+	for subject, scopes := range mapping {
+		entries = append(entries, subject+"="+strings.Join(scopes, ","))
+	}
+	slices.Sort(entries)
+	return strings.Join(entries, ";")
+}
+
+// serverTLSConfig builds the listener's TLS settings. It returns nil when mTLS is off so
+// the server keeps Go's defaults.
+func (c clientCertConfig) serverTLSConfig() (*tls.Config, error) {
+	if c.CAFile == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read client CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("client CA bundle contains no certificates")
+	}
+
+	clientAuth := tls.VerifyClientCertIfGiven
+	if c.Require {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientCAs:  pool,
+		ClientAuth: clientAuth,
+	}, nil
+}
+
+// scopesFor returns the scopes granted to a verified certificate subject.
+func (c clientCertConfig) scopesFor(subject pkix.Name) ([]string, bool) {
+	if scopes, ok := c.Scopes[subject.String()]; ok {
+		return scopes, true
+	}
+	scopes, ok := c.Scopes["CN="+subject.CommonName]
+	return scopes, ok
+}
+
+// verifiedClientCert returns the client certificate the TLS handshake verified, or nil.
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
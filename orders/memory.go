@@ -0,0 +1,107 @@
+package orders
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Memory is a Repository held in memory, for tests and offline development.
+type Memory struct {
+	mu     sync.Mutex
+	orders map[string]*Order
+
+	// Err, when set, is returned by every method, to simulate the database being down.
+	Err error
+}
+
+// NewMemory returns a Memory holding copies of orders.
+func NewMemory(orders ...Order) *Memory {
+	m := &Memory{orders: map[string]*Order{}}
+	for _, o := range orders {
+		m.Put(o)
+	}
+	return m
+}
+
+// Put adds or replaces an order, as the storefront does when a customer checks out.
+func (m *Memory) Put(o Order) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o.Results = slices.Clone(o.Results)
+	m.orders[o.InvoiceNumber] = &o
+}
+
+func (m *Memory) find(key string, byInvoice bool) *Order {
+	if byInvoice {
+		return m.orders[key]
+	}
+	for _, o := range m.orders {
+		if o.TransactionNum == key {
+			return o
+		}
+	}
+	return nil
+}
+
+func (m *Memory) lookup(key string, byInvoice bool) (*Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	o := m.find(key, byInvoice)
+	if o == nil {
+		return nil, ErrNotFound
+	}
+	c := *o
+	c.Results = slices.Clone(o.Results)
+	return &c, nil
+}
+
+func (m *Memory) ByInvoice(invoiceNumber string) (*Order, error) {
+	return m.lookup(invoiceNumber, true)
+}
+
+func (m *Memory) ByTransactionNum(transId string) (*Order, error) {
+	return m.lookup(transId, false)
+}
+
+func (m *Memory) InvoicesByTransactionNum(transIds []string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	invoices := map[string]string{}
+	for _, id := range transIds {
+		if o := m.find(id, false); o != nil {
+			invoices[id] = o.InvoiceNumber
+		}
+	}
+	return invoices, nil
+}
+
+func (m *Memory) Record(r Result) error {
+	key, byInvoice, err := lookupKey(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return m.Err
+	}
+	o := m.find(key, byInvoice)
+	if o == nil || slices.ContainsFunc(o.Results, func(existing Result) bool { return existing.Equal(r) }) {
+		return ErrNotFound
+	}
+	o.Results = append(o.Results, r)
+	now := time.Now()
+	o.UpdatedAt = &now
+	o.Status = statusAfter(r)
+	if movesTransaction(r) {
+		o.TransactionNum = r.TransId
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Package orders records what the payment gateway did to our orders. Orders live in the
+// storefront's header table, keyed by invoice number; transactionnum holds the gateway
+// transaction currently standing for the order's payment.
+//
+// Each gateway result is appended to the order as structured JSON, so the history can be
+// queried instead of split apart from a '|'-joined string:
+//
+//	repo := orders.NewPostgres(db)
+//	err := repo.Record(orders.Result{Operation: orders.Capture, TransId: "120", RefTransId: "119"})
+//	order, err := repo.ByInvoice("INV-1001")
+package orders
+
+import (
+	"errors"
+	"time"
+)
+
+// Operations a Result can record.
+const (
+	Auth    = "auth"
+	Charge  = "charge"
+	Capture = "capture"
+	Refund  = "refund"
+	Void    = "void"
+)
+
+// Payment statuses an order moves through as results are recorded.
+const (
+	StatusAuthorized = "authorized"
+	StatusCaptured   = "captured"
+	StatusVoided     = "voided"
+	StatusRefunded   = "refunded"
+)
+
+// ErrNotFound is returned when no order matches a lookup or a Result.
+var ErrNotFound = errors.New("order not found")
+
+// Result is the outcome of one gateway operation on an order.
+type Result struct {
+	Operation     string    `json:"operation"`
+	InvoiceNumber string    `json:"invoiceNumber,omitempty"`
+	TransId       string    `json:"transId"`
+	RefTransId    string    `json:"refTransId,omitempty"`
+	Amount        string    `json:"amount,omitempty"`
+	ResponseCode  string    `json:"responseCode,omitempty"`
+	AuthCode      string    `json:"authCode,omitempty"`
+	AvsResultCode string    `json:"avsResultCode,omitempty"`
+	CvvResultCode string    `json:"cvvResultCode,omitempty"`
+	RecordedAt    time.Time `json:"recordedAt"`
+}
+
+// Order is a row of the header table as far as payments are concerned.
+type Order struct {
+	InvoiceNumber  string     `json:"invoiceNumber"`
+	TransactionNum string     `json:"transactionNum"`
+	Status         string     `json:"status,omitempty"`
+	UpdatedAt      *time.Time `json:"updatedAt,omitempty"`
+	Results        []Result   `json:"results"`
+}
+
+// Repository finds orders and records gateway results against them.
+type Repository interface {
+	// ByInvoice returns the order with the given invoice number.
+	ByInvoice(invoiceNumber string) (*Order, error)
+	// ByTransactionNum returns the order whose payment is currently transId.
+	ByTransactionNum(transId string) (*Order, error)
+	// InvoicesByTransactionNum maps gateway transaction IDs to invoice numbers, leaving out
+	// transactions that don't belong to an order.
+	InvoicesByTransactionNum(transIds []string) (map[string]string, error)
+
+	// Record appends r to its order and sets the order's status. Auth and Charge find the
+	// order by InvoiceNumber and make TransId its transaction; Capture finds it by
+	// RefTransId and moves it to TransId; Refund and Void find it by RefTransId. Recording
+	// the same Result twice changes nothing the second time and returns ErrNotFound, as
+	// does a Result with no order.
+	Record(r Result) error
+}
+
+// lookupKey is the column value Record finds r's order by.
+func lookupKey(r Result) (key string, byInvoice bool, err error) {
+	switch r.Operation {
+	case Auth, Charge:
+		return r.InvoiceNumber, true, nil
+	case Capture, Refund, Void:
+		return r.RefTransId, false, nil
+	}
+	return "", false, errors.New("unknown order operation " + r.Operation)
+}
+
+// statusAfter is an order's status once r is recorded. A partial refund still marks the
+// order refunded; the results say how much.
+func statusAfter(r Result) string {
+	switch r.Operation {
+	case Auth:
+		return StatusAuthorized
+	case Charge, Capture:
+		return StatusCaptured
+	case Void:
+		return StatusVoided
+	}
+	return StatusRefunded
+}
+
+// movesTransaction reports whether r replaces the order's transactionnum with r.TransId.
+func movesTransaction(r Result) bool {
+	return r.Operation == Auth || r.Operation == Charge || r.Operation == Capture
+}
+
+// Equal reports whether r and other record the same operation.
+func (r Result) Equal(other Result) bool {
+	rt, ot := r.RecordedAt, other.RecordedAt
+	r.RecordedAt, other.RecordedAt = time.Time{}, time.Time{}
+	return r == other && rt.Equal(ot)
+}
@@ -0,0 +1,91 @@
+package orders
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryRecord(t *testing.T) {
+	repo := NewMemory(Order{InvoiceNumber: "INV-1"}, Order{InvoiceNumber: "INV-2", TransactionNum: "200"})
+	at := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		result         Result
+		transactionNum string
+		status         string
+	}{
+		{Result{Operation: Auth, InvoiceNumber: "INV-1", TransId: "100", Amount: "10.00", RecordedAt: at}, "100", StatusAuthorized},
+		{Result{Operation: Capture, TransId: "101", RefTransId: "100", Amount: "10.00", RecordedAt: at}, "101", StatusCaptured},
+		{Result{Operation: Refund, TransId: "102", RefTransId: "101", Amount: "4.00", RecordedAt: at}, "101", StatusRefunded},
+	}
+	for _, step := range steps {
+		if err := repo.Record(step.result); err != nil {
+			t.Fatalf("%s: %v", step.result.Operation, err)
+		}
+		order, err := repo.ByInvoice("INV-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order.TransactionNum != step.transactionNum || order.Status != step.status {
+			t.Errorf("after %s transactionNum, status = %s, %s; want %s, %s", step.result.Operation,
+				order.TransactionNum, order.Status, step.transactionNum, step.status)
+		}
+	}
+
+	order, err := repo.ByTransactionNum("101")
+	if err != nil || order.InvoiceNumber != "INV-1" || len(order.Results) != 3 || order.UpdatedAt == nil {
+		t.Fatalf("order = %+v, err = %v", order, err)
+	}
+	if order.Results[2].Amount != "4.00" {
+		t.Errorf("refund result = %+v", order.Results[2])
+	}
+
+	t.Run("retried result is not recorded twice", func(t *testing.T) {
+		if err := repo.Record(steps[2].result); !errors.Is(err, ErrNotFound) {
+			t.Errorf("err = %v, want ErrNotFound", err)
+		}
+		if order, _ := repo.ByInvoice("INV-1"); len(order.Results) != 3 {
+			t.Errorf("results = %+v", order.Results)
+		}
+	})
+	t.Run("retried capture finds no order", func(t *testing.T) {
+		if err := repo.Record(steps[1].result); !errors.Is(err, ErrNotFound) {
+			t.Errorf("err = %v, want ErrNotFound", err)
+		}
+	})
+	t.Run("void", func(t *testing.T) {
+		if err := repo.Record(Result{Operation: Void, TransId: "200", RefTransId: "200", RecordedAt: at}); err != nil {
+			t.Fatal(err)
+		}
+		if order, _ := repo.ByInvoice("INV-2"); order.Status != StatusVoided || order.TransactionNum != "200" {
+			t.Errorf("order = %+v", order)
+		}
+	})
+	t.Run("unknown order", func(t *testing.T) {
+		if err := repo.Record(Result{Operation: Charge, InvoiceNumber: "INV-9", TransId: "900"}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("err = %v, want ErrNotFound", err)
+		}
+		if _, err := repo.ByTransactionNum("900"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("err = %v, want ErrNotFound", err)
+		}
+	})
+	t.Run("unknown operation", func(t *testing.T) {
+		if err := repo.Record(Result{Operation: "settle", RefTransId: "101"}); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("err = %v, want an operation error", err)
+		}
+	})
+	t.Run("invoices by transaction", func(t *testing.T) {
+		invoices, err := repo.InvoicesByTransactionNum([]string{"101", "200", "999"})
+		if err != nil || len(invoices) != 2 || invoices["101"] != "INV-1" || invoices["200"] != "INV-2" {
+			t.Errorf("invoices = %v, err = %v", invoices, err)
+		}
+	})
+	t.Run("lookups return copies", func(t *testing.T) {
+		order, _ := repo.ByInvoice("INV-1")
+		order.Results[0].Amount = "0.00"
+		if again, _ := repo.ByInvoice("INV-1"); again.Results[0].Amount != "10.00" {
+			t.Error("caller's copy changed the stored order")
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package orders
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// Postgres is a Repository over the header table.
+type Postgres struct {
+	db *sql.DB
+}
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+const orderColumns = `invoicenum, COALESCE(transactionnum, ''), COALESCE(payment_status, ''), authorizenet_ts, gateway_results`
+
+func (p *Postgres) scanOrder(row *sql.Row) (*Order, error) {
+	var o Order
+	var updatedAt sql.NullTime
+	var results []byte
+	err := row.Scan(&o.InvoiceNumber, &o.TransactionNum, &o.Status, &updatedAt, &results)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if updatedAt.Valid {
+		o.UpdatedAt = &updatedAt.Time
+	}
+	if err := json.Unmarshal(results, &o.Results); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (p *Postgres) ByInvoice(invoiceNumber string) (*Order, error) {
+	return p.scanOrder(p.db.QueryRow(`SELECT `+orderColumns+` FROM header WHERE invoicenum = $1`, invoiceNumber))
+}
+
+func (p *Postgres) ByTransactionNum(transId string) (*Order, error) {
+	return p.scanOrder(p.db.QueryRow(`SELECT `+orderColumns+` FROM header WHERE transactionnum = $1`, transId))
+}
+
+func (p *Postgres) InvoicesByTransactionNum(transIds []string) (map[string]string, error) {
+	invoices := make(map[string]string)
+	if len(transIds) == 0 {
+		return invoices, nil
+	}
+
+	rows, err := p.db.Query(`SELECT transactionnum, invoicenum FROM header WHERE transactionnum = ANY($1)`, pq.Array(transIds))
+	if err != nil {
+		return invoices, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var transId string
+		var invoice sql.NullString
+		if err := rows.Scan(&transId, &invoice); err != nil {
+			return invoices, err
+		}
+		invoices[transId] = invoice.String
+	}
+	return invoices, rows.Err()
+}
+
+func (p *Postgres) Record(r Result) error {
+	key, byInvoice, err := lookupKey(r)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal([]Result{r})
+	if err != nil {
+		return err
+	}
+
+	column := "transactionnum"
+	if byInvoice {
+		column = "invoicenum"
+	}
+	// The containment check makes a retried Record a no-op.
+	res, err := p.db.Exec(`
+		UPDATE header SET
+			gateway_results = gateway_results || $2::jsonb,
+			authorizenet_ts = now(),
+			transactionnum = CASE WHEN $4 THEN $3 ELSE transactionnum END,
+			payment_status = $5
+		WHERE `+column+` = $1 AND NOT gateway_results @> $2::jsonb`,
+		key, string(entry), r.TransId, movesTransaction(r), statusAfter(r))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
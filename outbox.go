@@ -0,0 +1,313 @@
+package main
+
+import (
+	"authnet/authorizenet"
+	"authnet/orders"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// orderOutboxLease is how long a claimed update is hidden from other workers while it
+	// is being applied.
+	orderOutboxLease = time.Minute
+	// orderOutboxStuckAttempts is the number of failed attempts after which an update is
+	// reported as stuck.
+	orderOutboxStuckAttempts = 5
+	// orderOutboxBatch bounds how many updates one pass of the worker claims.
+	orderOutboxBatch = 100
+)
+
+// OrderUpdate is a gateway result that still has to be recorded against its order.
+type OrderUpdate struct {
+	ID            int64         `json:"id"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	Result        orders.Result `json:"result"`
+	Attempts      int           `json:"attempts"`
+	NextAttemptAt time.Time     `json:"nextAttemptAt"`
+	LastError     string        `json:"lastError,omitempty"`
+}
+
+// OrderOutbox durably holds header updates until they have been applied, so a database
+// failure after the gateway has moved money is retried instead of lost.
+type OrderOutbox interface {
+	// Enqueue records an update. Workers leave it alone until notBefore, giving the
+	// caller the first attempt.
+	Enqueue(u OrderUpdate, notBefore time.Time) (OrderUpdate, error)
+	// Claim returns up to limit undelivered updates that are due, hiding them from other
+	// claims until now+lease.
+	Claim(limit int, lease time.Duration) ([]OrderUpdate, error)
+	// Delivered marks an update as applied.
+	Delivered(id int64) error
+	// Failed counts a failed attempt and schedules the next one.
+	Failed(id int64, cause string, next time.Time) error
+	// Pending lists undelivered updates with at least minAttempts failed attempts, oldest first.
+	Pending(minAttempts int) ([]OrderUpdate, error)
+	// Retry makes an undelivered update due immediately. It reports whether one was found.
+	Retry(id int64) (bool, error)
+}
+
+type postgresOrderOutbox struct {
+	db *sql.DB
+}
+
+const orderOutboxColumns = `id, created_at, original_trans_id, new_trans_id, result, attempts, next_attempt_at, last_error`
+
+func scanOrderUpdate(row rowScanner) (OrderUpdate, error) {
+	var u OrderUpdate
+	var originalTransId, newTransId, result string
+	err := row.Scan(&u.ID, &u.CreatedAt, &originalTransId, &newTransId, &result, &u.Attempts, &u.NextAttemptAt, &u.LastError)
+	if err != nil {
+		return u, err
+	}
+	if err := json.Unmarshal([]byte(result), &u.Result); err != nil {
+		return u, err
+	}
+	if u.Result.Operation == "" {
+		// Queued before results were structured: the body is the capture's API response.
+		u.Result = orders.Result{Operation: orders.Capture, TransId: newTransId, RefTransId: originalTransId}
+	}
+	return u, nil
+}
+
+func scanOrderUpdates(rows *sql.Rows) ([]OrderUpdate, error) {
+	defer rows.Close()
+	updates := []OrderUpdate{}
+	for rows.Next() {
+		u, err := scanOrderUpdate(rows)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, u)
+	}
+	return updates, rows.Err()
+}
+
+func (o *postgresOrderOutbox) Enqueue(u OrderUpdate, notBefore time.Time) (OrderUpdate, error) {
+	result, err := json.Marshal(u.Result)
+	if err != nil {
+		return u, err
+	}
+	row := o.db.QueryRow(`
+		INSERT INTO order_outbox (original_trans_id, new_trans_id, result, next_attempt_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING `+orderOutboxColumns,
+		u.Result.RefTransId, u.Result.TransId, string(result), notBefore)
+	return scanOrderUpdate(row)
+}
+
+func (o *postgresOrderOutbox) Claim(limit int, lease time.Duration) ([]OrderUpdate, error) {
+	rows, err := o.db.Query(`
+		UPDATE order_outbox SET next_attempt_at = now() + $2 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM order_outbox
+			WHERE delivered_at IS NULL AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+orderOutboxColumns, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanOrderUpdates(rows)
+}
+
+func (o *postgresOrderOutbox) Delivered(id int64) error {
+	_, err := o.db.Exec(`UPDATE order_outbox SET delivered_at = now(), last_error = '' WHERE id = $1`, id)
+	return err
+}
+
+func (o *postgresOrderOutbox) Failed(id int64, cause string, next time.Time) error {
+	_, err := o.db.Exec(`
+		UPDATE order_outbox SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3
+		WHERE id = $1`, id, cause, next)
+	return err
+}
+
+func (o *postgresOrderOutbox) Pending(minAttempts int) ([]OrderUpdate, error) {
+	rows, err := o.db.Query(`
+		SELECT `+orderOutboxColumns+` FROM order_outbox
+		WHERE delivered_at IS NULL AND attempts >= $1
+		ORDER BY created_at, id`, minAttempts)
+	if err != nil {
+		return nil, err
+	}
+	return scanOrderUpdates(rows)
+}
+
+func (o *postgresOrderOutbox) Retry(id int64) (bool, error) {
+	res, err := o.db.Exec(`UPDATE order_outbox SET next_attempt_at = now() WHERE id = $1 AND delivered_at IS NULL`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// orderOutboxBackoff is the delay before retrying an update that has failed attempts
+// times: 30s doubling up to an hour.
+func orderOutboxBackoff(attempts int) time.Duration {
+	delay := 30 * time.Second
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	return min(delay, time.Hour)
+}
+
+// applyOrderUpdate records an update against its order and marks it delivered. A failure
+// is recorded on the outbox row with the next retry time.
+func (app *application) applyOrderUpdate(u OrderUpdate) error {
+	err := app.orders.Record(u.Result)
+	if errors.Is(err, orders.ErrNotFound) {
+		// Either not one of our orders, or an earlier attempt already recorded it.
+		app.logger.Info("No order to update", "outbox_id", u.ID, "operation", u.Result.Operation,
+			"trans_id", u.Result.TransId, "ref_trans_id", u.Result.RefTransId, "invoice_number", u.Result.InvoiceNumber)
+	} else if err != nil {
+		next := time.Now().Add(orderOutboxBackoff(u.Attempts + 1))
+		if ferr := app.outbox.Failed(u.ID, err.Error(), next); ferr != nil {
+			app.logger.Error("Cannot record order update failure", "outbox_id", u.ID, "error", ferr)
+		}
+		return err
+	}
+	return app.outbox.Delivered(u.ID)
+}
+
+// recordOrder queues a gateway result for its order and tries to apply it straight away.
+// It fails only if the result could be neither queued nor applied, which leaves the order
+// out of step with the gateway.
+func (app *application) recordOrder(r *http.Request, result orders.Result) error {
+	logger := requestLogger(r)
+	update, err := app.outbox.Enqueue(OrderUpdate{Result: result}, time.Now().Add(orderOutboxLease))
+	if err != nil {
+		logger.Error("Cannot queue order update", "error", err)
+		// Nothing durable holds the update; write it directly as a last resort.
+		if err := app.orders.Record(result); err != nil && !errors.Is(err, orders.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+	if err := app.applyOrderUpdate(update); err != nil {
+		logger.Warn("Order update queued for retry", "outbox_id", update.ID, "error", err)
+	}
+	return nil
+}
+
+// orderResult describes a successful gateway response for the order history.
+func orderResult(operation, invoiceNumber, refTransId, amount string, resp *authorizenet.FullTransactionResponse) orders.Result {
+	return orders.Result{
+		Operation:     operation,
+		InvoiceNumber: invoiceNumber,
+		TransId:       resp.TransId,
+		RefTransId:    refTransId,
+		Amount:        amount,
+		ResponseCode:  resp.ResponseCode,
+		AuthCode:      resp.AuthCode,
+		AvsResultCode: resp.AvsResultCode,
+		CvvResultCode: resp.CvvResultCode,
+		RecordedAt:    time.Now().UTC(),
+	}
+}
+
+// drainOrderOutbox applies every due update once and returns how many were applied.
+func (app *application) drainOrderOutbox() (int, error) {
+	updates, err := app.outbox.Claim(orderOutboxBatch, orderOutboxLease)
+	if err != nil {
+		return 0, err
+	}
+	applied := 0
+	for _, u := range updates {
+		if err := app.applyOrderUpdate(u); err != nil {
+			level := slog.LevelWarn
+			if u.Attempts+1 >= orderOutboxStuckAttempts {
+				level = slog.LevelError
+			}
+			app.logger.Log(context.Background(), level, "Order update failed",
+				"outbox_id", u.ID, "operation", u.Result.Operation, "trans_id", u.Result.TransId,
+				"attempts", u.Attempts+1, "error", err)
+			continue
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// runOrderOutbox drains the outbox once per interval until ctx is done. Updates claimed
+// by an interrupted pass are retried once their lease runs out.
+func (app *application) runOrderOutbox(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := app.drainOrderOutbox()
+		if err != nil {
+			app.logger.Error("Order outbox drain failed", "error", err)
+			continue
+		}
+		if n > 0 {
+			app.logger.Info("Applied queued order updates", "updates", n)
+		}
+	}
+}
+
+// getOrderOutboxHandler serves GET /order-outbox, the header updates not yet applied.
+// With stuck=true only updates that have failed repeatedly are listed.
+func (app *application) getOrderOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	minAttempts := 0
+	if v := r.URL.Query().Get("stuck"); v != "" {
+		stuck, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "stuck must be true or false", http.StatusBadRequest)
+			return
+		}
+		if stuck {
+			minAttempts = orderOutboxStuckAttempts
+		}
+	}
+
+	updates, err := app.outbox.Pending(minAttempts)
+	if err != nil {
+		requestLogger(r).Error("Order outbox query failed", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updates)
+}
+
+// retryOrderUpdateHandler serves POST /order-outbox/{id}/retry, which makes a pending
+// update due now instead of waiting out its backoff.
+func (app *application) retryOrderUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid outbox id", http.StatusBadRequest)
+		return
+	}
+	annotate(r, slog.Int64("outbox_id", id))
+
+	found, err := app.outbox.Retry(id)
+	if err != nil {
+		requestLogger(r).Error("Order outbox retry failed", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "No pending order update with that id", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"authnet/authorizenet"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProfileQuery selects a page of customer profiles from the local index.
+type ProfileQuery struct {
+	Email              string
+	MerchantCustomerId string
+	Description        string
+
+	Limit int
+	// Offset skips this many matches. It is ignored when Cursor is set.
+	Offset int
+	// Cursor continues after the last profile of a previous page.
+	Cursor string
+}
+
+type ProfilePage struct {
+	Profiles   []authorizenet.CustomerProfile `json:"profiles"`
+	Total      int                            `json:"total"`
+	Limit      int                            `json:"limit"`
+	Offset     int                            `json:"offset,omitempty"`
+	NextCursor string                         `json:"nextCursor,omitempty"`
+}
+
+// ProfileIndex answers profile searches without going to the gateway for every profile.
+type ProfileIndex interface {
+	Search(q ProfileQuery) (*ProfilePage, error)
+}
+
+// ProfileMirror is a local copy of the gateway's customer profiles that can be searched.
+// Card numbers are only ever stored masked.
+type ProfileMirror interface {
+	ProfileIndex
+
+	// SaveProfile inserts or replaces a profile together with its payment profiles and
+	// shipping addresses.
+	SaveProfile(profile authorizenet.CustomerProfile) error
+	DeletePaymentProfile(customerProfileId, paymentProfileId string) error
+	DeleteShippingAddress(customerProfileId, addressId string) error
+	// ReplaceAll applies a full sync that began at started. ids is every profile ID at the
+	// gateway; profiles holds the ones that were fetched. Profiles missing from ids are
+	// removed unless they were saved after started, and profiles in ids that could not be
+	// fetched keep their previous copy.
+	ReplaceAll(started time.Time, ids []string, profiles []authorizenet.CustomerProfile) error
+}
+
+var (
+	errIndexNotReady = errors.New("customer profile index is still being built")
+	errInvalidCursor = errors.New("invalid cursor")
+)
+
+func encodeCursor(profileID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(profileID))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	id, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(id) == 0 {
+		return "", errInvalidCursor
+	}
+	return string(id), nil
+}
+
+// profileQueryParams are the query parameters that switch GET /customer-profiles to the index.
+var profileQueryParams = []string{"limit", "offset", "cursor", "email", "merchantCustomerId", "description"}
+
+func isProfileQuery(values url.Values) bool {
+	for _, key := range profileQueryParams {
+		if values.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseProfileQuery(values url.Values) (ProfileQuery, error) {
+	q := ProfileQuery{
+		Email:              strings.TrimSpace(values.Get("email")),
+		MerchantCustomerId: strings.TrimSpace(values.Get("merchantCustomerId")),
+		Description:        strings.TrimSpace(values.Get("description")),
+		Cursor:             values.Get("cursor"),
+		Limit:              100,
+	}
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > 1000 {
+			return q, errors.New("limit must be between 1 and 1000")
+		}
+		q.Limit = limit
+	}
+	if v := values.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return q, errors.New("offset must be zero or a positive integer")
+		}
+		q.Offset = offset
+	}
+	return q, nil
+}
+
+// searchCustomerProfilesHandler serves GET /customer-profiles when paging or filter
+// parameters are present.
+func (app *application) searchCustomerProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseProfileQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := app.profiles.Search(q)
+	switch {
+	case errors.Is(err, errInvalidCursor):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errIndexNotReady):
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		requestLogger(r).Error("Customer profile search failed", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
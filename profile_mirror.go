@@ -0,0 +1,403 @@
+package main
+
+import (
+	"authnet/authorizenet"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maskCardNumber keeps only the last four digits of a card number, in the gateway's
+// XXXX1111 format.
+func maskCardNumber(number string) string {
+	if len(number) <= 4 {
+		return number
+	}
+	return "XXXX" + number[len(number)-4:]
+}
+
+// maskProfile returns a copy of profile that is safe to mirror: card numbers are masked
+// and expiration dates dropped.
+func maskProfile(profile authorizenet.CustomerProfile) authorizenet.CustomerProfile {
+	if len(profile.PaymentProfiles) == 0 {
+		return profile
+	}
+	paymentProfiles := make([]authorizenet.PaymentProfile, len(profile.PaymentProfiles))
+	for i, pp := range profile.PaymentProfiles {
+		pp.Payment.CreditCard = authorizenet.CreditCard{CardNumber: maskCardNumber(pp.Payment.CreditCard.CardNumber)}
+		paymentProfiles[i] = pp
+	}
+	profile.PaymentProfiles = paymentProfiles
+	return profile
+}
+
+// postgresProfileMirror keeps the customer profile mirror in the customer_profiles,
+// customer_payment_profiles and customer_shipping_addresses tables. The mirror is ready
+// once ReplaceAll has recorded a completed sync in customer_profile_sync.
+type postgresProfileMirror struct {
+	db *sql.DB
+	// ready caches a completed sync so searches don't check for one every time.
+	ready atomic.Bool
+}
+
+func (m *postgresProfileMirror) SaveProfile(profile authorizenet.CustomerProfile) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := saveProfileTx(tx, profile, time.Now(), time.Time{}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveProfileTx writes profile with its synced_at set to syncedAt. The time comes from
+// the application rather than the database so ReplaceAll can compare it with the time
+// its sync started. A stored profile synced at or after keepSince is left as it is; the
+// zero time always overwrites.
+func saveProfileTx(tx *sql.Tx, profile authorizenet.CustomerProfile, syncedAt, keepSince time.Time) error {
+	profile = maskProfile(profile)
+
+	result, err := tx.Exec(`
+		INSERT INTO customer_profiles (customer_profile_id, merchant_customer_id, email, description, profile_type, synced_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (customer_profile_id) DO UPDATE SET
+			merchant_customer_id = EXCLUDED.merchant_customer_id,
+			email = EXCLUDED.email,
+			description = EXCLUDED.description,
+			profile_type = EXCLUDED.profile_type,
+			synced_at = EXCLUDED.synced_at
+		WHERE $7::timestamptz IS NULL OR customer_profiles.synced_at < $7::timestamptz`,
+		profile.CustomerProfileId, profile.MerchantCustomerId, profile.Email, profile.Description, profile.ProfileType, syncedAt,
+		sql.NullTime{Time: keepSince, Valid: !keepSince.IsZero()})
+	if err != nil {
+		return err
+	}
+	if written, err := result.RowsAffected(); err != nil || written == 0 {
+		// Either an error, or a newer stored copy whose cards and addresses stay as well.
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM customer_payment_profiles WHERE customer_profile_id = $1`, profile.CustomerProfileId); err != nil {
+		return err
+	}
+	for _, pp := range profile.PaymentProfiles {
+		var billTo []byte
+		if pp.BillTo != nil {
+			if billTo, err = json.Marshal(pp.BillTo); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`
+			INSERT INTO customer_payment_profiles (customer_payment_profile_id, customer_profile_id, customer_type, card_number, bill_to)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (customer_payment_profile_id) DO UPDATE SET
+				customer_profile_id = EXCLUDED.customer_profile_id,
+				customer_type = EXCLUDED.customer_type,
+				card_number = EXCLUDED.card_number,
+				bill_to = EXCLUDED.bill_to`,
+			pp.CustomerPaymentProfileId, profile.CustomerProfileId, pp.CustomerType, pp.Payment.CreditCard.CardNumber, billTo)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM customer_shipping_addresses WHERE customer_profile_id = $1`, profile.CustomerProfileId); err != nil {
+		return err
+	}
+	for _, a := range profile.ShipToList {
+		_, err := tx.Exec(`
+			INSERT INTO customer_shipping_addresses (customer_address_id, customer_profile_id, first_name, last_name, address, city, state, zip, country)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (customer_address_id) DO UPDATE SET
+				customer_profile_id = EXCLUDED.customer_profile_id,
+				first_name = EXCLUDED.first_name,
+				last_name = EXCLUDED.last_name,
+				address = EXCLUDED.address,
+				city = EXCLUDED.city,
+				state = EXCLUDED.state,
+				zip = EXCLUDED.zip,
+				country = EXCLUDED.country`,
+			a.CustomerAddressId, profile.CustomerProfileId, a.FirstName, a.LastName, a.Address, a.City, a.State, a.Zip, a.Country)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *postgresProfileMirror) DeletePaymentProfile(customerProfileId, paymentProfileId string) error {
+	_, err := m.db.Exec(`DELETE FROM customer_payment_profiles WHERE customer_profile_id = $1 AND customer_payment_profile_id = $2`,
+		customerProfileId, paymentProfileId)
+	return err
+}
+
+func (m *postgresProfileMirror) DeleteShippingAddress(customerProfileId, addressId string) error {
+	_, err := m.db.Exec(`DELETE FROM customer_shipping_addresses WHERE customer_profile_id = $1 AND customer_address_id = $2`,
+		customerProfileId, addressId)
+	return err
+}
+
+func (m *postgresProfileMirror) ReplaceAll(started time.Time, ids []string, profiles []authorizenet.CustomerProfile) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, profile := range profiles {
+		// A handler may have saved a newer copy after the sync fetched this one.
+		if err := saveProfileTx(tx, profile, now, started); err != nil {
+			return err
+		}
+	}
+	// Profiles saved by handlers since the sync started may be missing from ids.
+	_, err = tx.Exec(`DELETE FROM customer_profiles WHERE NOT (customer_profile_id = ANY($1)) AND synced_at < $2`, pq.Array(ids), started)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO customer_profile_sync (id, started_at, completed_at) VALUES (true, $1, $2)
+		ON CONFLICT (id) DO UPDATE SET started_at = EXCLUDED.started_at, completed_at = EXCLUDED.completed_at`,
+		started, now)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	m.ready.Store(true)
+	return nil
+}
+
+// checkReady returns errIndexNotReady until a full sync has completed.
+func (m *postgresProfileMirror) checkReady() error {
+	if m.ready.Load() {
+		return nil
+	}
+	var completed time.Time
+	err := m.db.QueryRow(`SELECT completed_at FROM customer_profile_sync`).Scan(&completed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errIndexNotReady
+	}
+	if err != nil {
+		return err
+	}
+	m.ready.Store(true)
+	return nil
+}
+
+// profileFilter is the WHERE clause shared by the count and page queries; $1..$3 are
+// email, merchantCustomerId and the escaped description pattern.
+const profileFilter = `
+	($1::text = '' OR lower(email) = lower($1::text))
+	AND ($2::text = '' OR merchant_customer_id = $2::text)
+	AND ($3::text = '' OR description ILIKE '%' || $3::text || '%')`
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (m *postgresProfileMirror) Search(q ProfileQuery) (*ProfilePage, error) {
+	if err := m.checkReady(); err != nil {
+		return nil, err
+	}
+
+	after := ""
+	if q.Cursor != "" {
+		var err error
+		if after, err = decodeCursor(q.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	page := &ProfilePage{Profiles: []authorizenet.CustomerProfile{}, Limit: q.Limit}
+	offset := 0
+	if q.Cursor == "" {
+		page.Offset = q.Offset
+		offset = q.Offset
+	}
+
+	description := likeEscaper.Replace(q.Description)
+	err := m.db.QueryRow(`SELECT count(*) FROM customer_profiles WHERE`+profileFilter,
+		q.Email, q.MerchantCustomerId, description).Scan(&page.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.Query(`
+		SELECT customer_profile_id, merchant_customer_id, email, description, profile_type
+		FROM customer_profiles
+		WHERE`+profileFilter+`
+			AND ($4::text = '' OR (length(customer_profile_id), customer_profile_id) > (length($4::text), $4::text))
+		ORDER BY length(customer_profile_id), customer_profile_id
+		LIMIT $5 OFFSET $6`,
+		q.Email, q.MerchantCustomerId, description, after, q.Limit+1, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p authorizenet.CustomerProfile
+		if err := rows.Scan(&p.CustomerProfileId, &p.MerchantCustomerId, &p.Email, &p.Description, &p.ProfileType); err != nil {
+			return nil, err
+		}
+		page.Profiles = append(page.Profiles, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Profiles) > q.Limit {
+		page.Profiles = page.Profiles[:q.Limit]
+		page.NextCursor = encodeCursor(page.Profiles[len(page.Profiles)-1].CustomerProfileId)
+	}
+	if err := m.loadChildren(page.Profiles); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// loadChildren fills in the payment profiles and shipping addresses of profiles.
+func (m *postgresProfileMirror) loadChildren(profiles []authorizenet.CustomerProfile) error {
+	if len(profiles) == 0 {
+		return nil
+	}
+	ids := make([]string, len(profiles))
+	byID := make(map[string]*authorizenet.CustomerProfile, len(profiles))
+	for i := range profiles {
+		ids[i] = profiles[i].CustomerProfileId
+		byID[ids[i]] = &profiles[i]
+	}
+
+	rows, err := m.db.Query(`
+		SELECT customer_profile_id, customer_payment_profile_id, customer_type, card_number, bill_to
+		FROM customer_payment_profiles
+		WHERE customer_profile_id = ANY($1)
+		ORDER BY customer_payment_profile_id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var profileID string
+		var pp authorizenet.PaymentProfile
+		var billTo []byte
+		if err := rows.Scan(&profileID, &pp.CustomerPaymentProfileId, &pp.CustomerType, &pp.Payment.CreditCard.CardNumber, &billTo); err != nil {
+			return err
+		}
+		if billTo != nil {
+			pp.BillTo = &authorizenet.ShippingAddress{}
+			if err := json.Unmarshal(billTo, pp.BillTo); err != nil {
+				return err
+			}
+		}
+		p := byID[profileID]
+		p.PaymentProfiles = append(p.PaymentProfiles, pp)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = m.db.Query(`
+		SELECT customer_profile_id, customer_address_id, first_name, last_name, address, city, state, zip, country
+		FROM customer_shipping_addresses
+		WHERE customer_profile_id = ANY($1)
+		ORDER BY customer_address_id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var profileID string
+		var a authorizenet.ShippingAddress
+		if err := rows.Scan(&profileID, &a.CustomerAddressId, &a.FirstName, &a.LastName, &a.Address, &a.City, &a.State, &a.Zip, &a.Country); err != nil {
+			return err
+		}
+		p := byID[profileID]
+		p.ShipToList = append(p.ShipToList, a)
+	}
+	return rows.Err()
+}
+
+// profileSyncJob periodically copies every customer profile from the gateway into the mirror.
+type profileSyncJob struct {
+	client   PaymentGateway
+	mirror   ProfileMirror
+	fetch    authorizenet.FetchOptions
+	interval time.Duration
+}
+
+func newProfileSyncJob(client PaymentGateway, mirror ProfileMirror, fetch authorizenet.FetchOptions, interval time.Duration) *profileSyncJob {
+	return &profileSyncJob{client: client, mirror: mirror, fetch: fetch, interval: interval}
+}
+
+// Run syncs immediately and then once per interval until ctx is done.
+func (j *profileSyncJob) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := j.Sync(); err != nil {
+			slog.Error("Customer profile sync failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync lists every profile ID, fetches the profiles and replaces the mirror's contents.
+// Profiles that fail to load keep their previous copy; a failure listing profile IDs
+// leaves the mirror untouched.
+func (j *profileSyncJob) Sync() error {
+	started := time.Now()
+	skipped := 0
+
+	ids, err := j.client.GetAllCustomerProfileIds()
+	if err != nil {
+		return err
+	}
+
+	profiles, err := j.client.GetCustomerProfilesWithOptions(ids, j.fetch)
+	var partial *authorizenet.PartialFetchError
+	if errors.As(err, &partial) {
+		skipped = len(partial.Failed)
+		for _, failed := range partial.Failed {
+			slog.Warn("Customer profile sync skipped profile", "customer_profile_id", failed.ProfileId, "error", failed.Err)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := j.mirror.ReplaceAll(started, ids, profiles); err != nil {
+		return err
+	}
+
+	slog.Info("Customer profiles synced", "profiles", len(ids), "skipped", skipped, "latency", time.Since(started))
+	return nil
+}
+
+// mirrorProfile refreshes one profile in the mirror from the gateway after a handler has
+// changed it. Failures are only logged; the next full sync repairs the mirror.
+func (app *application) mirrorProfile(r *http.Request, profileID string) {
+	profile, err := app.gateway(r).GetCustomerProfile(profileID)
+	if err == nil {
+		err = app.profiles.SaveProfile(*profile)
+	}
+	if err != nil {
+		requestLogger(r).Warn("Customer profile mirror update failed", "customer_profile_id", profileID, "error", err)
+	}
+}
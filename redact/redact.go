@@ -0,0 +1,227 @@
+// Package redact masks card data and gateway credentials before anything is written to a log.
+//
+// Values are redacted by field name (cardNumber, cardCode, expirationDate, accountNumber,
+// routingNumber, transactionKey, ...) wherever they appear in a struct or JSON document, and any
+// remaining run of 13 to 19 digits in free text is treated as a card number.
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Mask replaces values that must not be logged at all.
+	Mask = "[REDACTED]"
+	// maskPrefix replaces all but the last four digits of card and bank account numbers.
+	maskPrefix = "XXXX"
+)
+
+// keepLastFour are fields whose last four digits are still useful for support.
+var keepLastFour = map[string]bool{
+	"cardnumber":    true,
+	"accountnumber": true,
+	"pan":           true,
+}
+
+// sensitiveKeys are fields that are replaced entirely. Keys are compared case-insensitively
+// with dashes and underscores removed.
+var sensitiveKeys = map[string]bool{
+	"cardcode":       true,
+	"cvv":            true,
+	"cvv2":           true,
+	"cvc":            true,
+	"expirationdate": true,
+	"expdate":        true,
+	"routingnumber":  true,
+	"transactionkey": true,
+	"password":       true,
+	"secret":         true,
+	"apikey":         true,
+	"authorization":  true,
+	"track1":         true,
+	"track2":         true,
+}
+
+var panPattern = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+
+func normalizeKey(key string) string {
+	key = strings.ToLower(key)
+	key = strings.ReplaceAll(key, "_", "")
+	return strings.ReplaceAll(key, "-", "")
+}
+
+// IsSensitiveKey reports whether a field with this name is masked.
+func IsSensitiveKey(key string) bool {
+	k := normalizeKey(key)
+	return sensitiveKeys[k] || keepLastFour[k]
+}
+
+func lastFour(s string) string {
+	var digits []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] >= '0' && s[i] <= '9' {
+			digits = append(digits, s[i])
+		}
+	}
+	if len(digits) <= 4 {
+		return maskPrefix
+	}
+	return maskPrefix + string(digits[len(digits)-4:])
+}
+
+func maskField(key, value string) string {
+	if value == "" {
+		return value
+	}
+	if keepLastFour[normalizeKey(key)] {
+		return lastFour(value)
+	}
+	return Mask
+}
+
+// String masks anything that looks like a card number in free text.
+func String(s string) string {
+	return panPattern.ReplaceAllStringFunc(s, lastFour)
+}
+
+// JSON returns body with every sensitive field masked. Bodies that are not valid JSON
+// are treated as free text.
+func JSON(body []byte) []byte {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return []byte(String(string(body)))
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return []byte(String(string(body)))
+	}
+
+	out, err := json.Marshal(walk("", doc))
+	if err != nil {
+		return []byte(String(string(body)))
+	}
+	return out
+}
+
+func walk(key string, v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			val[k] = walk(k, child)
+		}
+		return val
+	case []interface{}:
+		for i, child := range val {
+			val[i] = walk(key, child)
+		}
+		return val
+	case string:
+		if key != "" && IsSensitiveKey(key) {
+			return maskField(key, val)
+		}
+		return String(val)
+	case json.Number:
+		if key != "" && IsSensitiveKey(key) {
+			return maskField(key, val.String())
+		}
+		if s := String(val.String()); s != val.String() {
+			return s
+		}
+		return val
+	}
+	return v
+}
+
+// Value renders any value for logging with sensitive fields masked. Structs, maps and slices
+// are rendered through their JSON form so field names are known; strings and byte slices are
+// treated as request or response bodies.
+func Value(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "<nil>"
+	case string:
+		return string(JSON([]byte(val)))
+	case []byte:
+		return string(JSON(val))
+	case error:
+		return String(val.Error())
+	case fmt.Stringer:
+		return String(val.String())
+	}
+
+	switch reflect.Indirect(reflect.ValueOf(v)).Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		data, err := json.Marshal(v)
+		if err != nil {
+			// Never fall back to %+v here: it would print the fields we are trying to hide.
+			return fmt.Sprintf("<unloggable %T>", v)
+		}
+		return string(JSON(data))
+	}
+	return String(fmt.Sprint(v))
+}
+
+// Sprintf formats like fmt.Sprintf after redacting every argument. Verbs such as %+v and %s
+// print the redacted rendering of the argument.
+func Sprintf(format string, args ...interface{}) string {
+	safe := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch arg.(type) {
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool:
+			safe[i] = arg
+		default:
+			safe[i] = Value(arg)
+		}
+	}
+	return String(fmt.Sprintf(format, safe...))
+}
+
+// Printf logs through the standard logger with every argument redacted.
+func Printf(format string, args ...interface{}) {
+	log.Output(2, Sprintf(format, args...))
+}
+
+// Println logs through the standard logger with every argument redacted.
+func Println(args ...interface{}) {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		parts[i] = Value(arg)
+	}
+	log.Output(2, String(strings.Join(parts, " ")))
+}
+
+// ReplaceAttr is a slog.HandlerOptions.ReplaceAttr that masks sensitive attributes. Structs,
+// maps, slices and byte slices logged with slog.Any are rendered through Value.
+func ReplaceAttr(groups []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		if IsSensitiveKey(a.Key) {
+			return slog.String(a.Key, maskField(a.Key, a.Value.String()))
+		}
+		return slog.String(a.Key, String(a.Value.String()))
+	case slog.KindAny:
+		v := a.Value.Any()
+		if IsSensitiveKey(a.Key) {
+			return slog.String(a.Key, maskField(a.Key, fmt.Sprint(v)))
+		}
+		return slog.String(a.Key, Value(v))
+	case slog.KindInt64, slog.KindUint64:
+		if IsSensitiveKey(a.Key) {
+			return slog.String(a.Key, maskField(a.Key, a.Value.String()))
+		}
+		if s := String(a.Value.String()); s != a.Value.String() {
+			return slog.String(a.Key, s)
+		}
+	}
+	return a
+}
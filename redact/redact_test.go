@@ -0,0 +1,181 @@
+package redact
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+const (
+	testPAN            = "4111111111111111"
+	testCVV            = "9731"
+	testExpiration     = "2031-07"
+	testAccountNumber  = "123456789012"
+	testRoutingNumber  = "121042882"
+	testTransactionKey = "8zQ4Yt2sW9bK3mPx"
+)
+
+// leaks reports which of the test secrets appear in s.
+func leaks(s string) []string {
+	var found []string
+	for _, secret := range []string{testPAN, testCVV, testExpiration, testAccountNumber, testRoutingNumber, testTransactionKey} {
+		if strings.Contains(s, secret) {
+			found = append(found, secret)
+		}
+	}
+	return found
+}
+
+type merchantAuthentication struct {
+	Name           string `json:"name"`
+	TransactionKey string `json:"transactionKey"`
+}
+
+type creditCard struct {
+	CardNumber     string `json:"cardNumber"`
+	ExpirationDate string `json:"expirationDate"`
+	CardCode       string `json:"cardCode,omitempty"`
+}
+
+type bankAccount struct {
+	AccountNumber string `json:"accountNumber"`
+	RoutingNumber string `json:"routingNumber"`
+}
+
+type chargeRequest struct {
+	MerchantAuthentication merchantAuthentication `json:"merchantAuthentication"`
+	Payment                struct {
+		CreditCard  *creditCard  `json:"creditCard,omitempty"`
+		BankAccount *bankAccount `json:"bankAccount,omitempty"`
+	} `json:"payment"`
+	Amount string `json:"amount"`
+}
+
+func newChargeRequest() chargeRequest {
+	var req chargeRequest
+	req.MerchantAuthentication = merchantAuthentication{Name: "login", TransactionKey: testTransactionKey}
+	req.Payment.CreditCard = &creditCard{CardNumber: testPAN, ExpirationDate: testExpiration, CardCode: testCVV}
+	req.Payment.BankAccount = &bankAccount{AccountNumber: testAccountNumber, RoutingNumber: testRoutingNumber}
+	req.Amount = "12.50"
+	return req
+}
+
+func TestValueStruct(t *testing.T) {
+	out := Value(newChargeRequest())
+	if found := leaks(out); len(found) > 0 {
+		t.Fatalf("Value leaked %v in %s", found, out)
+	}
+	for _, want := range []string{"XXXX1111", "XXXX9012", `"amount":"12.50"`, `"name":"login"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Value output %s missing %s", out, want)
+		}
+	}
+}
+
+func TestValuePointer(t *testing.T) {
+	req := newChargeRequest()
+	if found := leaks(Value(&req)); len(found) > 0 {
+		t.Fatalf("Value leaked %v for pointer", found)
+	}
+}
+
+func TestJSONBodies(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"nested card", `{"payment":{"creditCard":{"cardNumber":"4111111111111111","expirationDate":"2031-07","cardCode":"9731"}}}`},
+		{"transaction key", `{"createTransactionRequest":{"merchantAuthentication":{"name":"x","transactionKey":"8zQ4Yt2sW9bK3mPx"}}}`},
+		{"bank account", `{"bankAccount":{"accountNumber":"123456789012","routingNumber":"121042882"}}`},
+		{"numeric card", `{"cardNumber":4111111111111111,"cvv":9731}`},
+		{"array of cards", `[{"cardNumber":"4111111111111111"},{"CardNumber":"4111111111111111","Expiration_Date":"2031-07"}]`},
+		{"card in free text field", `{"description":"card 4111 1111 1111 1111 exp soon"}`},
+		{"leading whitespace", "  \n" + `{"cardNumber":"4111111111111111"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := string(JSON([]byte(tt.body)))
+			if found := leaks(out); len(found) > 0 {
+				t.Fatalf("JSON leaked %v in %s", found, out)
+			}
+		})
+	}
+}
+
+func TestJSONMalformedBodyFallsBackToText(t *testing.T) {
+	out := string(JSON([]byte(`{"cardNumber":"4111111111111111", broken`)))
+	if strings.Contains(out, testPAN) {
+		t.Fatalf("malformed body leaked card number: %s", out)
+	}
+}
+
+func TestJSONKeepsOtherFields(t *testing.T) {
+	out := string(JSON([]byte(`{"customerProfileId":"918273645","amount":"10.00","transId":"120012345678"}`)))
+	for _, want := range []string{"918273645", "10.00", "120012345678"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("JSON output %s lost %s", out, want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"charged 4111111111111111 ok", "charged XXXX1111 ok"},
+		{"charged 4111-1111-1111-1111 ok", "charged XXXX1111 ok"},
+		{"transId 120012345678", "transId 120012345678"},
+		{"no digits", "no digits"},
+	}
+	for _, tt := range tests {
+		if got := String(tt.in); got != tt.want {
+			t.Errorf("String(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPrintfDoesNotLeak(t *testing.T) {
+	var buf bytes.Buffer
+	orig := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(orig)
+
+	req := newChargeRequest()
+	Printf("request %+v body %s raw %v", req, []byte(`{"cardNumber":"4111111111111111"}`), `{"transactionKey":"8zQ4Yt2sW9bK3mPx"}`)
+	Println("decoded", req, testPAN)
+
+	if found := leaks(buf.String()); len(found) > 0 {
+		t.Fatalf("log output leaked %v: %s", found, buf.String())
+	}
+}
+
+func TestSprintfKeepsNumbers(t *testing.T) {
+	if got := Sprintf("%d items for %s", 3, "918273645"); got != "3 items for 918273645" {
+		t.Errorf("Sprintf = %q", got)
+	}
+}
+
+func TestReplaceAttrDoesNotLeak(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: ReplaceAttr}))
+
+	logger.Info("charge "+testPAN,
+		"request", newChargeRequest(),
+		"body", []byte(`{"cardNumber":"4111111111111111","cardCode":"9731"}`),
+		"transactionKey", testTransactionKey,
+		"cardNumber", int64(4111111111111111),
+		"note", "card "+testPAN,
+		"customer_profile_id", "918273645",
+	)
+
+	out := buf.String()
+	if found := leaks(out); len(found) > 0 {
+		t.Fatalf("slog output leaked %v: %s", found, out)
+	}
+	if !strings.Contains(out, `"customer_profile_id":"918273645"`) {
+		t.Errorf("slog output lost non-sensitive attribute: %s", out)
+	}
+}
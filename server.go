@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newServer builds the HTTPS server with the configured timeouts. ReadHeaderTimeout is
+// kept short so a client trickling headers can't hold a connection open.
+func newServer(cfg *config, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: min(cfg.ReadTimeout, 5*time.Second),
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// serve runs srv on ln until ctx is done, then stops accepting connections and waits up
+// to timeout for in-flight requests to finish. Requests still running at the deadline are
+// cut off and reported as an error.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, certFile, keyFile string, timeout time.Duration) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ServeTLS(ln, certFile, keyFile)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, draining in-flight requests", "timeout", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return err
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// noWriteDeadline lifts the server's WriteTimeout for a handler whose response
+// legitimately takes longer, such as listing every customer profile.
+func noWriteDeadline(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}